@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// accessLog logs one line per request to the destination of --access-log,
+// apart from the application log. It is nil with --access-log=off.
+var accessLog *log.Logger
+
+// clfTimeLayout is the time layout of the Common Log Format.
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// setupAccessLog sets up --access-log and --access-log-format: json keeps
+// the formatting chosen by openAccessLog, common and combined write lines
+// of the Common or Combined Log Format instead.
+func setupAccessLog(dest, format string) error {
+	if format != "json" && format != "common" && format != "combined" {
+		return fmt.Errorf("invalid --access-log-format %q (valid: json, common, combined)", format)
+	}
+	if err := openAccessLog(dest); err != nil || accessLog == nil {
+		return err
+	}
+	if format != "json" {
+		accessLog.Formatter = clfFormatter{combined: format == "combined"}
+	}
+	return nil
+}
+
+// openAccessLog opens the destination of --access-log: off, console
+// (standard output, formatted like the application log there) or
+// file:/path (JSON lines, appended).
+func openAccessLog(dest string) error {
+	switch {
+	case dest == "off":
+		return nil
+	case dest == "console":
+		accessLog = log.New()
+		accessLog.Out = os.Stdout
+		accessLog.Formatter = newConsoleFormatter()
+	case strings.HasPrefix(dest, "file:") && len(dest) > len("file:"):
+		file, err := os.OpenFile(strings.TrimPrefix(dest, "file:"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("could not open --access-log: %w", err)
+		}
+		accessLog = log.New()
+		accessLog.Out = file
+		accessLog.Formatter = &log.JSONFormatter{}
+	default:
+		return fmt.Errorf("invalid --access-log %q (valid: off, console, file:/path)", dest)
+	}
+	return nil
+}
+
+// accessLogHandler logs each request once it is answered: who asked for
+// what, the status, the size of the response and how long it took. It wraps
+// every other handler, so that refused requests are logged as well.
+func accessLogHandler(next http.Handler) http.Handler {
+	if accessLog == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		user, _, _ := r.BasicAuth()
+		accessLog.WithFields(log.Fields{
+			"method":      r.Method,
+			"path":        r.URL.RequestURI(),
+			"proto":       r.Proto,
+			"status":      recorder.code(),
+			"bytes":       recorder.written,
+			"duration_ms": time.Since(start).Milliseconds(),
+			"remote":      clientAddr(r),
+			"user":        user,
+			"referer":     r.Referer(),
+			"user_agent":  r.UserAgent(),
+			"request_id":  requestID(r.Context()),
+		}).Infof("%s %s %d", r.Method, r.URL.Path, recorder.code())
+	})
+}
+
+// clfFormatter formats the entries of accessLogHandler as lines of the
+// Common Log Format, or of the Combined Log Format which adds the referer
+// and the user agent:
+//
+//	127.0.0.1 - alice [02/Jan/2006:15:04:05 -0700] "GET /files/a.iso HTTP/1.1" 200 4096 "-" "curl/8.5.0"
+//
+// Missing values are "-", and the size is the body bytes actually written.
+type clfFormatter struct {
+	combined bool
+}
+
+func (f clfFormatter) Format(entry *log.Entry) ([]byte, error) {
+	field := func(key string) string {
+		value, _ := entry.Data[key].(string)
+		return value
+	}
+	size := "-"
+	if written, _ := entry.Data["bytes"].(int64); written > 0 {
+		size = strconv.FormatInt(written, 10)
+	}
+	var line bytes.Buffer
+	fmt.Fprintf(&line, "%s - %s [%s] \"%s %s %s\" %d %s",
+		clfValue(field("remote"), false), clfValue(field("user"), false), entry.Time.Format(clfTimeLayout),
+		clfEscape(field("method")), clfEscape(field("path")), clfEscape(field("proto")), entry.Data["status"], size)
+	if f.combined {
+		fmt.Fprintf(&line, " \"%s\" \"%s\"", clfValue(field("referer"), true), clfValue(field("user_agent"), true))
+	}
+	line.WriteByte('\n')
+	return line.Bytes(), nil
+}
+
+// clfValue returns value for a field of a log line, "-" if it is empty.
+// Unquoted fields cannot contain spaces, so these are escaped too.
+func clfValue(value string, quoted bool) string {
+	if value == "" {
+		return "-"
+	}
+	value = clfEscape(value)
+	if !quoted {
+		value = strings.ReplaceAll(value, " ", "\\x20")
+	}
+	return value
+}
+
+// clfEscape escapes quotes, backslashes and non-printable bytes as Apache
+// does, so that a request cannot forge log lines or break their quoting.
+func clfEscape(value string) string {
+	var escaped strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; {
+		case c == '"' || c == '\\':
+			escaped.WriteByte('\\')
+			escaped.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&escaped, "\\x%02x", c)
+		default:
+			escaped.WriteByte(c)
+		}
+	}
+	return escaped.String()
+}
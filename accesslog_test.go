@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+func TestCLFFormatter(t *testing.T) {
+	at := time.Date(2024, time.March, 5, 14, 7, 9, 0, time.FixedZone("", 3600))
+	download := log.Fields{
+		"method": "GET", "path": "/download/a%20b.iso?x=1", "proto": "HTTP/1.1", "status": 200, "bytes": int64(4096),
+		"remote": "192.0.2.1", "user": "alice", "referer": "https://example.com/", "user_agent": "curl/8.5.0",
+	}
+	failedPost := log.Fields{
+		"method": "POST", "path": "/upload", "proto": "HTTP/2.0", "status": 413, "bytes": int64(0),
+		"remote": "2001:db8::1", "user": "", "referer": "", "user_agent": "",
+	}
+	hostile := log.Fields{
+		"method": "GET", "path": "/", "proto": "HTTP/1.1", "status": 200, "bytes": int64(10),
+		"remote": "192.0.2.1", "user": "bob smith",
+		"referer":    "x\" 200 0 \"-\" \"forged\n192.0.2.9 - - [01/Jan/2024:00:00:00 +0000] \"GET /",
+		"user_agent": "tab\there \\ del\x7f \xff\x1b[31m",
+	}
+
+	for _, tc := range []struct {
+		name     string
+		fields   log.Fields
+		combined bool
+		want     string
+	}{
+		{"download", download, false,
+			`192.0.2.1 - alice [05/Mar/2024:14:07:09 +0100] "GET /download/a%20b.iso?x=1 HTTP/1.1" 200 4096`},
+		{"download", download, true,
+			`192.0.2.1 - alice [05/Mar/2024:14:07:09 +0100] "GET /download/a%20b.iso?x=1 HTTP/1.1" 200 4096 "https://example.com/" "curl/8.5.0"`},
+		{"failed POST", failedPost, false,
+			`2001:db8::1 - - [05/Mar/2024:14:07:09 +0100] "POST /upload HTTP/2.0" 413 -`},
+		{"failed POST", failedPost, true,
+			`2001:db8::1 - - [05/Mar/2024:14:07:09 +0100] "POST /upload HTTP/2.0" 413 - "-" "-"`},
+		{"hostile", hostile, true,
+			`192.0.2.1 - bob\x20smith [05/Mar/2024:14:07:09 +0100] "GET / HTTP/1.1" 200 10 ` +
+				`"x\" 200 0 \"-\" \"forged\x0a192.0.2.9 - - [01/Jan/2024:00:00:00 +0000] \"GET /" ` +
+				`"tab\x09here \\ del\x7f \xff\x1b[31m"`},
+	} {
+		line, err := clfFormatter{combined: tc.combined}.Format(&log.Entry{Time: at, Data: tc.fields})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(line); got != tc.want+"\n" {
+			t.Errorf("%s, combined %t:\n got %s\nwant %s", tc.name, tc.combined, got, tc.want)
+		}
+	}
+}
+
+func TestAccessLogLines(t *testing.T) {
+	for _, format := range []string{"common", "combined"} {
+		logPath := filepath.Join(t.TempDir(), "access.log")
+		server, dir := newTestServer(t, "--access-log", "file:"+logPath, "--access-log-format", format)
+		file := accessLog.Out.(*os.File)
+		t.Cleanup(func() {
+			file.Close()
+			accessLog = nil
+		})
+		writeFile(t, dir, "a.txt", "hello")
+
+		req := newRequest(t, http.MethodGet, server.URL+"/download/a.txt", nil)
+		req.Header.Set("Referer", server.URL+"/")
+		req.Header.Set("User-Agent", `evil "agent"`)
+		send(t, req)
+		req = newRequest(t, http.MethodPost, server.URL+"/upload", strings.NewReader("x"))
+		req.Header.Set("User-Agent", "curl/8.5.0")
+		_, body := send(t, req)
+
+		data, err := os.ReadFile(logPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The time is the only part that cannot be known in advance
+		got := regexp.MustCompile(`\[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\]`).ReplaceAllString(string(data), "[TIME]")
+		want := []string{
+			`127.0.0.1 - - [TIME] "GET /download/a.txt HTTP/1.1" 200 5`,
+			`127.0.0.1 - - [TIME] "POST /upload HTTP/1.1" 400 ` + strconv.Itoa(len(body)),
+		}
+		if format == "combined" {
+			want[0] += ` "` + server.URL + `/" "evil \"agent\""`
+			want[1] += ` "-" "curl/8.5.0"`
+		}
+		if wantLog := strings.Join(want, "\n") + "\n"; got != wantLog {
+			t.Errorf("%s:\n got %s\nwant %s", format, got, wantLog)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// wantsJSON reports whether the client asked for a JSON response, either
+// with ?json=1 or an Accept header listing application/json. HTMX requests
+// from the web UI always get the regular response.
+func wantsJSON(r *http.Request) bool {
+	if r.Header.Get("HX-Request") != "" {
+		return false
+	}
+	if r.URL.Query().Get("json") == "1" {
+		return true
+	}
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mediaType == "application/json" {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsPlainText reports whether the client asked for a plain text
+// response, either with ?format=txt or an Accept header that ranks
+// text/plain above text/html. Browsers, which prefer HTML, are unaffected.
+func wantsPlainText(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "txt" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return acceptQuality(accept, "text/plain") > acceptQuality(accept, "text/html")
+}
+
+// acceptQuality returns the q-value the Accept header gives to mediaType,
+// using the most specific matching range (exact, type/*, then */*). Media
+// types that are not acceptable get 0.
+func acceptQuality(accept, mediaType string) float64 {
+	mainType, _, _ := strings.Cut(mediaType, "/")
+	bestSpecificity, quality := -1, 0.0
+	for _, item := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(item))
+		if err != nil {
+			continue
+		}
+		specificity := -1
+		switch rangeType {
+		case mediaType:
+			specificity = 2
+		case mainType + "/*":
+			specificity = 1
+		case "*/*":
+			specificity = 0
+		}
+		if specificity <= bestSpecificity {
+			continue
+		}
+		bestSpecificity, quality = specificity, 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+	}
+	return quality
+}
+
+// readFields returns the fields of a POST request sent either as a form or as
+// a JSON object, for endpoints used by both the web UI and scripts. JSON true
+// becomes "1", false is left out.
+func readFields(r *http.Request) (url.Values, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		if err := r.ParseForm(); err != nil {
+			return nil, err
+		}
+		return r.PostForm, nil
+	}
+	var object map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&object); err != nil {
+		return nil, err
+	}
+	fields := url.Values{}
+	for key, value := range object {
+		switch value := value.(type) {
+		case string:
+			fields.Set(key, value)
+		case bool:
+			if value {
+				fields.Set(key, "1")
+			}
+		case nil:
+		default:
+			fields.Set(key, fmt.Sprint(value))
+		}
+	}
+	return fields, nil
+}
+
+// writeJSON sends v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		loggerFrom(r.Context()).Errorf("Failed to write JSON response: %v", err)
+	}
+}
+
+// writeJSONError sends an error as a JSON object {"error": msg}.
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, msg string) {
+	writeJSON(w, r, status, map[string]string{"error": msg})
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	authRealm         = `Basic realm="http-file-server", charset="UTF-8"`
+	authCacheMaxUsers = 1024
+)
+
+// errAuthBackend is returned when the verifier could not give an answer
+// (timeout, crash, unreachable). Access is denied, but not cached.
+var errAuthBackend = errors.New("authentication backend failed")
+
+// authEnabled reports whether requests need HTTP basic authentication.
+func authEnabled() bool {
+	return C.AuthExec != "" || C.AuthURL != ""
+}
+
+// validateAuth checks the authentication flags at startup.
+func validateAuth() error {
+	if C.AuthExec != "" && C.AuthURL != "" {
+		return fmt.Errorf("--auth-exec and --auth-url cannot be used together")
+	}
+	if C.AuthExec != "" && len(strings.Fields(C.AuthExec)) == 0 {
+		return fmt.Errorf("--auth-exec is empty")
+	}
+	if authEnabled() && C.AuthTimeout <= 0 {
+		return fmt.Errorf("--auth-timeout must be positive")
+	}
+	return nil
+}
+
+// authCache remembers the answers of the verifier for --auth-cache-ttl,
+// keyed by a hash of username and password so no password is kept.
+type authCache struct {
+	mu      sync.Mutex
+	answers map[[sha256.Size]byte]cachedAuth
+}
+
+type cachedAuth struct {
+	allowed bool
+	expires time.Time
+}
+
+var authAnswers = &authCache{answers: make(map[[sha256.Size]byte]cachedAuth)}
+
+func authKey(username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(username + "\x00" + password))
+}
+
+func (c *authCache) get(key [sha256.Size]byte) (allowed, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	answer, ok := c.answers[key]
+	if !ok || time.Now().After(answer.expires) {
+		return false, false
+	}
+	return answer.allowed, true
+}
+
+func (c *authCache) put(key [sha256.Size]byte, allowed bool) {
+	if C.AuthCacheTTL <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.answers) >= authCacheMaxUsers {
+		now := time.Now()
+		for k, answer := range c.answers {
+			if now.After(answer.expires) {
+				delete(c.answers, k)
+			}
+		}
+		if len(c.answers) >= authCacheMaxUsers {
+			c.answers = make(map[[sha256.Size]byte]cachedAuth)
+		}
+	}
+	c.answers[key] = cachedAuth{allowed: allowed, expires: time.Now().Add(C.AuthCacheTTL)}
+}
+
+// authHandler requires HTTP basic authentication, checked by --auth-exec or
+// --auth-url, for every request but /healthz. Verifier failures and
+// timeouts deny access (503, so clients do not ask for the password again).
+func authHandler(next http.Handler) http.Handler {
+	if !authEnabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFrom(r.Context())
+		if r.URL.Path == "/healthz" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		username, password, ok := r.BasicAuth()
+		if !ok {
+			w.Header().Set("WWW-Authenticate", authRealm)
+			http.Error(w, "Authentication required", http.StatusUnauthorized)
+			return
+		}
+
+		key := authKey(username, password)
+		allowed, cached := authAnswers.get(key)
+		if !cached {
+			var err error
+			allowed, err = verifyCredentials(r.Context(), username, password)
+			if err != nil {
+				logger.Errorf("Could not verify credentials of %q from %s: %v", username, clientAddr(r), err)
+				http.Error(w, "Authentication is unavailable, try again later", http.StatusServiceUnavailable)
+				return
+			}
+			authAnswers.put(key, allowed)
+		}
+		if !allowed {
+			logger.Warnf("Failed authentication of %q from %s", username, clientAddr(r))
+			w.Header().Set("WWW-Authenticate", authRealm)
+			http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+			return
+		}
+		logger.Debugf("Authenticated %q from %s (cached: %t)", username, clientAddr(r), cached)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// verifyCredentials asks the configured verifier about a username and
+// password, and nothing else from the request.
+func verifyCredentials(ctx context.Context, username, password string) (bool, error) {
+	// Names that look like options or contain control characters could
+	// confuse the verifier, they are never valid
+	if username == "" || strings.HasPrefix(username, "-") || strings.IndexFunc(username, unicode.IsControl) >= 0 {
+		return false, nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, C.AuthTimeout)
+	defer cancel()
+	if C.AuthExec != "" {
+		return verifyExec(ctx, username, password)
+	}
+	return verifyURL(ctx, username, password)
+}
+
+// verifyExec runs --auth-exec with the username as its last argument and
+// the password on stdin. Exit code 0 allows access, any other denies it.
+func verifyExec(ctx context.Context, username, password string) (bool, error) {
+	args := append(strings.Fields(C.AuthExec), username)
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdin = strings.NewReader(password + "\n")
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() != nil:
+		return false, fmt.Errorf("%w: %s timed out", errAuthBackend, args[0])
+	case errors.As(err, &exitErr) && exitErr.ExitCode() > 0:
+		return false, nil
+	case err != nil:
+		return false, fmt.Errorf("%w: %v", errAuthBackend, err)
+	}
+	return true, nil
+}
+
+// authClient does not follow redirects, a redirect is no answer.
+var authClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// verifyURL posts {"username": ..., "password": ...} to --auth-url. A 2xx
+// answer allows access, 401 and 403 deny it, anything else is a failure.
+func verifyURL(ctx context.Context, username, password string) (bool, error) {
+	body, err := json.Marshal(map[string]string{"username": username, "password": password})
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, C.AuthURL, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errAuthBackend, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := authClient.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", errAuthBackend, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return true, nil
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %s answered %s", errAuthBackend, C.AuthURL, resp.Status)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingVerifier returns a stub --auth-url that accepts alice/secret,
+// answers "fail" with a 500, "redirect" with a redirect and lets "slow"
+// wait for a second, and the number of requests it got.
+func countingVerifier(t *testing.T) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	calls := new(atomic.Int32)
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		var credentials struct{ Username, Password string }
+		json.NewDecoder(r.Body).Decode(&credentials)
+		switch {
+		case credentials.Username == "alice" && credentials.Password == "secret":
+		case credentials.Username == "fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case credentials.Username == "redirect":
+			http.Redirect(w, r, "/", http.StatusFound)
+		case credentials.Username == "slow":
+			select {
+			case <-r.Context().Done():
+			case <-time.After(time.Second):
+			}
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	t.Cleanup(verifier.Close)
+	return verifier, calls
+}
+
+// execVerifier writes a stub --auth-exec script that accepts alice/secret
+// and bob with a password with spaces, sleeps for "slow" and dies of a
+// signal for "crash". It returns the script and a function counting its
+// runs.
+func execVerifier(t *testing.T) (string, func() int) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the stub verifier is a shell script")
+	}
+	dir := t.TempDir()
+	script := filepath.Join(dir, "verify.sh")
+	runs := filepath.Join(dir, "runs")
+	err := os.WriteFile(script, []byte(`#!/bin/sh
+echo "$1" >> "`+runs+`"
+IFS= read -r password
+case "$1:$password" in
+alice:secret | "bob: pass word \ ") exit 0 ;;
+slow:*) exec sleep 5 ;;
+crash:*) kill -9 $$ ;;
+esac
+exit 1
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return script, func() int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), "\n")
+	}
+}
+
+// getAs requests path from server with basic auth as user, without auth if
+// user is empty.
+func getAs(t *testing.T, server *httptest.Server, path, user, password string) *http.Response {
+	t.Helper()
+	req := newRequest(t, http.MethodGet, server.URL+path, nil)
+	if user != "" {
+		req.SetBasicAuth(user, password)
+	}
+	resp, _ := send(t, req)
+	return resp
+}
+
+// authTest is the answer to credentials, and whether the verifier is asked
+// for it.
+type authTest struct {
+	user, password string
+	want           int
+	asked          bool
+}
+
+// authTests are answered the same by both stub verifiers.
+var authTests = []authTest{
+	{"", "", http.StatusUnauthorized, false},
+	{"alice", "secret", http.StatusOK, true},
+	{"alice", "wrong", http.StatusUnauthorized, true},
+	{"mallory", "secret", http.StatusUnauthorized, true},
+	{"-alice", "secret", http.StatusUnauthorized, false}, // Looks like an option
+	{"al\nice", "secret", http.StatusUnauthorized, false},
+	{"slow", "x", http.StatusServiceUnavailable, true},
+}
+
+func TestAuthURL(t *testing.T) {
+	verifier, calls := countingVerifier(t)
+	server, dir := newTestServer(t, "--auth-url", verifier.URL, "--auth-cache-ttl", "0", "--auth-timeout", "200ms")
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, tc := range append(slices.Clone(authTests), []authTest{
+		{"fail", "x", http.StatusServiceUnavailable, true},
+		{"redirect", "x", http.StatusServiceUnavailable, true},
+	}...) {
+		before := calls.Load()
+		resp := getAs(t, server, "/files/a.txt", tc.user, tc.password)
+		if resp.StatusCode != tc.want {
+			t.Errorf("%q/%q: %d, want %d", tc.user, tc.password, resp.StatusCode, tc.want)
+		}
+		if challenge := resp.Header.Get("WWW-Authenticate"); (challenge != "") != (tc.want == http.StatusUnauthorized) {
+			t.Errorf("%q/%q: WWW-Authenticate %q with status %d", tc.user, tc.password, challenge, resp.StatusCode)
+		}
+		if asked := calls.Load() != before; asked != tc.asked {
+			t.Errorf("%q/%q: verifier asked: %t, want %t", tc.user, tc.password, asked, tc.asked)
+		}
+	}
+
+	if resp := getAs(t, server, "/healthz", "", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz without auth: %d, want 200", resp.StatusCode)
+	}
+}
+
+func TestAuthExec(t *testing.T) {
+	script, runs := execVerifier(t)
+	server, dir := newTestServer(t, "--auth-exec", script, "--auth-cache-ttl", "0", "--auth-timeout", "200ms")
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, tc := range append(slices.Clone(authTests), []authTest{
+		{"bob", " pass word \\ ", http.StatusOK, true}, // The password is passed as it is
+		{"bob", "pass word", http.StatusUnauthorized, true},
+		{"crash", "x", http.StatusServiceUnavailable, true},
+	}...) {
+		before := runs()
+		if resp := getAs(t, server, "/files/a.txt", tc.user, tc.password); resp.StatusCode != tc.want {
+			t.Errorf("%q/%q: %d, want %d", tc.user, tc.password, resp.StatusCode, tc.want)
+		}
+		if asked := runs() != before; asked != tc.asked {
+			t.Errorf("%q/%q: verifier run: %t, want %t", tc.user, tc.password, asked, tc.asked)
+		}
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	verifier, calls := countingVerifier(t)
+	server, dir := newTestServer(t, "--auth-url", verifier.URL, "--auth-timeout", "100ms")
+	writeFile(t, dir, "a.txt", "a")
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if resp := getAs(t, server, "/files/a.txt", "slow", "x"); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("verifier timed out: %d, want 503", resp.StatusCode)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("two requests with a timeout of 100ms took %v", elapsed)
+	}
+	// Failures are not remembered, the verifier is asked again
+	if n := calls.Load(); n != 2 {
+		t.Errorf("verifier asked %d times, want 2", n)
+	}
+}
+
+func TestAuthCache(t *testing.T) {
+	verifier, calls := countingVerifier(t)
+	server, dir := newTestServer(t, "--auth-url", verifier.URL, "--auth-cache-ttl", "200ms")
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, tc := range []struct {
+		user, password string
+		want           int
+		calls          int32
+	}{
+		{"alice", "secret", http.StatusOK, 1},
+		{"alice", "secret", http.StatusOK, 1},
+		{"alice", "wrong", http.StatusUnauthorized, 2}, // Another password is another answer
+		{"alice", "wrong", http.StatusUnauthorized, 2}, // Denials are remembered too
+		{"fail", "x", http.StatusServiceUnavailable, 3},
+		{"fail", "x", http.StatusServiceUnavailable, 4}, // Failures are not
+	} {
+		if resp := getAs(t, server, "/files/a.txt", tc.user, tc.password); resp.StatusCode != tc.want {
+			t.Errorf("%q/%q: %d, want %d", tc.user, tc.password, resp.StatusCode, tc.want)
+		}
+		if n := calls.Load(); n != tc.calls {
+			t.Errorf("%q/%q: verifier asked %d times in all, want %d", tc.user, tc.password, n, tc.calls)
+		}
+	}
+
+	time.Sleep(300 * time.Millisecond)
+	if resp := getAs(t, server, "/files/a.txt", "alice", "secret"); resp.StatusCode != http.StatusOK {
+		t.Errorf("after the cache expired: %d, want 200", resp.StatusCode)
+	}
+	if n := calls.Load(); n != 5 {
+		t.Errorf("verifier asked %d times in all after the cache expired, want 5", n)
+	}
+}
+
+func TestAuthExecCache(t *testing.T) {
+	script, runs := execVerifier(t)
+	server, dir := newTestServer(t, "--auth-exec", script)
+	writeFile(t, dir, "a.txt", "a")
+
+	for i := 0; i < 3; i++ {
+		if resp := getAs(t, server, "/files/a.txt", "alice", "secret"); resp.StatusCode != http.StatusOK {
+			t.Errorf("request %d: %d, want 200", i, resp.StatusCode)
+		}
+	}
+	if n := runs(); n != 1 {
+		t.Errorf("verifier run %d times for the same credentials, want 1", n)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// throttleChunk is how much of a download is written at once when it is
+// throttled. Small chunks let concurrent downloads take turns.
+const throttleChunk = 16 << 10
+
+// bandwidthUnits are the units accepted by parseBandwidth, in bytes per
+// second. Upper case B is bytes, lower case b bits, as in "10MBps" or
+// "80Mbps"; prefixes are powers of 1000, or of 1024 with "i".
+var bandwidthUnits = map[string]float64{
+	"B": 1, "KB": 1e3, "MB": 1e6, "GB": 1e9,
+	"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30,
+	"b": 1.0 / 8, "Kb": 1e3 / 8, "Mb": 1e6 / 8, "Gb": 1e9 / 8,
+}
+
+// parseBandwidth parses a rate like "10MBps", "80Mbps" or "500KB/s" into
+// bytes per second. A plain number is bytes per second, and 0 or "" means
+// no limit.
+func parseBandwidth(value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	amount, unit, err := splitQuantity(value)
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "ps"), "/s")
+	if unit == "" {
+		unit = "B"
+	}
+	if len(unit) > 1 && unit[0] == 'k' {
+		unit = "K" + unit[1:]
+	}
+	factor, ok := bandwidthUnits[unit]
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid bandwidth %q, expected e.g. 10MBps or 80Mbps", value)
+	}
+	return int64(amount * factor), nil
+}
+
+// tokenBucket limits a flow of bytes to rate bytes per second. Writers take
+// their bytes in turn, so concurrent downloads share the rate evenly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	burst := bucketBurst(rate)
+	return &tokenBucket{rate: float64(rate), burst: burst, tokens: burst, last: time.Now()}
+}
+
+// bucketBurst is how many bytes a bucket of rate holds: a twentieth of a
+// second, but at least a chunk.
+func bucketBurst(rate int64) float64 {
+	return max(float64(throttleChunk), float64(rate)/20)
+}
+
+// setRate changes the rate of the bucket, as --rate-schedule does. Nothing
+// is dropped: the bytes taken so far are accounted for at the old rate and
+// writers go on at the new one. A rate of 0 lets everything through.
+func (b *tokenBucket) setRate(rate int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.burst = bucketBurst(rate)
+	if b.rate > 0 {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	} else {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.rate = float64(rate)
+}
+
+// limit returns the rate of the bucket in bytes per second, 0 for none.
+func (b *tokenBucket) limit() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return int64(b.rate)
+}
+
+// wait takes n bytes from the bucket, sleeping until they are available or
+// ctx is done.
+func (b *tokenBucket) wait(ctx context.Context, n int) error {
+	b.mu.Lock()
+	if b.rate <= 0 {
+		b.mu.Unlock()
+		return nil
+	}
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// downloadBucket is the shared budget of all downloads from --max-bandwidth
+// and --rate-schedule, nil without a limit.
+var downloadBucket *tokenBucket
+
+// perConnBandwidth is the limit of each download from --per-conn-bandwidth,
+// in bytes per second, 0 without a limit.
+var perConnBandwidth int64
+
+// throttledWriter writes a response through one or more token buckets.
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), throttleChunk)]
+		for _, bucket := range t.buckets {
+			if err := bucket.wait(t.ctx, len(chunk)); err != nil {
+				return written, err
+			}
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *throttledWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// throttle wraps w so that the body of a download respects --max-bandwidth
+// and --per-conn-bandwidth. A request can ask for a lower rate of its own
+// with ?limit=500KBps, but never for a higher one.
+func throttle(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, error) {
+	rate := perConnBandwidth
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err := parseBandwidth(value)
+		if err != nil {
+			return nil, err
+		}
+		if limit > 0 && (rate == 0 || limit < rate) {
+			rate = limit
+		}
+	}
+	var buckets []*tokenBucket
+	if rate > 0 {
+		buckets = append(buckets, newTokenBucket(rate))
+	}
+	if downloadBucket != nil {
+		buckets = append(buckets, downloadBucket)
+	}
+	if len(buckets) == 0 {
+		return w, nil
+	}
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), buckets: buckets}, nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	cli "github.com/urfave/cli/v2"
+)
+
+// genCertCommand is the "gen-cert" subcommand, which writes a self-signed
+// certificate and key usable with --tls-cert and --tls-key.
+var genCertCommand = &cli.Command{
+	Name:  "gen-cert",
+	Usage: "Generate a self-signed TLS certificate (cert.pem) and key (key.pem)",
+	Flags: []cli.Flag{
+		&cli.StringFlag{Name: "out-dir", Value: ".", Usage: "Directory to write cert.pem and key.pem into"},
+		&cli.StringSliceFlag{Name: "host", Usage: "Hostname or IP to include as SAN (repeatable); detected LAN IPs are always included"},
+		&cli.IntFlag{Name: "days", Value: 365, Usage: "Validity of the certificate in days"},
+		&cli.BoolFlag{Name: "force", Usage: "Overwrite existing cert.pem and key.pem"},
+	},
+	Action: func(c *cli.Context) error {
+		return generateSelfSignedCert(c.String("out-dir"), c.StringSlice("host"), c.Int("days"), c.Bool("force"))
+	},
+}
+
+func generateSelfSignedCert(outDir string, hosts []string, days int, force bool) error {
+	if days <= 0 {
+		return fmt.Errorf("--days must be positive, got %d", days)
+	}
+
+	template := x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"http-file-server"}, CommonName: "http-file-server"},
+		NotBefore:             time.Now().Add(-5 * time.Minute),
+		NotAfter:              time.Now().AddDate(0, 0, days),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("could not generate serial number: %w", err)
+	}
+	template.SerialNumber = serial
+
+	hosts = append(hosts, "localhost", "127.0.0.1", "::1")
+	hosts = append(hosts, detectLanIPs()...)
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		if seen[h] {
+			continue
+		}
+		seen[h] = true
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("could not generate key: %w", err)
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("could not create certificate: %w", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("could not marshal key: %w", err)
+	}
+
+	certPath := filepath.Join(outDir, "cert.pem")
+	keyPath := filepath.Join(outDir, "key.pem")
+	if !force {
+		for _, p := range []string{certPath, keyPath} {
+			if _, err := os.Stat(p); err == nil {
+				return fmt.Errorf("%s already exists, use --force to overwrite", p)
+			}
+		}
+	}
+	if err := writePEMFile(certPath, "CERTIFICATE", certDER, 0644, force); err != nil {
+		return err
+	}
+	if err := writePEMFile(keyPath, "EC PRIVATE KEY", keyDER, 0600, force); err != nil {
+		return err
+	}
+
+	log.Infof("Wrote %s and %s (valid %d days) for %v %v", certPath, keyPath, days, template.DNSNames, template.IPAddresses)
+	log.Infof("Start the server with: --tls-cert %s --tls-key %s", certPath, keyPath)
+	return nil
+}
+
+func writePEMFile(path, blockType string, der []byte, perm os.FileMode, force bool) error {
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(path, flags, perm)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", path, err)
+	}
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: der}); err != nil {
+		f.Close()
+		return fmt.Errorf("could not write %s: %w", path, err)
+	}
+	return f.Close()
+}
+
+// detectLanIPs returns the non-loopback unicast addresses of this machine.
+func detectLanIPs() []string {
+	var ips []string
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		log.Warnf("Could not detect LAN IPs: %v", err)
+		return ips
+	}
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP.IsLoopback() || !ipNet.IP.IsGlobalUnicast() {
+			continue
+		}
+		ips = append(ips, ipNet.IP.String())
+	}
+	return ips
+}
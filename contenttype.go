@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// detectContentType returns the MIME type of file from the extension of
+// name, falling back to sniffing its first 512 bytes. ReadAt leaves the
+// read offset alone, so the sniffed bytes are still served.
+func detectContentType(file io.ReaderAt, name string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+	var head [512]byte
+	n, err := file.ReadAt(head[:], 0)
+	if err != nil && err != io.EOF {
+		return "application/octet-stream"
+	}
+	// DetectContentType falls back to application/octet-stream itself
+	return http.DetectContentType(head[:n])
+}
+
+// inlineAllowed reports whether content of type ctype may be shown in the
+// browser with ?inline=1. HTML and SVG can run scripts in the server's
+// origin, so they stay attachments unless --allow-inline-html is set.
+func inlineAllowed(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch {
+	case mediaType == "text/html" || mediaType == "image/svg+xml":
+		return C.AllowInlineHTML
+	case mediaType == "application/pdf" || mediaType == "text/plain":
+		return true
+	default:
+		return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "video/") ||
+			strings.HasPrefix(mediaType, "audio/")
+	}
+}
+
+// contentDisposition builds an RFC 6266 header of the given type
+// ("attachment" or "inline") for filename.
+// The quoted filename is an ASCII fallback with other characters replaced
+// by "_" and quotes and backslashes escaped. Names that needed replacing
+// also get an RFC 5987 filename* parameter with the exact UTF-8 name, which
+// browsers prefer (curl -J only understands the fallback).
+func contentDisposition(disposition, filename string) string {
+	var fallback strings.Builder
+	exact := true
+	for _, r := range filename {
+		switch {
+		case r == '"' || r == '\\':
+			fallback.WriteByte('\\')
+			fallback.WriteRune(r)
+		case r < 0x20 || r == 0x7f || r > 0x7e:
+			fallback.WriteByte('_')
+			exact = false
+		default:
+			fallback.WriteRune(r)
+		}
+	}
+	header := fmt.Sprintf(`%s; filename="%s"`, disposition, fallback.String())
+	if !exact {
+		header += "; filename*=UTF-8''" + encodeRFC5987(filename)
+	}
+	return header
+}
+
+// encodeRFC5987 percent-encodes s as an RFC 5987 ext-value, leaving only
+// attr-char bytes as they are.
+func encodeRFC5987(s string) string {
+	const attrChars = "!#$&+-.^_`|~"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte(attrChars, c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// dispositionTests are file names with the exact Content-Disposition
+// header they are downloaded with.
+var dispositionTests = []struct {
+	name, want string
+}{
+	{"report.pdf", `attachment; filename="report.pdf"`},
+	{"report 2024.pdf", `attachment; filename="report 2024.pdf"`},
+	{"100% done.txt", `attachment; filename="100% done.txt"`},
+	{`say "hi".txt`, `attachment; filename="say \"hi\".txt"`},
+	{`back\slash.txt`, `attachment; filename="back\\slash.txt"`},
+	{"party 🎉.png", `attachment; filename="party _.png"; filename*=UTF-8''party%20%F0%9F%8E%89.png`},
+	{"日本語.txt", `attachment; filename="___.txt"; filename*=UTF-8''%E6%97%A5%E6%9C%AC%E8%AA%9E.txt`},
+	{"отчёт 2024.pdf", `attachment; filename="_____ 2024.pdf"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%202024.pdf`},
+	{`"東京".txt`, `attachment; filename="\"__\".txt"; filename*=UTF-8''%22%E6%9D%B1%E4%BA%AC%22.txt`},
+	{"tab\there.txt", `attachment; filename="tab_here.txt"; filename*=UTF-8''tab%09here.txt`},
+}
+
+func TestContentDisposition(t *testing.T) {
+	for _, tc := range dispositionTests {
+		if got := contentDisposition("attachment", tc.name); got != tc.want {
+			t.Errorf("contentDisposition(%q):\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+	}
+	if got, want := contentDisposition("inline", "日.pdf"), `inline; filename="_.pdf"; filename*=UTF-8''%E6%97%A5.pdf`; got != want {
+		t.Errorf("inline:\n got %s\nwant %s", got, want)
+	}
+}
+
+func TestDownloadContentDisposition(t *testing.T) {
+	server, dir := newTestServer(t)
+	for _, tc := range dispositionTests {
+		// Backslashes in paths are separators, and quotes and control
+		// characters are not allowed in Windows file names
+		if strings.Contains(tc.name, `\`) || runtime.GOOS == "windows" && strings.ContainsAny(tc.name, "\"\t") {
+			continue
+		}
+		writeFile(t, dir, tc.name, "x")
+
+		resp, _ := send(t, newRequest(t, http.MethodGet, fileURL(server, tc.name), nil))
+		got := resp.Header.Get("Content-Disposition")
+		if got != tc.want {
+			t.Errorf("GET %q:\n got %s\nwant %s", tc.name, got, tc.want)
+		}
+		// What a browser saves the file as
+		if _, params, err := mime.ParseMediaType(got); err != nil || params["filename"] != tc.name {
+			t.Errorf("GET %q: header parses as %q, %v", tc.name, params["filename"], err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	corsAllowHeaders  = "Accept, Authorization, Content-Type, X-Content-SHA256"
+	corsExposeHeaders = "Content-Disposition, Location, X-Request-Id, X-Stored-Filename, X-Stored-Sha256"
+	corsMaxAge        = "600"
+)
+
+// routeMethods returns the methods a route accepts, besides OPTIONS. It is
+// the single source for Allow headers and CORS preflight answers.
+func routeMethods(urlPath string) []string {
+	switch {
+	case urlPath == "/upload" || urlPath == "/delete" || urlPath == "/create" || urlPath == "/mkdir" || urlPath == "/api/mkdir" ||
+		urlPath == "/rename" || urlPath == "/api/rename" || urlPath == "/move" ||
+		urlPath == "/trash/restore" || urlPath == "/trash/purge" || strings.HasPrefix(urlPath, "/save/"):
+		return []string{http.MethodPost}
+	case strings.HasPrefix(urlPath, "/files/"):
+		return []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete}
+	default:
+		return []string{http.MethodGet, http.MethodHead}
+	}
+}
+
+// allowMethods answers 405 with an Allow header and returns false unless the
+// request method is one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(append(methods, http.MethodOptions), ", "))
+	http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// validateCors checks the CORS flags at startup. Credentials cannot be
+// allowed for "*": browsers would then send the cookies and passwords of
+// their users along with requests of any website.
+func validateCors() error {
+	if !C.CorsAllowCredentials {
+		return nil
+	}
+	if len(C.CorsOrigins) == 0 {
+		return fmt.Errorf("--cors-allow-credentials needs the allowed origins in --cors-origin")
+	}
+	for _, origin := range C.CorsOrigins {
+		if origin == "*" {
+			return fmt.Errorf("--cors-allow-credentials cannot be used with --cors-origin \"*\", list the allowed origins instead")
+		}
+	}
+	return nil
+}
+
+// corsOriginAllowed reports whether origin may access the server according
+// to --cors-origin.
+func corsOriginAllowed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, allowed := range C.CorsOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// corsHandler answers OPTIONS requests for every route and adds CORS headers
+// for allowed origins. Preflights are answered here, before any other check,
+// as they never carry credentials; the actual requests still go through all
+// guards. Disallowed origins get no CORS headers at all, so browsers block them.
+func corsHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := corsOriginAllowed(origin)
+		if len(C.CorsOrigins) > 0 {
+			w.Header().Add("Vary", "Origin")
+		}
+		if allowed {
+			if len(C.CorsOrigins) == 1 && C.CorsOrigins[0] == "*" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+			if C.CorsAllowCredentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+		}
+
+		if r.Method != http.MethodOptions {
+			if allowed {
+				w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := strings.Join(append(routeMethods(r.URL.Path), http.MethodOptions), ", ")
+		w.Header().Set("Allow", methods)
+		if allowed && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", methods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "https://app.example.com"
+
+func TestCorsPreflight(t *testing.T) {
+	// Preflights never carry credentials, they are answered before auth
+	server, _ := newTestServer(t, "--cors-origin", testOrigin, "--auth-url", newVerifier(t).URL)
+
+	req := newRequest(t, http.MethodOptions, server.URL+"/api/files", nil)
+	req.Header.Set("Origin", testOrigin)
+	req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+	req.Header.Set("Access-Control-Request-Headers", "Authorization")
+	resp, _ := send(t, req)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("preflight: %d, want 204", resp.StatusCode)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":  testOrigin,
+		"Access-Control-Allow-Methods": "GET, HEAD, OPTIONS",
+		"Access-Control-Allow-Headers": corsAllowHeaders,
+		"Access-Control-Max-Age":       corsMaxAge,
+		"Vary":                         "Origin",
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestCorsCredentialedPut(t *testing.T) {
+	server, dir := newTestServer(t, "--cors-origin", testOrigin, "--cors-allow-credentials", "--auth-url", newVerifier(t).URL)
+
+	req := newRequest(t, http.MethodPut, server.URL+"/files/report.txt", strings.NewReader("report"))
+	req.Header.Set("Origin", testOrigin)
+	req.SetBasicAuth("alice", "secret")
+	resp, _ := send(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %d, want 201", resp.StatusCode)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      testOrigin,
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Expose-Headers":    corsExposeHeaders,
+	} {
+		if got := resp.Header.Get(name); got != want {
+			t.Errorf("%s: %q, want %q", name, got, want)
+		}
+	}
+	if got := snapshot(t, dir); got["report.txt"] != "report" {
+		t.Errorf("PUT did not store the file: %v", got)
+	}
+
+	// The actual request is still protected
+	req = newRequest(t, http.MethodPut, server.URL+"/files/other.txt", strings.NewReader("other"))
+	req.Header.Set("Origin", testOrigin)
+	if resp, _ := send(t, req); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("PUT without credentials: %d, want 401", resp.StatusCode)
+	}
+}
+
+func TestCorsDisallowedOrigin(t *testing.T) {
+	server, dir := newTestServer(t, "--cors-origin", testOrigin, "--cors-allow-credentials")
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, origin := range []string{"https://evil.example.com", "https://app.example.com.evil.example", "null"} {
+		preflight := newRequest(t, http.MethodOptions, server.URL+"/files/a.txt", nil)
+		preflight.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+		get := newRequest(t, http.MethodGet, server.URL+"/files/a.txt", nil)
+		for _, req := range []*http.Request{preflight, get} {
+			req.Header.Set("Origin", origin)
+			resp, _ := send(t, req)
+			for name := range resp.Header {
+				if strings.HasPrefix(name, "Access-Control-") {
+					t.Errorf("%s from %s: got %s: %s", req.Method, origin, name, resp.Header.Get(name))
+				}
+			}
+		}
+	}
+}
+
+func TestCorsCredentialsNeedOrigins(t *testing.T) {
+	for _, args := range [][]string{
+		{"--cors-origin", "*", "--cors-allow-credentials"},
+		{"--cors-origin", testOrigin, "--cors-origin", "*", "--cors-allow-credentials"},
+		{"--cors-allow-credentials"},
+	} {
+		loadConfig(t, args...)
+		if err := validateCors(); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+	loadConfig(t, "--cors-origin", "*")
+	if err := validateCors(); err != nil {
+		t.Errorf("--cors-origin * without credentials: %v", err)
+	}
+}
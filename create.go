@@ -0,0 +1,93 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// createFileHandler handles POST /create with the form fields "name" and,
+// optionally, "content", for "curl -d name=todo.txt -d content=hello
+// http://host/create". The target directory is ?dir= or a "dir" field. An
+// existing file is never replaced: the overwrite policy answers 409 here,
+// while --on-conflict rename still stores "name (1).ext".
+func createFileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	// Form encoding takes up to 3 bytes per byte of content
+	r.Body = http.MaxBytesReader(w, r.Body, 3*C.ViewMaxSize+8192)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Could not parse form", http.StatusBadRequest)
+		}
+		return
+	}
+	content := r.PostForm.Get("content")
+	if int64(len(content)) > C.ViewMaxSize {
+		http.Error(w, fmt.Sprintf("Content too large, at most %d bytes", C.ViewMaxSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	// Same checks as for the name of an uploaded file, except that
+	// subdirectories are chosen with dir, never in the name
+	name := strings.TrimSpace(r.PostForm.Get("name"))
+	if name == "" {
+		http.Error(w, "Missing file name", http.StatusBadRequest)
+		return
+	}
+	filename, err := sanitizeNestedPath(name)
+	if err == nil && strings.Contains(filename, "/") {
+		err = errors.New("use dir to create a file in a subdirectory")
+	}
+	if err != nil {
+		logger.Warnf("Rejected creation of %q: %v", name, err)
+		http.Error(w, fmt.Sprintf("Invalid file name: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	relDir := r.URL.Query().Get("dir")
+	if r.PostForm.Has("dir") {
+		relDir = r.PostForm.Get("dir")
+	}
+	dir, err := resolveUploadDir(r.Context(), relDir)
+	if err != nil {
+		logger.Warnf("Rejected creation in directory %q: %v", relDir, err)
+		http.Error(w, fmt.Sprintf("Invalid directory: %v", err), http.StatusBadRequest)
+		return
+	}
+	relPath := path.Join(cleanRelPath(relDir), filename)
+	if !isServable(relPath) {
+		logger.Warnf("Rejected creation of hidden or excluded file: %s", relPath)
+		http.Error(w, "Hidden or excluded files are not accepted", http.StatusForbidden)
+		return
+	}
+
+	opts := uploadOptions{policy: C.OnConflict}
+	if opts.policy == conflictOverwrite {
+		opts.policy = conflictReject
+	}
+	result := storeUploadStream(r.Context(), strings.NewReader(content), filename, dir, filename, opts)
+	if result.Error != "" {
+		http.Error(w, result.Error, result.status)
+		return
+	}
+	result.StoredName = path.Join(cleanRelPath(relDir), result.StoredName)
+	logger.Infof("Created file /%s (size: %d bytes)", result.StoredName, result.Size)
+
+	if wantsJSON(r) {
+		writeJSON(w, r, http.StatusCreated, result)
+		return
+	}
+	w.Header().Set("X-Stored-Filename", url.PathEscape(result.StoredName))
+	w.Header().Set("X-Stored-Sha256", result.SHA256)
+	http.Redirect(w, r, returnURL(r, cleanRelPath(relDir)), http.StatusSeeOther)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"net/netip"
+	"net/url"
+	"os"
+	"runtime"
+	"sync/atomic"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// bytesServed counts the bytes of file content downloaded, for expvar.
+var bytesServed atomic.Int64
+
+// startDebugServer serves net/http/pprof and expvar on --debug-listen,
+// which should be a local address: profiles and the configuration are for
+// the operator only. The main listener never serves them.
+func startDebugServer() error {
+	if C.DebugListen == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", C.DebugListen)
+	if err != nil {
+		return fmt.Errorf("could not listen on --debug-listen: %w", err)
+	}
+	publishDebugVars()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	debugServer := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: C.ReadHeaderTimeout,
+	}
+	go func() {
+		if err := debugServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Debug server stopped: %v", err)
+		}
+	}()
+	log.Infof("Debug endpoints are served at http://%s/debug/pprof/ and /debug/vars", listener.Addr())
+	if addr, err := netip.ParseAddrPort(listener.Addr().String()); err == nil && !addr.Addr().IsLoopback() {
+		log.Warnf("--debug-listen %s is not a local address: profiles and the configuration can be read from the network", C.DebugListen)
+	}
+	return nil
+}
+
+// publishDebugVars adds the variables of this server to expvar, next to its
+// default cmdline and memstats.
+func publishDebugVars() {
+	expvar.NewString("version").Set(version)
+	expvar.Publish("config", expvar.Func(func() interface{} { return redactedConfig() }))
+	expvar.Publish("bytesServed", expvar.Func(func() interface{} { return bytesServed.Load() }))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} { return runtime.NumGoroutine() }))
+	expvar.Publish("openFiles", expvar.Func(func() interface{} { return openFiles() }))
+}
+
+// redactedConfig returns C without its secrets: the authentication command,
+// and the credentials and query of the authentication URL.
+func redactedConfig() Config {
+	config := C
+	if config.AuthExec != "" {
+		config.AuthExec = "(redacted)"
+	}
+	if u, err := url.Parse(config.AuthURL); err == nil && (u.User != nil || u.RawQuery != "") {
+		if u.User != nil {
+			u.User = url.User("redacted")
+		}
+		if u.RawQuery != "" {
+			u.RawQuery = "redacted"
+		}
+		config.AuthURL = u.String()
+	}
+	return config
+}
+
+// openFiles returns the number of open file descriptors of the process, or
+// -1 where /proc is not available.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
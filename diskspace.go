@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// spaceCheckInterval is how many bytes of an upload are written between two
+// checks of the free space.
+const spaceCheckInterval = 4 << 20
+
+// errInsufficientStorage is returned when an upload would leave less than
+// --min-free-space on the filesystem of the served directory.
+var errInsufficientStorage = errors.New("not enough free space on the server")
+
+// minFreeSpace is --min-free-space in bytes, 0 to not check.
+var minFreeSpace int64
+
+// checkFreeSpace returns errInsufficientStorage if writing size more bytes
+// into dir would leave less than --min-free-space. If the free space cannot
+// be found out, the upload goes on.
+func checkFreeSpace(ctx context.Context, dir string, size int64) error {
+	if minFreeSpace <= 0 {
+		return nil
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		loggerFrom(ctx).Debugf("Could not get free space of %s: %v", dir, err)
+		return nil
+	}
+	if free-size < minFreeSpace {
+		loggerFrom(ctx).Warnf("Refusing to write %d bytes into %s: %d bytes free, --min-free-space is %d", size, dir, free, minFreeSpace)
+		return errInsufficientStorage
+	}
+	return nil
+}
+
+// spaceGuard writes an upload, checking the free space every
+// spaceCheckInterval bytes so that an upload of unknown size stops before
+// it fills the disk. Each write is also reserved against --quota, so that
+// concurrent uploads cannot exceed it together; reserved must be released
+// if the upload fails.
+type spaceGuard struct {
+	ctx       context.Context
+	w         io.Writer
+	dir       string
+	unchecked int64
+	reserved  int64
+}
+
+func (g *spaceGuard) Write(p []byte) (int, error) {
+	if err := quotaReserve(int64(len(p))); err != nil {
+		return 0, err
+	}
+	g.reserved += int64(len(p))
+	g.unchecked += int64(len(p))
+	if g.unchecked >= spaceCheckInterval {
+		g.unchecked = 0
+		if err := checkFreeSpace(g.ctx, g.dir, int64(len(p))); err != nil {
+			return 0, err
+		}
+	}
+	return g.w.Write(p)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var editTmpl = template.Must(template.New("edit").Parse(editHTML))
+
+// saveMu serializes saves, so that the modification time check and the
+// rename of one save cannot interleave with another.
+var saveMu sync.Mutex
+
+// editHandler serves GET /edit/<path>: a form to edit a text file of at most
+// --view-max-size bytes in the browser. The form carries the modification
+// time of the file, which saveHandler checks before writing.
+func editHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	relPath := strings.TrimPrefix(r.URL.Path, "/edit/")
+	filePath, err := resolvePath(r.Context(), relPath)
+	if err != nil || cleanRelPath(relPath) == "" || !isServable(relPath) {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			logger.Errorf("Error getting file info for %s: %v", filePath, err)
+			http.Error(w, "Error opening file", http.StatusInternalServerError)
+		}
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "Only regular files can be edited", http.StatusBadRequest)
+		return
+	}
+	if info.Size() > C.ViewMaxSize {
+		http.Error(w, "File too large to edit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		logger.Errorf("Error reading file %s: %v", filePath, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	name := path.Base(cleanRelPath(relPath))
+	if bytes.IndexByte(content[:min(len(content), binarySniffLen)], 0) >= 0 ||
+		!isTextType(http.DetectContentType(content)) && !hasPreview(name) {
+		http.Error(w, "Only text files can be edited", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	// The listing's view is passed on to the save, which returns to it
+	state := viewState(r.URL.Query())
+	state.Dir = cleanRelPath(path.Dir(cleanRelPath(relPath)))
+	data := struct {
+		Name    string
+		Path    string
+		Back    string
+		State   template.URL
+		Content string
+		ModTime string
+	}{
+		Name:    name,
+		Path:    cleanRelPath(relPath),
+		Back:    state.url(state.Page, state.Sort),
+		State:   state.state(),
+		Content: string(content),
+		ModTime: strconv.FormatInt(info.ModTime().UnixNano(), 10),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := editTmpl.Execute(w, data); err != nil {
+		logger.Errorf("Error rendering editor for %s: %v", filePath, err)
+	}
+}
+
+// saveHandler handles POST /save/<path> from the editor: it replaces the file
+// with the submitted content through a temporary file and a rename, so that
+// readers never see a partly written file. If the file was modified since
+// the editor was loaded, it answers 409 and leaves the file alone.
+func saveHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	relPath := strings.TrimPrefix(r.URL.Path, "/save/")
+	filePath, err := resolvePath(r.Context(), relPath)
+	if err != nil || cleanRelPath(relPath) == "" || !isServable(relPath) {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Form encoding takes up to 3 bytes per byte of content
+	r.Body = http.MaxBytesReader(w, r.Body, 3*C.ViewMaxSize+4096)
+	if err := r.ParseForm(); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Could not parse form", http.StatusBadRequest)
+		}
+		return
+	}
+	content := []byte(r.PostForm.Get("content"))
+	if int64(len(content)) > C.ViewMaxSize {
+		http.Error(w, "Content too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	loadedModTime, err := strconv.ParseInt(r.PostForm.Get("mtime"), 10, 64)
+	if err != nil {
+		http.Error(w, "Missing or invalid mtime", http.StatusBadRequest)
+		return
+	}
+
+	saveMu.Lock()
+	defer saveMu.Unlock()
+
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		logger.Warnf("Rejected save of %s: file was deleted", filePath)
+		http.Error(w, "The file was deleted since the editor was opened", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error getting file info for %s: %v", filePath, err)
+		http.Error(w, "Could not save file", http.StatusInternalServerError)
+		return
+	}
+	if !info.Mode().IsRegular() {
+		http.Error(w, "Only regular files can be edited", http.StatusBadRequest)
+		return
+	}
+	if info.ModTime().UnixNano() != loadedModTime {
+		logger.Warnf("Rejected save of %s: file changed since the editor was opened", filePath)
+		http.Error(w, "The file changed since the editor was opened, reload it and redo your changes", http.StatusConflict)
+		return
+	}
+
+	// Browsers submit textareas with CRLF line endings: keep LF files LF
+	if !usesCRLF(filePath) {
+		content = bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	}
+
+	growth := int64(len(content)) - info.Size()
+	if err := quotaReserve(growth); err != nil {
+		logger.Warnf("Rejected save of %s: %v", filePath, err)
+		http.Error(w, "Cannot save: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+
+	dir := filepath.Dir(filePath)
+	tmp, err := createPartialFile(dir, filepath.Base(filePath))
+	if err != nil {
+		logger.Errorf("Could not create temporary file for %s: %v", filePath, err)
+		quotaRelease(growth)
+		http.Error(w, "Could not save file", http.StatusInternalServerError)
+		return
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Chmod(info.Mode().Perm())
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = copyXattrs(filePath, tmp.Name())
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		logger.Errorf("Could not save %s: %v", filePath, err)
+		os.Remove(tmp.Name())
+		quotaRelease(growth)
+		http.Error(w, "Could not save file", http.StatusInternalServerError)
+		return
+	}
+	quotaRelease(-growth)
+	invalidateListing(dir)
+
+	logger.Infof("Saved %s from the editor (size: %d bytes, %+d bytes)", filePath, len(content), int64(len(content))-info.Size())
+	http.Redirect(w, r, returnURL(r, cleanRelPath(path.Dir(cleanRelPath(relPath)))), http.StatusSeeOther)
+}
+
+// usesCRLF reports whether the first line of the file at filePath ends with CRLF.
+func usesCRLF(filePath string) bool {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, binarySniffLen)
+	n, _ := io.ReadFull(file, head)
+	line, _, found := bytes.Cut(head[:n], []byte("\n"))
+	return found && bytes.HasSuffix(line, []byte("\r"))
+}
+
+// The newline after <textarea> is dropped by the HTML parser, so that one
+// at the start of the file is kept
+const editHTML = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Edit {{.Name}} - File Server</title>
+    <style>
+        body { font-family: sans-serif; }
+        .container { max-width: 800px; margin: auto; padding: 20px; }
+        .links a { margin-right: 1em; }
+        textarea { width: 100%; height: 70vh; font-family: monospace; box-sizing: border-box; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="links"><a href="{{.Back}}">&larr; back to listing</a><a href="/download/{{.Path}}">download raw</a></div>
+        <h1>Edit {{.Name}}</h1>
+        <form method="post" action="/save/{{.Path}}?{{.State}}">
+            <input type="hidden" name="mtime" value="{{.ModTime}}">
+            <textarea name="content" spellcheck="false">
+{{.Content}}</textarea>
+            <p><button type="submit">Save</button></p>
+        </form>
+    </div>
+</body>
+</html>
+`
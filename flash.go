@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+)
+
+const (
+	flashCookie = "hfs-flash"
+	// flashMaxLen keeps the cookie well below the 4 KB browsers accept
+	flashMaxLen = 1024
+)
+
+// setFlash stores msg in a cookie, for the next listing page to show once.
+// It is used where the web UI reloads the page after an action.
+func setFlash(w http.ResponseWriter, msg string) {
+	if len(msg) > flashMaxLen {
+		msg = msg[:flashMaxLen] + "..."
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     flashCookie,
+		Value:    url.QueryEscape(msg),
+		Path:     "/",
+		MaxAge:   60,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// takeFlash returns the message stored by setFlash, if any, and clears it.
+func takeFlash(w http.ResponseWriter, r *http.Request) string {
+	cookie, err := r.Cookie(flashCookie)
+	if err != nil {
+		return ""
+	}
+	http.SetCookie(w, &http.Cookie{Name: flashCookie, Path: "/", MaxAge: -1})
+	msg, err := url.QueryUnescape(cookie.Value)
+	if err != nil {
+		return ""
+	}
+	return msg
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// instanceLockName is the lockfile, inside the served directory, that
+// records which server instance manages the directory.
+const instanceLockName = ".hfs.lock"
+
+// instanceLock is the content of the lockfile.
+type instanceLock struct {
+	Pid       int    `json:"pid"`
+	Hostname  string `json:"hostname"`
+	Listen    string `json:"listen"`
+	StartTime string `json:"startTime"`
+}
+
+// acquireInstanceLock makes sure no other instance serves the same directory.
+// A lock left by a dead process on this host is reclaimed. With
+// --allow-shared-root an existing owner only produces a warning.
+func acquireInstanceLock(listen string) error {
+	lockPath := filepath.Join(C.DirpathToServe, instanceLockName)
+	hostname, _ := os.Hostname()
+	own := instanceLock{
+		Pid:       os.Getpid(),
+		Hostname:  hostname,
+		Listen:    listen,
+		StartTime: time.Now().Format(time.RFC3339),
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			err = json.NewEncoder(f).Encode(own)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+				return fmt.Errorf("could not write lockfile %s: %w", lockPath, err)
+			}
+			removeLockOnExit(lockPath)
+			return nil
+		}
+		if errors.Is(err, os.ErrPermission) || errors.Is(err, syscall.EROFS) {
+			// Nothing can be written there anyway (e.g. a read-only share)
+			log.Warnf("Could not create lockfile %s, not guarding against other instances: %v", lockPath, err)
+			return nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("could not create lockfile %s: %w", lockPath, err)
+		}
+
+		var owner instanceLock
+		data, err := os.ReadFile(lockPath)
+		if err == nil {
+			err = json.Unmarshal(data, &owner)
+		}
+		if err != nil {
+			return fmt.Errorf("lockfile %s exists but is unreadable (%v); remove it if no other instance is running", lockPath, err)
+		}
+
+		if owner.Hostname == hostname && !processAlive(owner.Pid) {
+			log.Warnf("Reclaiming stale lock %s left by dead process %d (started %s)", lockPath, owner.Pid, owner.StartTime)
+			if err := os.Remove(lockPath); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("could not remove stale lockfile %s: %w", lockPath, err)
+			}
+			continue
+		}
+
+		if C.AllowSharedRoot {
+			log.Warnf("Directory %s is already served by pid %d on %s (listening on %s, started %s); continuing because of --allow-shared-root",
+				C.DirpathToServe, owner.Pid, owner.Hostname, owner.Listen, owner.StartTime)
+			return nil
+		}
+		return fmt.Errorf("directory %s is already served by pid %d on %s (listening on %s, started %s); use --allow-shared-root to serve it anyway",
+			C.DirpathToServe, owner.Pid, owner.Hostname, owner.Listen, owner.StartTime)
+	}
+	return fmt.Errorf("could not acquire lockfile %s", lockPath)
+}
+
+// removeLockOnExit removes the lockfile when the server is stopped with
+// SIGINT or SIGTERM.
+func removeLockOnExit(lockPath string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Infof("Received %v, shutting down", sig)
+		os.Remove(lockPath)
+		os.Exit(0)
+	}()
+}
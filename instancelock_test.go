@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// readInstanceLock returns the content of the lockfile of dir.
+func readInstanceLock(t *testing.T, dir string) instanceLock {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, instanceLockName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lock instanceLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		t.Fatalf("invalid lockfile %q: %v", data, err)
+	}
+	return lock
+}
+
+// writeInstanceLock writes a lockfile of another instance into dir.
+func writeInstanceLock(t *testing.T, dir string, lock instanceLock) {
+	t.Helper()
+	data, err := json.Marshal(lock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, instanceLockName), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// deadPid returns the pid of a process that has exited.
+func deadPid(t *testing.T) int {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return cmd.Process.Pid
+}
+
+func TestInstanceLockContention(t *testing.T) {
+	dir := t.TempDir()
+	loadConfig(t, "--dir-to-serve", dir)
+
+	if err := acquireInstanceLock("127.0.0.1:8080"); err != nil {
+		t.Fatalf("first instance: %v", err)
+	}
+	if lock := readInstanceLock(t, dir); lock.Pid != os.Getpid() || lock.Listen != "127.0.0.1:8080" {
+		t.Errorf("lockfile %+v does not name this process", lock)
+	}
+
+	err := acquireInstanceLock("127.0.0.1:9090")
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("pid %d", os.Getpid())) || !strings.Contains(err.Error(), "127.0.0.1:8080") {
+		t.Errorf("second instance: %v, want an error naming the owner", err)
+	}
+
+	C.AllowSharedRoot = true
+	if err := acquireInstanceLock("127.0.0.1:9090"); err != nil {
+		t.Errorf("second instance with --allow-shared-root: %v", err)
+	}
+	if lock := readInstanceLock(t, dir); lock.Listen != "127.0.0.1:8080" {
+		t.Errorf("--allow-shared-root took over the lock of the owner: %+v", lock)
+	}
+}
+
+func TestInstanceLockReclaimsStaleLock(t *testing.T) {
+	dir := t.TempDir()
+	loadConfig(t, "--dir-to-serve", dir)
+	hostname, _ := os.Hostname()
+	writeInstanceLock(t, dir, instanceLock{Pid: deadPid(t), Hostname: hostname, Listen: "0.0.0.0:8080"})
+
+	if err := acquireInstanceLock("127.0.0.1:8080"); err != nil {
+		t.Fatalf("stale lock was not reclaimed: %v", err)
+	}
+	if lock := readInstanceLock(t, dir); lock.Pid != os.Getpid() {
+		t.Errorf("lockfile %+v does not name this process", lock)
+	}
+}
+
+func TestInstanceLockOfOtherHostIsKept(t *testing.T) {
+	dir := t.TempDir()
+	loadConfig(t, "--dir-to-serve", dir)
+	// Whether a process on another host is alive cannot be told from here
+	writeInstanceLock(t, dir, instanceLock{Pid: deadPid(t), Hostname: "other-host.invalid", Listen: "0.0.0.0:8080"})
+
+	if err := acquireInstanceLock("127.0.0.1:8080"); err == nil || !strings.Contains(err.Error(), "other-host.invalid") {
+		t.Errorf("lock of another host: %v, want an error naming it", err)
+	}
+}
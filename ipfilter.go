@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// allowedNets and deniedNets are --allow-ip and --deny-ip, parsed by
+// parseIPRules at startup.
+var allowedNets, deniedNets []netip.Prefix
+
+// parseIPRules parses the --allow-ip, --deny-ip and --trusted-proxies flags,
+// so that a typo fails at startup instead of letting everybody in.
+func parseIPRules() error {
+	var err error
+	if allowedNets, err = parsePrefixes("--allow-ip", C.AllowIPs); err != nil {
+		return err
+	}
+	if deniedNets, err = parsePrefixes("--deny-ip", C.DenyIPs); err != nil {
+		return err
+	}
+	trustedProxies, err = parsePrefixes("--trusted-proxies", C.TrustedProxies)
+	return err
+}
+
+// parsePrefixes parses CIDRs like 192.168.0.0/16 or 2001:db8::/32 and single
+// addresses. IPv4-mapped IPv6 ranges become IPv4 ranges, like the addresses
+// they are compared with.
+func parsePrefixes(flag string, values []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			prefix, err := netip.ParsePrefix(item)
+			if err != nil {
+				addr, addrErr := netip.ParseAddr(item)
+				if addrErr != nil {
+					return nil, fmt.Errorf("invalid %s %q, expected an address or CIDR like 10.0.0.0/8", flag, item)
+				}
+				prefix = netip.PrefixFrom(addr, addr.BitLen())
+			}
+			if prefix.Addr().Zone() != "" {
+				return nil, fmt.Errorf("invalid %s %q, zones are not supported", flag, item)
+			}
+			if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+				prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+			}
+			prefixes = append(prefixes, prefix.Masked())
+		}
+	}
+	return prefixes, nil
+}
+
+// ipAllowed applies the rules to addr: --deny-ip wins, and an empty
+// --allow-ip allows every address that is not denied.
+func ipAllowed(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range deniedNets {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	if len(allowedNets) == 0 {
+		return true
+	}
+	for _, prefix := range allowedNets {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddr returns the address of the peer of the request, which may be a
+// proxy; see clientIP for the address of the client.
+func remoteAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
+
+// ipFilterHandler answers 403 to clients that --allow-ip and --deny-ip keep
+// out, before any other handler runs.
+func ipFilterHandler(next http.Handler) http.Handler {
+	if len(allowedNets) == 0 && len(deniedNets) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		addr, ok := clientIP(r)
+		if !ok || !ipAllowed(addr) {
+			loggerFrom(r.Context()).Warnf("Denied %s %s from %s by --allow-ip/--deny-ip", r.Method, r.URL.Path, clientAddr(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
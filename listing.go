@@ -0,0 +1,488 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Entry is a file or directory inside the served directory, as returned by
+// readListing. It is shared by the HTML listing and the JSON API.
+type Entry struct {
+	Name        string            `json:"name"`
+	Path        string            `json:"path"` // Relative to the served directory, with forward slashes
+	Size        int64             `json:"size"`
+	ModTime     time.Time         `json:"modTime"`
+	IsDir       bool              `json:"isDir"`
+	Symlink     bool              `json:"symlink,omitempty"`
+	Xattrs      map[string]string `json:"xattrs,omitempty"` // Those of --expose-xattrs
+	DownloadURL string            `json:"downloadUrl,omitempty"`
+}
+
+const (
+	defaultPerPage = 200
+	maxPerPage     = 5000
+)
+
+// listingQuery is what a listing request asks for: the dir, q, sort, order,
+// page and per-page query parameters.
+type listingQuery struct {
+	Dir     string // Relative to the served directory, as given by the client
+	Filter  string
+	Sort    listingSort
+	Page    int
+	PerPage int  // 0 means everything on one page
+	Paged   bool // Whether page or per-page were given explicitly
+	Fast    bool // Skip stat'ing entries when possible, see listing.Pending
+}
+
+// parseListingQuery validates the query parameters of a listing request.
+func parseListingQuery(values url.Values) (listingQuery, error) {
+	q := listingQuery{Dir: values.Get("dir"), Filter: values.Get("q"), Page: 1, PerPage: defaultPerPage,
+		Fast: values.Get("fast") == "1"}
+	var err error
+	if q.Sort, err = parseListingSort(values); err != nil {
+		return q, err
+	}
+	if value := values.Get("page"); value != "" {
+		q.Paged = true
+		if q.Page, err = strconv.Atoi(value); err != nil || q.Page < 1 {
+			return q, fmt.Errorf("invalid page %q", value)
+		}
+	}
+	if value := values.Get("per-page"); value != "" {
+		q.Paged = true
+		if q.PerPage, err = strconv.Atoi(value); err != nil || q.PerPage < 1 || q.PerPage > maxPerPage {
+			return q, fmt.Errorf("invalid per-page %q (1 to %d)", value, maxPerPage)
+		}
+	}
+	if _, err := nameMatcher(q.Filter); err != nil {
+		return q, err
+	}
+	return q, nil
+}
+
+// url returns the HTML listing URL for q, with the given page and sort.
+func (q listingQuery) url(page int, s listingSort) string {
+	values := url.Values{}
+	if dir := cleanRelPath(q.Dir); dir != "" {
+		values.Set("dir", dir)
+	}
+	if q.Filter != "" {
+		values.Set("q", q.Filter)
+	}
+	if s.By != "name" {
+		values.Set("sort", s.By)
+	}
+	if s.Desc {
+		values.Set("order", "desc")
+	}
+	if page > 1 {
+		values.Set("page", strconv.Itoa(page))
+	}
+	if q.PerPage != defaultPerPage && q.PerPage != 0 {
+		values.Set("per-page", strconv.Itoa(q.PerPage))
+	}
+	if len(values) == 0 {
+		return "/"
+	}
+	return "/?" + values.Encode()
+}
+
+// listing is one page of a directory listing.
+type listing struct {
+	Entries []Entry `json:"entries"`
+	Total   int     `json:"total"` // Entries matching the filter, on all pages
+	All     int     `json:"-"`     // Entries before filtering
+	Page    int     `json:"page"`
+	PerPage int     `json:"perPage"`
+	Pages   int     `json:"-"`
+	Pending bool    `json:"-"` // Entries have no size or mtime yet, see readListing
+}
+
+// readListing reads the page of the directory listing asked for by q.
+// Entries are filtered and sorted before paging. Without the listing cache
+// and when sorting by name, only the entries on the requested page are
+// stat'ed, and with q.Fast none at all: the listing is then Pending and
+// sizes and times can be fetched later from /api/files/meta.
+func readListing(ctx context.Context, q listingQuery) (listing, error) {
+	dirPath, err := resolvePath(ctx, q.Dir)
+	if err != nil {
+		return listing{}, err
+	}
+	if !isServableDir(q.Dir) {
+		return listing{}, errNotServed
+	}
+	relDir := cleanRelPath(q.Dir)
+	match, err := nameMatcher(q.Filter)
+	if err != nil {
+		return listing{}, err
+	}
+	l := listing{Page: q.Page, PerPage: q.PerPage}
+
+	if listings != nil {
+		cached, err := listings.entries(ctx, relDir, dirPath)
+		if err != nil {
+			return listing{}, err
+		}
+		// The cached slice is shared, filter into a copy before sorting
+		entries := make([]Entry, 0, len(cached))
+		for _, entry := range cached {
+			if match(entry.Name) {
+				entries = append(entries, entry)
+			}
+		}
+		l.All, l.Total = len(cached), len(entries)
+		sortEntries(entries, q.Sort)
+		l.Entries = pageOf(entries, q.Page, q.PerPage)
+		l.Pages = pageCount(l.Total, q.PerPage)
+		addXattrs(dirPath, l.Entries)
+		return l, nil
+	}
+
+	dirEntries, err := readVisibleDir(relDir, dirPath)
+	if err != nil {
+		return listing{}, err
+	}
+	visible := make([]os.DirEntry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		if match(dirEntry.Name()) {
+			visible = append(visible, dirEntry)
+		}
+	}
+	l.All, l.Total = len(dirEntries), len(visible)
+
+	// Sorting by name needs no stat, so only the requested page is stat'ed
+	if q.Sort.By == "name" {
+		sortDirEntries(visible, q.Sort.Desc)
+		visible = pageOf(visible, q.Page, q.PerPage)
+	}
+	if q.Fast && q.Sort.By == "name" {
+		l.Entries = make([]Entry, 0, len(visible))
+		for _, dirEntry := range visible {
+			l.Entries = append(l.Entries, newPendingEntry(relDir, dirEntry))
+		}
+		l.Pending = true
+		l.Pages = pageCount(l.Total, q.PerPage)
+		return l, nil
+	}
+	entries := make([]Entry, 0, len(visible))
+	for _, dirEntry := range visible {
+		entry, err := newEntry(relDir, dirEntry)
+		if err != nil {
+			loggerFrom(ctx).Warnf("Could not get file info for %s: %v", dirEntry.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if q.Sort.By != "name" {
+		sortEntries(entries, q.Sort)
+		entries = pageOf(entries, q.Page, q.PerPage)
+	}
+	l.Entries = entries
+	l.Pages = pageCount(l.Total, q.PerPage)
+	addXattrs(dirPath, l.Entries)
+	return l, nil
+}
+
+// newEntry stats dirEntry, found in the directory relDir.
+func newEntry(relDir string, dirEntry os.DirEntry) (Entry, error) {
+	info, err := dirEntry.Info()
+	if err != nil {
+		return Entry{}, err
+	}
+	return entryFromInfo(relDir, info), nil
+}
+
+// entryFromInfo describes the file with the given info in the directory relDir.
+func entryFromInfo(relDir string, info os.FileInfo) Entry {
+	entry := Entry{
+		Name:    info.Name(),
+		Path:    path.Join(relDir, info.Name()),
+		ModTime: info.ModTime(),
+		IsDir:   info.IsDir(),
+		Symlink: info.Mode()&os.ModeSymlink != 0,
+	}
+	if !entry.IsDir {
+		entry.Size = info.Size()
+		entry.DownloadURL = (&url.URL{Path: "/download/" + entry.Path}).String()
+	}
+	return entry
+}
+
+// newPendingEntry describes dirEntry from what ReadDir returned, without
+// stat'ing it: Size and ModTime are left empty.
+func newPendingEntry(relDir string, dirEntry os.DirEntry) Entry {
+	entry := Entry{
+		Name:    dirEntry.Name(),
+		Path:    path.Join(relDir, dirEntry.Name()),
+		IsDir:   dirEntry.IsDir(),
+		Symlink: dirEntry.Type()&os.ModeSymlink != 0,
+	}
+	if !entry.IsDir {
+		entry.DownloadURL = (&url.URL{Path: "/download/" + entry.Path}).String()
+	}
+	return entry
+}
+
+// pageCount returns the number of pages needed for total entries, at least 1.
+func pageCount(total, perPage int) int {
+	if perPage == 0 || total == 0 {
+		return 1
+	}
+	return (total + perPage - 1) / perPage
+}
+
+// pageOf returns the items on the given page, counting from 1. A perPage
+// of 0 means a single page with everything.
+func pageOf[T any](items []T, page, perPage int) []T {
+	if perPage == 0 {
+		return items
+	}
+	start := (page - 1) * perPage
+	if start >= len(items) {
+		return items[:0]
+	}
+	return items[start:min(start+perPage, len(items))]
+}
+
+// nameMatcher returns a function matching names against query, ignoring
+// case. A query containing wildcards (*, ? or [) is matched as a glob
+// pattern against the whole name, anything else as a substring. An empty
+// query matches everything.
+func nameMatcher(query string) (func(name string) bool, error) {
+	query = strings.ToLower(query)
+	if !strings.ContainsAny(query, "*?[") {
+		return func(name string) bool {
+			return strings.Contains(strings.ToLower(name), query)
+		}, nil
+	}
+	if _, err := path.Match(query, ""); err != nil {
+		return nil, fmt.Errorf("invalid pattern %q", query)
+	}
+	return func(name string) bool {
+		matched, _ := path.Match(query, strings.ToLower(name))
+		return matched
+	}, nil
+}
+
+// viewState reads the state of the listing a request came from (dir, q,
+// sort, order, page and per-page, as in the listing's own URL), so that
+// actions can lead back to the same view. Invalid parameters fall back to
+// their defaults instead of failing the action.
+func viewState(values url.Values) listingQuery {
+	valid := url.Values{}
+	for _, key := range []string{"dir", "q", "sort", "order", "page", "per-page"} {
+		if !values.Has(key) {
+			continue
+		}
+		candidate := maps.Clone(valid)
+		candidate.Set(key, values.Get(key))
+		if _, err := parseListingQuery(candidate); err == nil {
+			valid = candidate
+		}
+	}
+	q, _ := parseListingQuery(valid)
+	return q
+}
+
+// returnURL is the URL an action redirects to: the listing view the request
+// came from, showing relDir.
+func returnURL(r *http.Request, relDir string) string {
+	q := viewState(r.URL.Query())
+	q.Dir = relDir
+	return q.url(q.Page, q.Sort)
+}
+
+// state is the query string of the view q, for the action URLs of pages,
+// which pass it back to returnURL.
+func (q listingQuery) state() template.URL {
+	_, query, _ := strings.Cut(q.url(q.Page, q.Sort), "?")
+	return template.URL(query)
+}
+
+// listingSort is the order of a listing, from the sort and order query
+// parameters. The zero value is not valid, use parseListingSort.
+type listingSort struct {
+	By   string // name, size or mtime
+	Desc bool
+}
+
+// parseListingSort reads ?sort=name|size|mtime&order=asc|desc, defaulting
+// to name ascending.
+func parseListingSort(query url.Values) (listingSort, error) {
+	s := listingSort{By: "name"}
+	switch by := query.Get("sort"); by {
+	case "", "name":
+	case "size", "mtime":
+		s.By = by
+	default:
+		return s, fmt.Errorf("invalid sort %q (valid: name, size, mtime)", by)
+	}
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		s.Desc = true
+	default:
+		return s, fmt.Errorf("invalid order %q (valid: asc, desc)", order)
+	}
+	return s, nil
+}
+
+// sortEntries sorts entries in place by s. Directories always come before
+// files, and entries with equal size or mtime are in natural name order.
+func sortEntries(entries []Entry, s listingSort) {
+	compare := func(a, b Entry) int {
+		switch s.By {
+		case "size":
+			return cmp.Compare(a.Size, b.Size)
+		case "mtime":
+			return a.ModTime.Compare(b.ModTime)
+		default:
+			return 0
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir != b.IsDir {
+			return a.IsDir
+		}
+		c := compare(a, b)
+		if c == 0 {
+			if s.By != "name" || !s.Desc {
+				return naturalLess(a.Name, b.Name)
+			}
+			return naturalLess(b.Name, a.Name)
+		}
+		if s.Desc {
+			return c > 0
+		}
+		return c < 0
+	})
+}
+
+// sortDirEntries sorts entries in place in natural name order, with
+// directories first, without stat'ing them.
+func sortDirEntries(entries []os.DirEntry, desc bool) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.IsDir() != b.IsDir() {
+			return a.IsDir()
+		}
+		if desc {
+			return naturalLess(b.Name(), a.Name())
+		}
+		return naturalLess(a.Name(), b.Name())
+	})
+}
+
+// sortLink is a column header of the HTML listing, linking to the listing
+// sorted by that column.
+type sortLink struct {
+	Label string
+	URL   string
+	Arrow string // Shown next to the column the listing is currently sorted by
+}
+
+// sortLinks returns the column headers for the listing asked for by q.
+// Following the link of the current column toggles the order, and any
+// link goes back to the first page.
+func sortLinks(q listingQuery) []sortLink {
+	columns := []struct{ by, label string }{{"name", "Name"}, {"size", "Size"}, {"mtime", "Modified"}}
+	links := make([]sortLink, 0, len(columns))
+	for _, column := range columns {
+		link := sortLink{Label: column.label}
+		s := listingSort{By: column.by}
+		if column.by == q.Sort.By {
+			link.Arrow = "▲"
+			if q.Sort.Desc {
+				link.Arrow = "▼"
+			} else {
+				s.Desc = true
+			}
+		}
+		link.URL = q.url(1, s)
+		links = append(links, link)
+	}
+	return links
+}
+
+// writePlainListing writes one path per line, for use in shell pipelines.
+// Directories get a trailing slash. With long, size in bytes and RFC3339
+// modification time follow, separated by tabs.
+func writePlainListing(w http.ResponseWriter, entries []Entry, long bool) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	for _, entry := range entries {
+		name := entry.Path
+		if entry.IsDir {
+			name += "/"
+		}
+		if long {
+			fmt.Fprintf(w, "%s\t%d\t%s\n", name, entry.Size, entry.ModTime.Format(time.RFC3339))
+		} else {
+			fmt.Fprintln(w, name)
+		}
+	}
+}
+
+// listDirError maps an error from readListing to an HTTP status and message,
+// switching the server to degraded mode if the root itself went away.
+func listDirError(ctx context.Context, rel string, err error) (int, string) {
+	logger := loggerFrom(ctx)
+	switch {
+	case errors.Is(err, errSymlinkOutside):
+		logger.Warnf("Refused to list %s: symlink leads outside the served directory", rel)
+		return http.StatusForbidden, "Symlink leads outside the served directory"
+	case errors.Is(err, errOutsideRoot) || errors.Is(err, errInvalidPath):
+		logger.Warnf("Attempted path traversal on listing: %s", rel)
+		return http.StatusBadRequest, "Invalid directory"
+	case isRootUnavailableErr(err) && !root.check():
+		root.reject()
+		return http.StatusServiceUnavailable, "Served directory is unavailable"
+	case os.IsNotExist(err) || errors.Is(err, errNotServed):
+		return http.StatusNotFound, "Directory not found"
+	default:
+		logger.Errorf("Failed to read directory %s: %v", rel, err)
+		return http.StatusInternalServerError, "Could not read directory"
+	}
+}
+
+// apiFilesHandler serves GET /api/files?dir=<relpath>, the JSON counterpart
+// of the HTML listing. It accepts the same q, sort, order, page and
+// per-page parameters. With ?fast=1 and the name sort, entries come without
+// size and modTime, see apiFilesMetaHandler.
+func apiFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	q, err := parseListingQuery(r.URL.Query())
+	if err != nil {
+		writeJSONError(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	l, err := readListing(r.Context(), q)
+	if err != nil {
+		status, msg := listDirError(r.Context(), q.Dir, err)
+		writeJSONError(w, r, status, msg)
+		return
+	}
+	if l.Pending {
+		writeJSON(w, r, http.StatusOK, pendingListing(l))
+		return
+	}
+	writeJSON(w, r, http.StatusOK, l)
+}
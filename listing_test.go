@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSortEntries(t *testing.T) {
+	t1 := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2, t3 := t1.Add(time.Hour), t1.Add(2*time.Hour)
+	entries := []Entry{
+		{Name: "b", Size: 10, ModTime: t1},
+		{Name: "zdir", IsDir: true, ModTime: t1},
+		{Name: "d", Size: 20, ModTime: t1},
+		{Name: "a", Size: 10, ModTime: t2},
+		{Name: "adir", IsDir: true, ModTime: t3},
+		{Name: "c", Size: 5, ModTime: t3},
+	}
+
+	// a and b have the same size, b and d the same time: ties are always
+	// in ascending name order, except when sorting by name descending
+	for _, tc := range []struct {
+		sort listingSort
+		want []string
+	}{
+		{listingSort{By: "name"}, []string{"adir", "zdir", "a", "b", "c", "d"}},
+		{listingSort{By: "name", Desc: true}, []string{"zdir", "adir", "d", "c", "b", "a"}},
+		{listingSort{By: "size"}, []string{"adir", "zdir", "c", "a", "b", "d"}},
+		{listingSort{By: "size", Desc: true}, []string{"adir", "zdir", "d", "a", "b", "c"}},
+		{listingSort{By: "mtime"}, []string{"zdir", "adir", "b", "d", "a", "c"}},
+		{listingSort{By: "mtime", Desc: true}, []string{"adir", "zdir", "c", "a", "b", "d"}},
+	} {
+		// The result must not depend on the order the entries were read in
+		for _, input := range [][]Entry{entries, reversed(entries), append(slices.Clone(entries[3:]), entries[:3]...)} {
+			sorted := slices.Clone(input)
+			sortEntries(sorted, tc.sort)
+			if got := names(sorted); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("sort %+v of %v: %v, want %v", tc.sort, names(input), got, tc.want)
+			}
+		}
+	}
+}
+
+func reversed(entries []Entry) []Entry {
+	r := slices.Clone(entries)
+	slices.Reverse(r)
+	return r
+}
+
+func names(entries []Entry) []string {
+	var n []string
+	for _, entry := range entries {
+		n = append(n, entry.Name)
+	}
+	return n
+}
+
+func TestActionsKeepViewState(t *testing.T) {
+	server, dir := newTestServer(t)
+	for i := 1; i <= 6; i++ {
+		writeFile(t, dir, fmt.Sprintf("sub/a%d.txt", i), strings.Repeat("x", i))
+	}
+	writeFile(t, dir, "sub/other.txt", "x")
+	// Page 2 of the files matching "a" in sub, largest first, 2 per page
+	view := "/?" + url.Values{
+		"dir": {"sub"}, "q": {"a"}, "sort": {"size"}, "order": {"desc"}, "page": {"2"}, "per-page": {"2"},
+	}.Encode()
+
+	resp, page := send(t, newRequest(t, http.MethodGet, server.URL+view, nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET %s: %d", view, resp.StatusCode)
+	}
+	// The action URLs of the page, as the browser sends them
+	action := func(route string) string {
+		t.Helper()
+		match := regexp.MustCompile(`hx-post="` + regexp.QuoteMeta(route) + `(\?[^"]*)"`).FindStringSubmatch(page)
+		if match == nil {
+			t.Fatalf("no action %s in the listing", route)
+		}
+		return server.URL + route + html.UnescapeString(match[1])
+	}
+	_, query, _ := strings.Cut(view, "?")
+
+	for _, tc := range []struct {
+		name string
+		req  *http.Request
+	}{
+		{"upload", multipartUpload(t, action("/upload"), nil, [][2]string{{"new.txt", "x"}})},
+		{"delete", postForm(t, action("/delete"), url.Values{"files": {encodeFormPath("sub/a1.txt")}})},
+		// renameFile() posts to /rename with the query of the page
+		{"rename", postForm(t, server.URL+"/rename?"+query, url.Values{"from": {"sub/a2.txt"}, "to": {"sub/b2.txt"}})},
+	} {
+		resp, body := send(t, tc.req)
+		if resp.StatusCode != http.StatusSeeOther {
+			t.Errorf("%s: %d %q, want 303", tc.name, resp.StatusCode, body)
+			continue
+		}
+		if location := resp.Header.Get("Location"); location != view {
+			t.Errorf("%s: redirected to %s, want %s", tc.name, location, view)
+		}
+	}
+	if stored := snapshot(t, filepath.Join(dir, "sub")); stored["new.txt"] != "x" || stored["b2.txt"] != "xx" || stored["a1.txt"] != "" {
+		t.Errorf("the actions were not all done: %v", stored)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	listingCacheTTL     = 5 * time.Second
+	listingCacheMaxDirs = 256
+)
+
+// listingCache holds the stat'ed entries of recently listed directories,
+// keyed by their path relative to the served directory. Entries are dropped
+// when fsnotify reports a change in the directory, when an upload or delete
+// touches it, and in any case after listingCacheTTL, as fsnotify does not
+// see every change on network filesystems.
+type listingCache struct {
+	mu      sync.Mutex
+	dirs    map[string]cachedListing
+	epoch   uint64 // Incremented by every invalidation
+	watcher *fsnotify.Watcher
+}
+
+type cachedListing struct {
+	entries []Entry
+	loaded  time.Time
+}
+
+// listings is nil, meaning no caching, with --no-listing-cache, --low-memory
+// or --progressive-listing (whose point is not to stat everything up front).
+var listings *listingCache
+
+// startListingCache enables the listing cache unless it is disabled. If
+// fsnotify is not available, entries only expire after listingCacheTTL.
+func startListingCache() {
+	if C.NoListingCache || C.LowMemory || C.ProgressiveListing {
+		return
+	}
+	listings = &listingCache{dirs: make(map[string]cachedListing)}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Warnf("Could not start filesystem watcher, listings are cached for %s only: %v", listingCacheTTL, err)
+		return
+	}
+	listings.watcher = watcher
+	go listings.watch()
+}
+
+// entries returns the visible entries of dirPath, the directory relDir,
+// reading them from disk if they are not cached.
+func (c *listingCache) entries(ctx context.Context, relDir, dirPath string) ([]Entry, error) {
+	c.mu.Lock()
+	cached, ok := c.dirs[relDir]
+	epoch := c.epoch
+	c.mu.Unlock()
+	if ok && time.Since(cached.loaded) < listingCacheTTL {
+		return cached.entries, nil
+	}
+
+	dirEntries, err := readVisibleDir(relDir, dirPath)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]Entry, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		entry, err := newEntry(relDir, dirEntry)
+		if err != nil {
+			loggerFrom(ctx).Warnf("Could not get file info for %s: %v", dirEntry.Name(), err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	if c.watcher != nil && !ok {
+		if err := c.watcher.Add(dirPath); err != nil {
+			loggerFrom(ctx).Debugf("Could not watch %s, relying on cache expiry: %v", dirPath, err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Something changed while reading: the result may already be stale
+	if c.epoch != epoch {
+		return entries, nil
+	}
+	if len(c.dirs) >= listingCacheMaxDirs {
+		c.evictOldest()
+	}
+	c.dirs[relDir] = cachedListing{entries: entries, loaded: time.Now()}
+	return entries, nil
+}
+
+// evictOldest drops the least recently loaded directory. c.mu must be held.
+func (c *listingCache) evictOldest() {
+	var oldest string
+	var oldestTime time.Time
+	for relDir, cached := range c.dirs {
+		if oldestTime.IsZero() || cached.loaded.Before(oldestTime) {
+			oldest, oldestTime = relDir, cached.loaded
+		}
+	}
+	delete(c.dirs, oldest)
+	if c.watcher != nil {
+		if dirPath, err := resolvePath(context.Background(), oldest); err == nil {
+			c.watcher.Remove(dirPath)
+		}
+	}
+}
+
+// invalidate drops the cached listing of the directory at dirPath, a
+// filesystem path inside the served directory.
+func (c *listingCache) invalidate(dirPath string) {
+	rel, err := filepath.Rel(C.DirpathToServe, dirPath)
+	if err != nil {
+		return
+	}
+	relDir := cleanRelPath(rel)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.epoch++
+	delete(c.dirs, relDir)
+}
+
+// watch invalidates directories as fsnotify reports changes in them. An
+// event also invalidates the entry's own listing, for directories that were
+// removed or renamed.
+func (c *listingCache) watch() {
+	for {
+		select {
+		case event, ok := <-c.watcher.Events:
+			if !ok {
+				return
+			}
+			if name := filepath.Base(event.Name); isPartialFile(name) || name == instanceLockName {
+				continue // Never listed, e.g. the writes of an upload in progress
+			}
+			c.invalidate(filepath.Dir(event.Name))
+			c.invalidate(event.Name)
+			invalidateTotals()
+		case err, ok := <-c.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Events may have been lost (e.g. queue overflow): start over
+			log.Warnf("Filesystem watcher error, dropping cached listings: %v", err)
+			c.mu.Lock()
+			c.epoch++
+			c.dirs = make(map[string]cachedListing)
+			c.mu.Unlock()
+		}
+	}
+}
+
+// invalidateListing tells the listing cache, if enabled, that the contents
+// of the directory at dirPath changed, and the totals of the served
+// directory with them.
+func invalidateListing(dirPath string) {
+	invalidateTotals()
+	if listings != nil {
+		listings.invalidate(dirPath)
+	}
+}
+
+// invalidateListingTree is invalidateListing for dirPath and each of its
+// parents inside the served directory, after creating directories.
+func invalidateListingTree(dirPath string) {
+	for {
+		invalidateListing(dirPath)
+		rel, err := filepath.Rel(C.DirpathToServe, dirPath)
+		if err != nil || cleanRelPath(rel) == "" {
+			return
+		}
+		dirPath = filepath.Dir(dirPath)
+	}
+}
+
+// readVisibleDir reads the directory at dirPath, the directory relDir,
+// without the entries that are never listed.
+func readVisibleDir(relDir, dirPath string) ([]os.DirEntry, error) {
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	visible := dirEntries[:0]
+	for _, dirEntry := range dirEntries {
+		if isPartialFile(dirEntry.Name()) || dirEntry.Name() == instanceLockName {
+			continue // Upload still in progress, or our own lockfile
+		}
+		rel := path.Join(relDir, dirEntry.Name())
+		if dirEntry.IsDir() && !isServableDir(rel) || !dirEntry.IsDir() && !isServable(rel) {
+			continue // Hidden, or left out by --include/--exclude
+		}
+		visible = append(visible, dirEntry)
+	}
+	return visible, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// newRotatingLog returns the writer of --log-file, which renames the file
+// with a timestamp once it reaches --log-max-size and removes the renamed
+// files beyond --log-max-backups or older than --log-max-age, compressing
+// them with --log-compress. Writes are serialized, so entries from
+// concurrent goroutines are never lost or mixed up while it rotates.
+func newRotatingLog(logFilePath string) (*lumberjack.Logger, error) {
+	// lumberjack opens the file on the first write: try it now, so that an
+	// unwritable path stops the startup with a clear error
+	file, err := os.OpenFile(logFilePath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open --log-file: %w", err)
+	}
+	file.Close()
+	if C.LogMaxSize <= 0 {
+		return nil, fmt.Errorf("--log-max-size must be at least 1 (MB)")
+	}
+	logger := &lumberjack.Logger{
+		Filename:   logFilePath,
+		MaxSize:    C.LogMaxSize,
+		MaxAge:     C.LogMaxAge,
+		MaxBackups: C.LogMaxBackups,
+		LocalTime:  true,
+		Compress:   C.LogCompress,
+	}
+	handleRotateSignal(logger)
+	return logger, nil
+}
+
+// rotateLog rotates the log file now, on request of an external tool.
+func rotateLog(logger *lumberjack.Logger) {
+	if err := logger.Rotate(); err != nil {
+		log.Errorf("Could not rotate the log file: %v", err)
+		return
+	}
+	log.Infof("Rotated the log file")
+}
@@ -0,0 +1,23 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// handleRotateSignal rotates the log file on SIGUSR1, e.g. from a
+// postrotate script of logrotate.
+func handleRotateSignal(logger *lumberjack.Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	go func() {
+		for range signals {
+			rotateLog(logger)
+		}
+	}()
+}
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "gopkg.in/natefinch/lumberjack.v2"
+
+// handleRotateSignal does nothing: Windows has no SIGUSR1, the log file is
+// only rotated by size.
+func handleRotateSignal(logger *lumberjack.Logger) {}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	copyBufferSize          = 32 * 1024
+	lowMemoryCopyBufferSize = 4 * 1024
+	lowMemoryGCPercent      = 20
+	lowMemoryMaxTransfers   = 2
+)
+
+// copyBuffers holds the buffers used to stream uploads to disk. Its size is
+// fixed by applyLowMemory before the server starts.
+var copyBuffers = newCopyBufferPool(copyBufferSize)
+
+// transferSlots limits the number of concurrent uploads and downloads. It is
+// nil, meaning unlimited, unless --low-memory is set.
+var transferSlots chan struct{}
+
+func newCopyBufferPool(size int) *sync.Pool {
+	return &sync.Pool{New: func() interface{} {
+		buf := make([]byte, size)
+		return &buf
+	}}
+}
+
+// applyLowMemory configures the process for --low-memory: smaller copy
+// buffers, at most lowMemoryMaxTransfers concurrent transfers and more
+// frequent garbage collection. It must run before the server starts.
+func applyLowMemory() {
+	if !C.LowMemory {
+		return
+	}
+	copyBuffers = newCopyBufferPool(lowMemoryCopyBufferSize)
+	transferSlots = make(chan struct{}, lowMemoryMaxTransfers)
+	debug.SetGCPercent(lowMemoryGCPercent)
+	log.Infof("Low-memory mode: %d KiB copy buffers, at most %d concurrent transfers, GOGC=%d",
+		lowMemoryCopyBufferSize/1024, lowMemoryMaxTransfers, lowMemoryGCPercent)
+}
+
+// transferring guards every handler that streams file content, so that
+// concurrent transfers are capped in one place in --low-memory mode.
+// Requests over the limit wait for a free slot until the client gives up.
+func transferring(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if transferSlots == nil {
+			handler(w, r)
+			return
+		}
+		select {
+		case transferSlots <- struct{}{}:
+			defer func() { <-transferSlots }()
+		case <-r.Context().Done():
+			return
+		}
+		handler(w, r)
+	}
+}
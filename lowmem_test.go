@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"testing"
+	"time"
+)
+
+// gcPercent returns the current GOGC setting.
+func gcPercent() int {
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+	return percent
+}
+
+func TestLowMemoryConfiguration(t *testing.T) {
+	original := gcPercent()
+	t.Cleanup(func() {
+		debug.SetGCPercent(original)
+		copyBuffers = newCopyBufferPool(copyBufferSize)
+		transferSlots = nil
+		listings = nil
+	})
+
+	for _, tc := range []struct {
+		args      []string
+		bufSize   int
+		slots     int
+		gcPercent int
+		cache     bool
+	}{
+		{nil, copyBufferSize, 0, original, true},
+		{[]string{"--low-memory"}, 4 * 1024, 2, 20, false},
+	} {
+		loadConfig(t, append([]string{"--dir-to-serve", t.TempDir()}, tc.args...)...)
+		copyBuffers = newCopyBufferPool(copyBufferSize)
+		transferSlots = nil
+		listings = nil
+		debug.SetGCPercent(original)
+
+		applyLowMemory()
+		startListingCache()
+		if buf := copyBuffers.Get().(*[]byte); len(*buf) != tc.bufSize {
+			t.Errorf("%v: copy buffers of %d bytes, want %d", tc.args, len(*buf), tc.bufSize)
+		}
+		if cap(transferSlots) != tc.slots {
+			t.Errorf("%v: %d transfer slots, want %d", tc.args, cap(transferSlots), tc.slots)
+		}
+		if percent := gcPercent(); percent != tc.gcPercent {
+			t.Errorf("%v: GOGC=%d, want %d", tc.args, percent, tc.gcPercent)
+		}
+		if (listings != nil) != tc.cache {
+			t.Errorf("%v: listing cache enabled: %t, want %t", tc.args, listings != nil, tc.cache)
+		}
+		if listings != nil && listings.watcher != nil {
+			listings.watcher.Close()
+		}
+	}
+}
+
+func TestLowMemoryCapsTransfers(t *testing.T) {
+	original := gcPercent()
+	t.Cleanup(func() { debug.SetGCPercent(original) })
+	server, dir := newTestServer(t, "--low-memory")
+	writeFile(t, dir, "a.txt", "a")
+
+	// Two transfers in progress take every slot
+	transferSlots <- struct{}{}
+	transferSlots <- struct{}{}
+	for _, route := range downloadRoutes {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		req := newRequest(t, http.MethodGet, server.URL+route+"a.txt", nil).WithContext(ctx)
+		if resp, err := testClient.Do(req); err == nil {
+			resp.Body.Close()
+			t.Errorf("GET %s: %d while every transfer slot is taken, want it to wait", route, resp.StatusCode)
+		}
+		cancel()
+	}
+
+	<-transferSlots
+	for _, route := range downloadRoutes {
+		if resp, _ := send(t, newRequest(t, http.MethodGet, server.URL+route+"a.txt", nil)); resp.StatusCode != http.StatusOK {
+			t.Errorf("GET %s with a free slot: %d, want 200", route, resp.StatusCode)
+		}
+	}
+}
@@ -1,15 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
+	"io/fs"
+	"maps"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
+	"time"
 
-	"github.com/davecgh/go-spew/spew"
 	"github.com/mattn/go-isatty"
 	log "github.com/sirupsen/logrus"
 	cli "github.com/urfave/cli/v2"
@@ -21,15 +31,97 @@ type Config struct {
 	ListenIp       string
 	ListenPort     int
 	LogLevel       string
+	LogFile        string
+	ConsoleLevel   string
+	FileLevel      string
+	Quiet          bool
+	NoColor        bool
+	LogMaxSize     int
+	LogMaxAge      int
+	LogMaxBackups  int
+	LogCompress    bool
+	LogSyslog      string
+	TlsCertFile    string
+	TlsKeyFile     string
+	TlsMinVersion  string
+	AcmeDomains    []string
+	AcmeCacheDir   string
+	ReadOnly       bool
+	UploadOnly     bool
+	OnConflict     string
+	DirMode        string
+	MaxBandwidth   string
+	RateSchedule   string
+	RateScheduleTZ string
+	MinFreeSpace   string
+	Quota          string
+	PartialMaxAge  time.Duration
+	MkdirOnUpload  bool
+	LowMemory      bool
+	NoListingCache bool
+	MaxUploadFiles int
+	ShowHidden     bool
+	SIUnits        bool
+	Includes       []string
+	Excludes       []string
+	ExposeXattrs   []string
+	CorsOrigins    []string
+	AllowIPs       []string
+	DenyIPs        []string
+	TrustedProxies []string
+	ThumbMaxPixels int64
+	ViewMaxSize    int64
+	AuthExec       string
+	AuthURL        string
+	Trash          bool
+	AllowDirDelete bool
+	FollowSymlinks bool
+	Metrics        bool
+	MetricsPort    int
+	DebugListen    string
+	AccessLog      string
+	AccessLogFmt   string
+
+	PerConnBandwidth   string
+	SlowReadThreshold  time.Duration
+	UploadQueueWait    time.Duration
+	FirstByteDeadline  time.Duration
+	ProgressiveListing bool
+	AuthCacheTTL       time.Duration
+	AuthTimeout        time.Duration
+
+	AllowNestedUpload bool
+	AllowSharedRoot   bool
+	AllowInlineHTML   bool
+
+	CorsAllowCredentials bool
+	MaxConcurrentUploads int
+
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	WriteTimeout      time.Duration
 }
 
 // FileViewData holds information for displaying a file in the template.
 type FileViewData struct {
 	Name    string
-	SizeMB  string
+	Path    string // Relative to the served directory, with forward slashes
+	IsDir   bool
+	Size    string // Human readable, see humanSize
+	Bytes   int64
+	Inline  bool // Whether a "view" link is shown, judged by the extension only
+	Thumb   bool // Whether a thumbnail is shown, see hasThumbnail
+	Preview bool // Whether a "preview" link to /view/ is shown, see hasPreview
+	Pending bool // Size and ModTime are not known yet, see --progressive-listing
+	Symlink bool
 	ModTime string
 }
 
+// FormValue is the value of the file's checkbox, see encodeFormPath.
+func (f FileViewData) FormValue() string {
+	return encodeFormPath(f.Path)
+}
+
 // C is the global configuration variable.
 var C Config
 
@@ -39,38 +131,45 @@ var (
 
 // LogHook is a custom logrus hook to write to multiple outputs with different formatters.
 type LogHook struct {
-	writers    []io.Writer
-	formatters []log.Formatter
-	logLevels  []log.Level
+	outputs []logOutput
 }
 
-// NewLogHook creates a new hook.
+// logOutput is one output of LogHook, with the levels it receives.
+type logOutput struct {
+	writer    io.Writer
+	formatter log.Formatter
+	levels    []log.Level
+}
+
+// levelWriter is an output of LogHook that needs the level of each entry,
+// like syslog.
+type levelWriter interface {
+	io.Writer
+	WriteLevel(level log.Level, p []byte) error
+}
+
+// Add adds an output receiving the entries of the given levels.
 func (hook *LogHook) Add(writer io.Writer, formatter log.Formatter, levels []log.Level) {
-	hook.writers = append(hook.writers, writer)
-	hook.formatters = append(hook.formatters, formatter)
-	hook.logLevels = append(hook.logLevels, levels...)
+	hook.outputs = append(hook.outputs, logOutput{writer: writer, formatter: formatter, levels: levels})
 }
 
 // Fire is called by logrus when a log entry is made.
 func (hook *LogHook) Fire(entry *log.Entry) error {
-	for i, writer := range hook.writers {
-		// Check if the level of the entry is one of the levels for this writer
-		isLoggable := false
-		for _, level := range hook.logLevels {
-			if entry.Level <= level {
-				isLoggable = true
-				break
-			}
+	for _, output := range hook.outputs {
+		if !slices.Contains(output.levels, entry.Level) {
+			continue
 		}
-
-		if isLoggable {
-			formatted, err := hook.formatters[i].Format(entry)
-			if err != nil {
-				return err
-			}
-			if _, err := writer.Write(formatted); err != nil {
-				return err
-			}
+		formatted, err := output.formatter.Format(entry)
+		if err != nil {
+			return err
+		}
+		if leveled, ok := output.writer.(levelWriter); ok {
+			err = leveled.WriteLevel(entry.Level, formatted)
+		} else {
+			_, err = output.writer.Write(formatted)
+		}
+		if err != nil {
+			return err
 		}
 	}
 	return nil
@@ -81,59 +180,222 @@ func (hook *LogHook) Levels() []log.Level {
 	return log.AllLevels
 }
 
-func setupLogging(level string) {
-	spew.Config.Indent = "  "
+// levelsUpTo returns the levels from panic up to level, e.g. up to warn for
+// warnings and errors only.
+func levelsUpTo(level log.Level) []log.Level {
+	return log.AllLevels[:level+1]
+}
 
-	logLevel, err := log.ParseLevel(level)
+// parseOutputLevel parses the level of an output from flag, which defaults
+// to --log-level.
+func parseOutputLevel(flag, value string, defaultLevel log.Level) (log.Level, error) {
+	if value == "" {
+		return defaultLevel, nil
+	}
+	level, err := log.ParseLevel(value)
 	if err != nil {
-		log.Fatalf("Invalid log level: %v", err)
+		return 0, fmt.Errorf("invalid --%s: %v", flag, err)
 	}
-	log.SetLevel(logLevel)
-	log.SetOutput(io.Discard) // All output is now handled by the hook
+	return level, nil
+}
 
-	logFile, err := os.OpenFile("/tmp/hfs.last.log", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0666)
+// setupLogging sends the logs to the console and, with --log-file, as JSON
+// to that file, and with --log-syslog to syslog. --console-level and
+// --file-level set the levels of the first two, --log-level that of the
+// others. It must run only once.
+func setupLogging() error {
+	logLevel, err := log.ParseLevel(C.LogLevel)
+	if err != nil {
+		return fmt.Errorf("invalid --log-level: %v", err)
+	}
+	consoleLevel, err := parseOutputLevel("console-level", C.ConsoleLevel, logLevel)
+	if err != nil {
+		return err
+	}
+	if C.Quiet {
+		consoleLevel = min(consoleLevel, log.WarnLevel)
+	}
+	fileLevel, err := parseOutputLevel("file-level", C.FileLevel, logLevel)
 	if err != nil {
-		log.Fatalf("Failed to open log file: %v", err)
+		return err
+	}
+	var logFile io.Writer
+	if C.LogFile != "" {
+		if logFile, err = openLogFile(C.LogFile); err != nil {
+			return err
+		}
+	}
+	var syslogOut io.Writer
+	if C.LogSyslog != "" {
+		if syslogOut, err = newSyslogWriter(C.LogSyslog); err != nil {
+			return err
+		}
 	}
 
-	var consoleFormatter log.Formatter
-	if isatty.IsTerminal(os.Stdout.Fd()) {
-		consoleFormatter = &log.TextFormatter{ForceColors: true, FullTimestamp: true}
-	} else {
-		consoleFormatter = &log.JSONFormatter{}
+	// Entries are only made up to the most verbose level of the outputs,
+	// each output then takes those of its own levels
+	maxLevel := max(logLevel, consoleLevel)
+	if logFile != nil {
+		maxLevel = max(maxLevel, fileLevel)
 	}
+	log.SetLevel(maxLevel)
+	log.SetOutput(io.Discard) // All output is now handled by the hook
 
 	hook := &LogHook{}
-	hook.Add(os.Stdout, consoleFormatter, log.AllLevels)
-	hook.Add(logFile, &log.JSONFormatter{}, log.AllLevels)
+	hook.Add(os.Stdout, newConsoleFormatter(), levelsUpTo(consoleLevel))
+	if logFile != nil {
+		hook.Add(logFile, &log.JSONFormatter{}, levelsUpTo(fileLevel))
+	}
+	if syslogOut != nil {
+		hook.Add(syslogOut, &log.TextFormatter{DisableTimestamp: true, DisableColors: true}, levelsUpTo(logLevel))
+	}
 	log.AddHook(hook)
+	return nil
+}
+
+// newConsoleFormatter returns the formatter of the console: text, colored
+// unless --no-color or NO_COLOR is set, on a terminal and JSON otherwise.
+// --no-color always gives plain text.
+func newConsoleFormatter() log.Formatter {
+	switch {
+	case C.NoColor:
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	case !isatty.IsTerminal(os.Stdout.Fd()):
+		return &log.JSONFormatter{}
+	case os.Getenv("NO_COLOR") != "":
+		return &log.TextFormatter{DisableColors: true, FullTimestamp: true}
+	}
+	return &log.TextFormatter{ForceColors: true, FullTimestamp: true}
+}
+
+// logConfig logs the effective configuration on one line, with a field per
+// setting and the secrets redacted.
+func logConfig() {
+	config := reflect.ValueOf(redactedConfig())
+	fields := log.Fields{}
+	for i := 0; i < config.NumField(); i++ {
+		value := config.Field(i).Interface()
+		if duration, ok := value.(time.Duration); ok {
+			value = duration.String()
+		}
+		fields[config.Type().Field(i).Name] = value
+	}
+	log.WithFields(fields).Info("Current configuration")
+}
+
+// openLogFile opens --log-file for appending, rotating it by size. "auto"
+// stands for http-file-server/hfs.log in the user's cache directory, which
+// depends on the OS.
+func openLogFile(logFilePath string) (io.Writer, error) {
+	if logFilePath == "auto" {
+		cacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, fmt.Errorf("no location for --log-file auto: %w", err)
+		}
+		logFilePath = filepath.Join(cacheDir, "http-file-server", "hfs.log")
+		if err := os.MkdirAll(filepath.Dir(logFilePath), 0755); err != nil {
+			return nil, fmt.Errorf("could not create the directory of --log-file: %w", err)
+		}
+	}
+	return newRotatingLog(logFilePath)
 }
 
 func main() {
+	if err := newApp().Run(os.Args); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// newApp returns the command line application, whose flags fill C.
+func newApp() *cli.App {
 	app := &cli.App{
 		Name:    "http-file-server",
 		Usage:   "A simple HTTP server for file listing, uploading, and downloading.",
 		Version: version,
 		Flags: []cli.Flag{
 			&cli.StringFlag{Name: "log-level", Value: "info", Usage: "Set log level (trace, debug, info, warn, error, fatal, panic)"},
+			&cli.BoolFlag{Name: "quiet", Aliases: []string{"q"}, Usage: "Do not log the configuration at startup, and only warnings and errors on the console"},
+			&cli.BoolFlag{Name: "no-color", Usage: "Log plain text without colors on the console (also with the NO_COLOR environment variable on a terminal)"},
+			&cli.StringFlag{Name: "console-level", Usage: "Log level of the console output (default: --log-level)"},
+			&cli.StringFlag{Name: "file-level", Usage: "Log level of --log-file (default: --log-level)"},
+			&cli.StringFlag{Name: "log-file", Usage: "Also write the log as JSON to this file, or \"auto\" for hfs.log in the user cache directory (default: console only)"},
+			&cli.IntFlag{Name: "log-max-size", Value: 100, Usage: "Rotate --log-file when it reaches this size in MB, renaming it with a timestamp (SIGUSR1 rotates it at once)"},
+			&cli.IntFlag{Name: "log-max-age", Usage: "Remove rotated log files older than this many days (0 = keep)"},
+			&cli.IntFlag{Name: "log-max-backups", Value: 10, Usage: "Keep at most this many rotated log files (0 = all)"},
+			&cli.BoolFlag{Name: "log-compress", Usage: "Gzip rotated log files"},
+			&cli.StringFlag{Name: "log-syslog", Usage: "Also send the log to syslog, tagged \"hfs\": \"local\" for the local daemon, or udp://host:514 or tcp://host:514"},
 			&cli.StringFlag{Name: "dir-to-serve", Aliases: []string{"d"}, Value: ".", Usage: "Directory to serve files from"},
 			&cli.StringFlag{Name: "listen-ip", Value: "0.0.0.0", Usage: "IP address to listen on"},
 			&cli.IntFlag{Name: "listen-port", Value: 8080, Usage: "Port to listen on"},
+			&cli.StringFlag{Name: "tls-cert", Usage: "TLS certificate file (PEM); enables HTTPS together with --tls-key"},
+			&cli.StringFlag{Name: "tls-key", Usage: "TLS private key file (PEM); enables HTTPS together with --tls-cert"},
+			&cli.StringFlag{Name: "tls-min-version", Value: "1.2", Usage: "Minimum TLS version to accept (1.2, 1.3)"},
+			&cli.StringSliceFlag{Name: "acme-domain", Usage: "Obtain certificates from Let's Encrypt for this domain (repeatable); serves on :443 and :80"},
+			&cli.BoolFlag{Name: "show-hidden", Usage: "List, serve and accept dotfiles (.git, .env, ...), which are hidden and blocked by default"},
+			&cli.StringSliceFlag{Name: "include", Usage: "Only serve files matching this glob, e.g. \"*.iso\" (repeatable); patterns with a / match the path from the served directory"},
+			&cli.StringSliceFlag{Name: "exclude", Usage: "Never serve files or directories matching this glob (repeatable); wins over --include"},
+			&cli.StringSliceFlag{Name: "expose-xattrs", Usage: "List these user.* extended attributes of files in the JSON listing and let uploads set them, e.g. user.source,user.owner (Linux and macOS)"},
+			&cli.BoolFlag{Name: "follow-symlinks", Usage: "Serve symlinks that lead outside the served directory (logging their target), which are refused with 403 by default"},
+			&cli.BoolFlag{Name: "si", Usage: "Show file sizes in 1000-based units instead of 1024-based"},
+			&cli.BoolFlag{Name: "allow-inline-html", Usage: "Let ?inline=1 show HTML and SVG files in the browser (scripts in uploaded files then run in this server's origin)"},
+			&cli.BoolFlag{Name: "read-only", Usage: "Disable upload, delete and any other modification of the served directory"},
+			&cli.BoolFlag{Name: "upload-only", Usage: "Drop box mode: only allow uploads, no listing, download or delete"},
+			&cli.StringFlag{Name: "on-conflict", Value: conflictOverwrite, Usage: "What to do when an uploaded file already exists (overwrite, rename, reject); always rename with --upload-only"},
+			&cli.BoolFlag{Name: "trash", Usage: "Move deleted files to " + trashDirName + "/ in the served directory, from where /trash restores or purges them, instead of deleting them"},
+			&cli.BoolFlag{Name: "allow-dir-delete", Usage: "Allow deleting directories with everything in them, when the request also asks for it with recursive=1"},
+			&cli.StringFlag{Name: "dir-mode", Value: "0755", Usage: "Permissions of directories created by the server (octal, the umask still applies)"},
+			&cli.BoolFlag{Name: "mkdir-on-upload", Usage: "Create the target subdirectory of an upload if it does not exist"},
+			&cli.IntFlag{Name: "max-upload-files", Value: 1000, Usage: "Max files in one multipart upload request, answered with 413 beyond that (0 = unlimited)"},
+			&cli.StringFlag{Name: "min-free-space", Value: "500MB", Usage: "Refuse uploads with 507 that would leave less free disk space than this, e.g. 2GB (0 = no check)"},
+			&cli.StringFlag{Name: "quota", Usage: "Refuse uploads with 507 that would bring the served directory over this total size, e.g. 20GB (0 = unlimited)"},
+			&cli.IntFlag{Name: "max-concurrent-uploads", Usage: "Max uploads in progress at once, others wait up to --upload-queue-wait and then get 503 (0 = unlimited)"},
+			&cli.DurationFlag{Name: "upload-queue-wait", Value: 10 * time.Second, Usage: "How long an upload waits for a free slot of --max-concurrent-uploads"},
+			&cli.BoolFlag{Name: "allow-nested-upload", Usage: "Keep the relative paths of folder uploads, creating subdirectories as needed"},
+			&cli.BoolFlag{Name: "allow-shared-root", Usage: "Start even if another instance already serves the same directory"},
+			&cli.DurationFlag{Name: "partial-max-age", Value: 24 * time.Hour, Usage: "Remove leftover partial uploads older than this at startup"},
+			&cli.DurationFlag{Name: "read-header-timeout", Value: 10 * time.Second, Usage: "Max time to read request headers (0 = unlimited)"},
+			&cli.DurationFlag{Name: "idle-timeout", Value: 120 * time.Second, Usage: "Max time to keep an idle keep-alive connection open (0 = unlimited)"},
+			&cli.DurationFlag{Name: "write-timeout", Value: 0, Usage: "Max time to write a whole response, including long downloads (0 = unlimited)"},
+			&cli.StringFlag{Name: "max-bandwidth", Usage: "Limit all downloads together to this rate, e.g. 10MBps (bytes) or 80Mbps (bits), shared evenly (0 = unlimited)"},
+			&cli.StringFlag{Name: "rate-schedule", Usage: "Change the limit of all downloads together by the time of day, e.g. 09:00-18:00=2MBps,18:00-09:00=50MBps; --max-bandwidth applies outside of the rules"},
+			&cli.StringFlag{Name: "rate-schedule-tz", Usage: "Time zone of --rate-schedule, e.g. Europe/Paris (default: local time)"},
+			&cli.StringFlag{Name: "per-conn-bandwidth", Usage: "Limit each download to this rate, e.g. 2MBps; a request may ask for less with ?limit=500KBps (0 = unlimited)"},
+			&cli.BoolFlag{Name: "metrics", Usage: "Serve Prometheus metrics at /metrics, which needs authentication if enabled and is only answered to local clients otherwise"},
+			&cli.IntFlag{Name: "metrics-port", Usage: "Serve /metrics on this port only, to any client, instead of on the main port"},
+			&cli.StringFlag{Name: "access-log", Value: "console", Usage: "Where to log each request, apart from the application log (off, console, file:/path)"},
+			&cli.StringFlag{Name: "access-log-format", Value: "json", Usage: "Format of the access log: json, or common or combined (Apache) for tools like goaccess and awstats"},
+			&cli.StringFlag{Name: "debug-listen", Usage: "Serve net/http/pprof and expvar on this address only, e.g. 127.0.0.1:6060 (never on the main listener)"},
+			&cli.BoolFlag{Name: "low-memory", Usage: "For small devices: 4 KiB copy buffers, at most 2 concurrent uploads/downloads (others wait), no listing cache and more frequent garbage collection, trading throughput and CPU for a lower memory peak"},
+			&cli.Int64Flag{Name: "thumb-max-pixels", Value: 40_000_000, Usage: "Refuse thumbnails of images with more pixels than this, which would take too much memory to decode"},
+			&cli.Int64Flag{Name: "view-max-size", Value: 2 << 20, Usage: "Max bytes shown by /view/: bigger Markdown files are refused, bigger text files cut off"},
+			&cli.BoolFlag{Name: "progressive-listing", Usage: "For slow storage: show names at once and let the page fetch sizes and times afterwards (disables the listing cache)"},
+			&cli.BoolFlag{Name: "no-listing-cache", Usage: "Read directories from disk on every listing instead of caching them until they change"},
+			&cli.StringSliceFlag{Name: "cors-origin", Usage: "Allow cross-origin requests from this origin, e.g. https://app.example.com (repeatable, or \"*\" for any)"},
+			&cli.BoolFlag{Name: "cors-allow-credentials", Usage: "Let the origins of --cors-origin (not \"*\") send cookies and Authorization headers with cross-origin requests"},
+			&cli.DurationFlag{Name: "slow-read-threshold", Value: 5 * time.Second, Usage: "Log a warning when the first byte of a download takes longer than this to read from disk (0 = never)"},
+			&cli.DurationFlag{Name: "first-byte-deadline", Value: 0, Usage: "Answer 503 with Retry-After when the first byte of a download is not available within this time (0 = wait forever)"},
+			&cli.StringSliceFlag{Name: "allow-ip", Usage: "Only accept clients from this address or CIDR, e.g. 192.168.0.0/16 (repeatable; default: all)"},
+			&cli.StringSliceFlag{Name: "deny-ip", Usage: "Refuse clients from this address or CIDR with 403 (repeatable); wins over --allow-ip"},
+			&cli.StringSliceFlag{Name: "trusted-proxies", Usage: "Reverse proxies (addresses or CIDRs, repeatable) whose X-Forwarded-For, X-Real-IP and X-Forwarded-Proto are believed; ignored from other peers"},
+			&cli.StringFlag{Name: "auth-exec", Usage: "Require HTTP basic auth, checked by running this command with the username as last argument and the password on stdin (exit code 0 = allowed)"},
+			&cli.StringFlag{Name: "auth-url", Usage: "Require HTTP basic auth, checked by POSTing {\"username\", \"password\"} as JSON to this URL (2xx = allowed, 401/403 = denied)"},
+			&cli.DurationFlag{Name: "auth-cache-ttl", Value: time.Minute, Usage: "How long answers of --auth-exec/--auth-url are remembered (0 = ask every time)"},
+			&cli.DurationFlag{Name: "auth-timeout", Value: 5 * time.Second, Usage: "Max time to wait for --auth-exec/--auth-url, access is denied after it"},
+			&cli.StringFlag{Name: "acme-cache-dir", Value: "acme-cache", Usage: "Directory to cache ACME certificates and account key"},
+		},
+		Commands: []*cli.Command{
+			genCertCommand,
 		},
 		Before: func(c *cli.Context) error {
-			C = Config{
-				DirpathToServe: c.String("dir-to-serve"),
-				ListenIp:       c.String("listen-ip"),
-				ListenPort:     c.Int("listen-port"),
-				LogLevel:       c.String("log-level"),
+			C = configFromFlags(c)
+			if err := setupLogging(); err != nil {
+				return err
 			}
 
-			// Re-setup logging with the potentially new level.
-			setupLogging(C.LogLevel)
-
 			// Show user the effective config in use
-			log.Info("Current configuration:")
-			spew.Dump(C)
+			if !C.Quiet {
+				logConfig()
+			}
 
 			return nil
 		},
@@ -147,15 +409,116 @@ func main() {
 	}
 	app.UseShortOptionHandling = true
 	app.EnableBashCompletion = true
+	return app
+}
 
-	if err := app.Run(os.Args); err != nil {
-		log.Fatal(err)
+// configFromFlags returns the configuration given by the flags of c.
+func configFromFlags(c *cli.Context) Config {
+	config := Config{
+		DirpathToServe: c.String("dir-to-serve"),
+		ListenIp:       c.String("listen-ip"),
+		ListenPort:     c.Int("listen-port"),
+		LogLevel:       c.String("log-level"),
+		LogFile:        c.String("log-file"),
+		ConsoleLevel:   c.String("console-level"),
+		FileLevel:      c.String("file-level"),
+		Quiet:          c.Bool("quiet"),
+		NoColor:        c.Bool("no-color"),
+		LogMaxSize:     c.Int("log-max-size"),
+		LogMaxAge:      c.Int("log-max-age"),
+		LogMaxBackups:  c.Int("log-max-backups"),
+		LogCompress:    c.Bool("log-compress"),
+		LogSyslog:      c.String("log-syslog"),
+		TlsCertFile:    c.String("tls-cert"),
+		TlsKeyFile:     c.String("tls-key"),
+		TlsMinVersion:  c.String("tls-min-version"),
+		AcmeDomains:    c.StringSlice("acme-domain"),
+		AcmeCacheDir:   c.String("acme-cache-dir"),
+		ReadOnly:       c.Bool("read-only"),
+		UploadOnly:     c.Bool("upload-only"),
+		OnConflict:     c.String("on-conflict"),
+		DirMode:        c.String("dir-mode"),
+		MaxBandwidth:   c.String("max-bandwidth"),
+		RateSchedule:   c.String("rate-schedule"),
+		RateScheduleTZ: c.String("rate-schedule-tz"),
+		MinFreeSpace:   c.String("min-free-space"),
+		Quota:          c.String("quota"),
+		Metrics:        c.Bool("metrics") || c.Int("metrics-port") != 0,
+		MetricsPort:    c.Int("metrics-port"),
+		DebugListen:    c.String("debug-listen"),
+		AccessLog:      c.String("access-log"),
+		AccessLogFmt:   c.String("access-log-format"),
+		PartialMaxAge:  c.Duration("partial-max-age"),
+		MkdirOnUpload:  c.Bool("mkdir-on-upload"),
+		LowMemory:      c.Bool("low-memory"),
+		NoListingCache: c.Bool("no-listing-cache"),
+		MaxUploadFiles: c.Int("max-upload-files"),
+		ShowHidden:     c.Bool("show-hidden"),
+		SIUnits:        c.Bool("si"),
+		Includes:       c.StringSlice("include"),
+		Excludes:       c.StringSlice("exclude"),
+		ExposeXattrs:   c.StringSlice("expose-xattrs"),
+		CorsOrigins:    c.StringSlice("cors-origin"),
+		AllowIPs:       c.StringSlice("allow-ip"),
+		DenyIPs:        c.StringSlice("deny-ip"),
+		TrustedProxies: c.StringSlice("trusted-proxies"),
+		ThumbMaxPixels: c.Int64("thumb-max-pixels"),
+		ViewMaxSize:    c.Int64("view-max-size"),
+		AuthExec:       c.String("auth-exec"),
+		AuthURL:        c.String("auth-url"),
+		Trash:          c.Bool("trash"),
+		AllowDirDelete: c.Bool("allow-dir-delete"),
+		FollowSymlinks: c.Bool("follow-symlinks"),
+
+		PerConnBandwidth:   c.String("per-conn-bandwidth"),
+		SlowReadThreshold:  c.Duration("slow-read-threshold"),
+		UploadQueueWait:    c.Duration("upload-queue-wait"),
+		FirstByteDeadline:  c.Duration("first-byte-deadline"),
+		ProgressiveListing: c.Bool("progressive-listing"),
+		AuthCacheTTL:       c.Duration("auth-cache-ttl"),
+		AuthTimeout:        c.Duration("auth-timeout"),
+
+		AllowNestedUpload: c.Bool("allow-nested-upload"),
+		AllowSharedRoot:   c.Bool("allow-shared-root"),
+		AllowInlineHTML:   c.Bool("allow-inline-html"),
+
+		CorsAllowCredentials: c.Bool("cors-allow-credentials"),
+		MaxConcurrentUploads: c.Int("max-concurrent-uploads"),
+
+		ReadHeaderTimeout: c.Duration("read-header-timeout"),
+		IdleTimeout:       c.Duration("idle-timeout"),
+		WriteTimeout:      c.Duration("write-timeout"),
 	}
+	if config.UploadOnly && !c.IsSet("on-conflict") {
+		config.OnConflict = conflictRename // Submitters must not replace each other's files
+	}
+	if config.Quiet && !c.IsSet("access-log") {
+		config.AccessLog = "off" // Requests are logged at info level
+	}
+	return config
 }
 
 func startServer() error {
+	if err := configure(); err != nil {
+		return err
+	}
 	addr := fmt.Sprintf("%s:%d", C.ListenIp, C.ListenPort)
-	log.Infof("Starting server on %s", addr)
+	var tlsConfig *tls.Config
+	if len(C.AcmeDomains) == 0 {
+		var err error
+		tlsConfig, err = buildTLSConfig()
+		if err != nil {
+			return err
+		}
+		scheme := "http"
+		if tlsConfig != nil {
+			scheme = "https"
+		}
+		if tlsConfig == nil && authEnabled() {
+			log.Warnf("Basic auth without TLS: passwords are sent in clear text, use --tls-cert/--tls-key or --acme-domain")
+		}
+		log.Infof("Starting server on %s://%s", scheme, addr)
+	}
 	absPath, err := filepath.Abs(C.DirpathToServe)
 	if err != nil {
 		log.Errorf("Could not determine absolute path for %s: %v", C.DirpathToServe, err)
@@ -163,13 +526,173 @@ func startServer() error {
 		log.Infof("Serving files from: %s", absPath)
 	}
 
-	http.HandleFunc("/", listFilesHandler)
-	http.HandleFunc("/upload", uploadFileHandler)
-	http.HandleFunc("/delete", deleteFileHandler)
-	http.HandleFunc("/download/", downloadFileHandler) // Add a dedicated handler for downloads
-	http.Handle("/files/", http.StripPrefix("/files/", http.FileServer(http.Dir(C.DirpathToServe))))
+	if err := acquireInstanceLock(addr); err != nil {
+		return err
+	}
+	applyLowMemory()
+	applyUploadLimit()
+	startListingCache()
+	startRootProbe()
+	startRateSchedule()
+	cleanupPartialFiles(C.DirpathToServe, C.PartialMaxAge)
+
+	mux := newRoutes()
+	if err := startMetrics(mux); err != nil {
+		return err
+	}
+	if err := startDebugServer(); err != nil {
+		return err
+	}
+
+	server := newServer(addr, mux, tlsConfig)
+	if len(C.AcmeDomains) > 0 {
+		return serveACME(server)
+	}
+	if tlsConfig != nil {
+		// Certificates are already loaded into tlsConfig
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// configure checks and parses the flags of C that need it, failing on the
+// first invalid one.
+func configure() error {
+	if C.ReadOnly && C.UploadOnly {
+		return fmt.Errorf("--read-only and --upload-only cannot be used together")
+	}
+	if err := validateConflictPolicy(C.OnConflict); err != nil {
+		return err
+	}
+	if C.UploadOnly && C.OnConflict != conflictRename {
+		// Overwriting replaces the files of others, rejecting reveals their
+		// names. Renaming does too unless the stored name is kept to the
+		// server, see concealStoredNames
+		return fmt.Errorf("--upload-only only works with --on-conflict %s, not %s", conflictRename, C.OnConflict)
+	}
+	if err := validateServePatterns(); err != nil {
+		return err
+	}
+	if err := validateExposedXattrs(); err != nil {
+		return err
+	}
+	if err := validateAuth(); err != nil {
+		return err
+	}
+	if err := validateCors(); err != nil {
+		return err
+	}
+	if err := parseIPRules(); err != nil {
+		return err
+	}
+	var err error
+	if newDirMode, err = parseDirMode(C.DirMode); err != nil {
+		return err
+	}
+	maxBandwidth, err := parseBandwidth(C.MaxBandwidth)
+	if err != nil {
+		return fmt.Errorf("--max-bandwidth: %v", err)
+	}
+	if maxBandwidth > 0 {
+		downloadBucket = newTokenBucket(maxBandwidth)
+		log.Infof("Downloads are limited to %s (%d bytes/s) in total", C.MaxBandwidth, maxBandwidth)
+	}
+	bandwidthLimit.Set(float64(maxBandwidth))
+	if err := setupRateSchedule(maxBandwidth); err != nil {
+		return err
+	}
+	if minFreeSpace, err = parseSize(C.MinFreeSpace); err != nil {
+		return fmt.Errorf("--min-free-space: %v", err)
+	}
+	quotaLimit, err := parseSize(C.Quota)
+	if err != nil {
+		return fmt.Errorf("--quota: %v", err)
+	}
+	startQuota(quotaLimit)
+	currentTotals() // Start counting in the background for the first listing
+	if err := setupAccessLog(C.AccessLog, C.AccessLogFmt); err != nil {
+		return err
+	}
+	if perConnBandwidth, err = parseBandwidth(C.PerConnBandwidth); err != nil {
+		return fmt.Errorf("--per-conn-bandwidth: %v", err)
+	}
+	if perConnBandwidth > 0 {
+		log.Infof("Each download is limited to %s (%d bytes/s)", C.PerConnBandwidth, perConnBandwidth)
+	}
+	return nil
+}
+
+// newRoutes returns the routes of the server. They have a mux of their own:
+// net/http/pprof and expvar add theirs to http.DefaultServeMux, which must
+// never be served here.
+func newRoutes() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", listFilesHandler)
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/api/files", exposing(apiFilesHandler))
+	mux.HandleFunc("/api/files/meta", exposing(apiFilesMetaHandler))
+	mux.HandleFunc("/api/stats", exposing(apiStatsHandler))
+	mux.HandleFunc("/upload", mutating(uploading(transferring(uploadFileHandler))))
+	mux.HandleFunc("/create", mutating(exposing(createFileHandler)))
+	mux.HandleFunc("/mkdir", mutating(exposing(mkdirHandler)))
+	mux.HandleFunc("/api/mkdir", mutating(exposing(mkdirHandler)))
+	mux.HandleFunc("/rename", mutating(exposing(renameHandler)))
+	mux.HandleFunc("/api/rename", mutating(exposing(renameHandler)))
+	mux.HandleFunc("/move", mutating(exposing(moveHandler)))
+	mux.HandleFunc("/delete", mutating(exposing(deleteFileHandler)))
+	mux.HandleFunc("/trash", exposing(trashHandler))
+	mux.HandleFunc("/trash/restore", mutating(exposing(trashRestoreHandler)))
+	mux.HandleFunc("/trash/purge", mutating(exposing(trashPurgeHandler)))
+	mux.HandleFunc("/download/", exposing(transferring(downloadFileHandler))) // Add a dedicated handler for downloads
+	mux.HandleFunc("/files/", filesHandler)                                   // Same code path as /download/, plus PUT uploads
+	mux.HandleFunc("/thumb/", exposing(thumbHandler))
+	mux.HandleFunc("/view/", exposing(viewHandler))
+	mux.HandleFunc("/edit/", mutating(exposing(editHandler)))
+	mux.HandleFunc("/save/", mutating(exposing(saveHandler)))
+	return mux
+}
+
+// newServer returns the server of mux on addr, with every middleware and the
+// timeouts of C.
+func newServer(addr string, mux *http.ServeMux, tlsConfig *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:      addr,
+		Handler:   requestIDHandler(metricsHandler(mux, accessLogHandler(recoverHandler(ipFilterHandler(corsHandler(authHandler(rootGuard(mux)))))))),
+		TLSConfig: tlsConfig,
+
+		// Bounded header and idle timeouts protect against slowloris-style
+		// connection hoarding. WriteTimeout is unlimited by default since it
+		// covers the whole response and would cut off long downloads.
+		ReadHeaderTimeout: C.ReadHeaderTimeout,
+		IdleTimeout:       C.IdleTimeout,
+		WriteTimeout:      C.WriteTimeout,
+	}
+}
+
+// mutating guards every handler that modifies the served directory, so that
+// --read-only is enforced in one place for current and future endpoints.
+func mutating(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if C.ReadOnly {
+			loggerFrom(r.Context()).Warnf("Rejected %s %s: server is in read-only mode", r.Method, r.URL.Path)
+			http.Error(w, "Server is in read-only mode", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
 
-	return http.ListenAndServe(addr, nil)
+// exposing guards every handler that reveals or touches existing files, so
+// that --upload-only is enforced in one place for current and future endpoints.
+func exposing(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if C.UploadOnly {
+			loggerFrom(r.Context()).Warnf("Rejected %s %s: server is in upload-only mode", r.Method, r.URL.Path)
+			http.Error(w, "Server is in upload-only mode", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
 }
 
 func listFilesHandler(w http.ResponseWriter, r *http.Request) {
@@ -177,50 +700,174 @@ func listFilesHandler(w http.ResponseWriter, r *http.Request) {
 		http.NotFound(w, r)
 		return
 	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	if C.UploadOnly {
+		// Drop box mode: never read the directory, only show the upload form
+		renderIndex(w, r, indexView{})
+		return
+	}
 
-	dirEntries, err := os.ReadDir(C.DirpathToServe)
+	q, err := parseListingQuery(r.URL.Query())
 	if err != nil {
-		log.Errorf("Failed to read directory %s: %v", C.DirpathToServe, err)
-		http.Error(w, "Could not read directory", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if wantsPlainText(r) && !q.Paged {
+		q.PerPage = 0 // Scripts get the whole directory unless they ask for a page
+	}
+	if C.ProgressiveListing && !wantsPlainText(r) {
+		q.Fast = true // Sizes and times are filled in by the page itself
+	}
+
+	l, err := readListing(r.Context(), q)
+	if err != nil {
+		status, msg := listDirError(r.Context(), q.Dir, err)
+		if status == http.StatusServiceUnavailable {
+			writeMaintenance(w)
+			return
+		}
+		http.Error(w, msg, status)
+		return
+	}
+
+	if l.Pages > 0 && q.Page > l.Pages && !wantsPlainText(r) {
+		// E.g. after deleting the last files of the last page
+		http.Redirect(w, r, q.url(l.Pages, q.Sort), http.StatusFound)
+		return
+	}
+
+	if wantsPlainText(r) {
+		writePlainListing(w, l.Entries, r.URL.Query().Get("long") == "1")
 		return
 	}
 
 	var files []FileViewData
-	for _, entry := range dirEntries {
-		if !entry.IsDir() {
-			info, err := entry.Info()
-			if err != nil {
-				log.Warnf("Could not get file info for %s: %v", entry.Name(), err)
-				continue
-			}
+	for _, entry := range l.Entries {
+		if entry.IsDir {
 			files = append(files, FileViewData{
-				Name:    entry.Name(),
-				SizeMB:  fmt.Sprintf("%.2f MB", float64(info.Size())/(1024*1024)),
-				ModTime: info.ModTime().Format("2006-01-02 15:04:05"),
+				Name:    entry.Name,
+				Path:    entry.Path,
+				IsDir:   true,
+				Symlink: entry.Symlink,
 			})
+			continue
+		}
+		if l.Pending {
+			files = append(files, FileViewData{
+				Name:    entry.Name,
+				Path:    entry.Path,
+				Inline:  inlineAllowed(mime.TypeByExtension(path.Ext(entry.Name))),
+				Thumb:   hasThumbnail(entry.Name),
+				Preview: hasPreview(entry.Name),
+				Pending: true,
+				Symlink: entry.Symlink,
+			})
+			continue
 		}
+		files = append(files, FileViewData{
+			Name:    entry.Name,
+			Path:    entry.Path,
+			Size:    humanSize(entry.Size),
+			Bytes:   entry.Size,
+			Inline:  inlineAllowed(mime.TypeByExtension(path.Ext(entry.Name))),
+			Thumb:   hasThumbnail(entry.Name),
+			Preview: hasPreview(entry.Name),
+			Symlink: entry.Symlink,
+			ModTime: entry.ModTime.Format("2006-01-02 15:04:05"),
+		})
 	}
 
+	view := indexView{
+		Files:   files,
+		Columns: sortLinks(q),
+		Dir:     cleanRelPath(q.Dir),
+		Query:   q.Filter,
+		Matched: l.Total,
+		Total:   l.All,
+		Page:    l.Page,
+		Pages:   l.Pages,
+		Sort:    q.Sort,
+		State:   q.state(),
+		Flash:   takeFlash(w, r),
+	}
+	if l.Page > 1 {
+		view.PrevURL = q.url(l.Page-1, q.Sort)
+	}
+	if l.Page < l.Pages {
+		view.NextURL = q.url(l.Page+1, q.Sort)
+	}
+	renderIndex(w, r, view)
+}
+
+// indexView is the listing shown by the index page.
+type indexView struct {
+	Files   []FileViewData
+	Columns []sortLink
+	Dir     string // Directory being shown, relative to the served directory
+	Query   string // Filter from ?q=, if any
+	Matched int    // Number of entries matching the filter, on all pages
+	Total   int    // Number of entries before filtering
+	Page    int
+	Pages   int
+	PrevURL string
+	NextURL string
+	Sort    listingSort
+	State   template.URL // Query string of this view, see returnURL
+	Flash   string       // Outcome of the last action, see setFlash
+}
+
+// renderIndex renders the index page for the given listing.
+func renderIndex(w http.ResponseWriter, r *http.Request, view indexView) {
 	data := struct {
-		Files []FileViewData
+		indexView
+		ParentDir      string
+		ReadOnly       bool
+		Trash          bool
+		AllowDirDelete bool
+		UploadOnly     bool
+		NestedUpload   bool
+		FreeSpace      string
+		QuotaUsage     string
+		Footer         string
 	}{
-		Files: files,
+		indexView:      view,
+		ReadOnly:       C.ReadOnly,
+		Trash:          C.Trash,
+		AllowDirDelete: C.AllowDirDelete,
+		UploadOnly:     C.UploadOnly,
+		NestedUpload:   C.AllowNestedUpload,
+	}
+	if view.Dir != "" {
+		data.ParentDir = strings.TrimPrefix(path.Dir("/"+view.Dir), "/")
+	}
+	if free, err := freeSpace(C.DirpathToServe); err == nil && !C.ReadOnly {
+		data.FreeSpace = humanSize(free)
+	}
+	data.Footer = footerLine()
+	if used, limit, ok := quotaUsage(); ok && !C.ReadOnly {
+		data.QuotaUsage = fmt.Sprintf("%s of %s used", humanSize(used), humanSize(limit))
 	}
 
 	tmpl, err := template.New("index").Parse(indexHTML)
 	if err != nil {
-		log.Errorf("Failed to parse template: %v", err)
+		loggerFrom(r.Context()).Errorf("Failed to parse template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 		return
 	}
+	// The page is streamed without buffering it first, so a failure may
+	// leave it cut off: mark that in the output rather than hiding it
 	if err := tmpl.Execute(w, data); err != nil {
-		log.Errorf("Failed to execute template: %v", err)
+		loggerFrom(r.Context()).Errorf("Failed to execute template: %v", err)
+		fmt.Fprint(w, "\n<!-- page incomplete: rendering failed -->\n")
 	}
 }
 
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
 		return
 	}
 
@@ -230,156 +877,548 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	// Get a multipart reader to process files as streams
 	mr, err := r.MultipartReader()
 	if err != nil {
-		log.Errorf("Failed to get multipart reader: %v", err)
-		http.Error(w, "Could not process upload", http.StatusInternalServerError)
+		logger.Warnf("Rejected upload that is not a multipart form: %v", err)
+		http.Error(w, "Could not process upload: expected a multipart form", http.StatusBadRequest)
+		return
+	}
+
+	// Target subdirectory, from ?dir= or a "dir" form field sent before the files
+	relDir := r.URL.Query().Get("dir")
+	uploadDir, err := resolveUploadDir(r.Context(), relDir)
+	if err != nil {
+		logger.Warnf("Rejected upload to directory %q: %v", r.URL.Query().Get("dir"), err)
+		refuseUpload(w, fmt.Sprintf("Invalid upload directory: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Extended attributes of every file, to which xattr.* fields add
+	allXattrs, err := headerXattrs(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
 	filesUploaded := 0
+	var results []uploadResult
+	// Options for the next file part, from "sha256", "resolution" and
+	// xattr.* fields sent before it
+	opts := uploadOptions{policy: C.OnConflict, xattrs: maps.Clone(allXattrs)}
 
-	// Process each part (file) in the multipart form
+	// Process each part (file) in the multipart form. A failing part is
+	// reported in the results and does not abort the others.
 	for {
 		part, err := mr.NextPart()
 		if err == io.EOF {
 			break // No more parts
 		}
 		if err != nil {
-			log.Errorf("Error reading next part: %v", err)
-			http.Error(w, "Error processing upload", http.StatusInternalServerError)
+			// Malformed part headers, or the client went away
+			logger.Warnf("Error reading next part: %v", err)
+			http.Error(w, "Malformed upload", http.StatusBadRequest)
 			return
 		}
 
-		// Skip non-file parts
+		// Non-file parts: only "dir", "sha256", "resolution" and xattr.* are used, everything else is skipped
 		if part.FileName() == "" {
+			if key, ok := strings.CutPrefix(part.FormName(), xattrFieldPrefix); ok {
+				value, err := io.ReadAll(io.LimitReader(part, maxXattrSize+1))
+				if err != nil {
+					logger.Errorf("Error reading %s field: %v", part.FormName(), err)
+					http.Error(w, "Error processing upload", http.StatusInternalServerError)
+					return
+				}
+				if err := setUploadXattr(opts.xattrs, key, string(value)); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if part.FormName() == "sha256" {
+				value, err := io.ReadAll(io.LimitReader(part, 256))
+				if err != nil {
+					logger.Errorf("Error reading sha256 field: %v", err)
+					http.Error(w, "Error processing upload", http.StatusInternalServerError)
+					return
+				}
+				opts.expectedSum, err = parseSHA256(string(value))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			if part.FormName() == "resolution" {
+				value, err := io.ReadAll(io.LimitReader(part, 256))
+				if err != nil {
+					logger.Errorf("Error reading resolution field: %v", err)
+					http.Error(w, "Error processing upload", http.StatusInternalServerError)
+					return
+				}
+				opts.policy, err = parseResolution(string(value))
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if C.UploadOnly && opts.policy != conflictRename {
+					logger.Warnf("Rejected resolution %q in upload-only mode", value)
+					http.Error(w, "Only the rename resolution is allowed in upload-only mode", http.StatusForbidden)
+					return
+				}
+			}
+			if part.FormName() == "dir" {
+				value, err := io.ReadAll(io.LimitReader(part, 4096))
+				if err != nil {
+					logger.Errorf("Error reading dir field: %v", err)
+					http.Error(w, "Error processing upload", http.StatusInternalServerError)
+					return
+				}
+				relDir = string(value)
+				uploadDir, err = resolveUploadDir(r.Context(), relDir)
+				if err != nil {
+					logger.Warnf("Rejected upload to directory %q: %v", value, err)
+					refuseUpload(w, fmt.Sprintf("Invalid upload directory: %v", err), http.StatusBadRequest)
+					return
+				}
+			}
 			continue
 		}
 
-		// Get the filename from the part
-		filename := filepath.Base(part.FileName())
-		fileSize := int64(0) // Will track the file size
-
-		log.Infof("Starting upload of file: %s", filename)
-
-		// Create the destination file
-		dstPath := filepath.Join(C.DirpathToServe, filename)
-		dst, err := os.Create(dstPath)
-		if err != nil {
-			log.Errorf("Could not create file %s on server: %v", dstPath, err)
-			http.Error(w, "Could not create file on server", http.StatusInternalServerError)
+		if C.MaxUploadFiles > 0 && len(results) >= C.MaxUploadFiles {
+			logger.Warnf("Rejected upload with more than %d files (%d stored)", C.MaxUploadFiles, filesUploaded)
+			http.Error(w, fmt.Sprintf("Too many files in one upload: at most %d per request are accepted, %d were stored. "+
+				"Upload an archive (e.g. .zip or .tar) instead, or split the upload.", C.MaxUploadFiles, filesUploaded),
+				http.StatusRequestEntityTooLarge)
 			return
 		}
+		if opts.policy != C.OnConflict {
+			logger.Debugf("Client chose conflict policy %s for %s", opts.policy, part.FileName())
+		}
+		result := storeUploadPart(r.Context(), part, cleanRelPath(relDir), uploadDir, opts)
+		opts = uploadOptions{policy: C.OnConflict, xattrs: maps.Clone(allXattrs)}
+		if result.StoredName != "" {
+			result.StoredName = path.Join(cleanRelPath(relDir), result.StoredName)
+			filesUploaded++
+		}
+		results = append(results, result)
+	}
 
-		// Copy from the part directly to the file on disk
-		fileSize, err = io.Copy(dst, part)
-		dst.Close() // Close file immediately after copying
+	logger.Infof("Successfully uploaded %d of %d files", filesUploaded, len(results))
+	concealStoredNames(results)
 
-		if err != nil {
-			log.Errorf("Could not save file %s: %v", dstPath, err)
-			// Try to remove the potentially partial file
-			os.Remove(dstPath)
-			http.Error(w, "Could not save file", http.StatusInternalServerError)
-			return
+	status := uploadStatus(results)
+	if wantsJSON(r) || (status != http.StatusOK && r.Header.Get("HX-Request") != "") {
+		// The web UI turns failed uploads (e.g. conflicts) into a dialog
+		writeJSON(w, r, status, results)
+		return
+	}
+	if status != http.StatusOK {
+		var msg []string
+		for _, result := range results {
+			if result.Error != "" {
+				msg = append(msg, fmt.Sprintf("Not stored: %s (%s)", result.OriginalName, result.Error))
+			} else if C.UploadOnly {
+				msg = append(msg, fmt.Sprintf("Stored: %s (sha256 %s)", result.OriginalName, result.SHA256))
+			} else {
+				msg = append(msg, fmt.Sprintf("Stored: /%s (sha256 %s)", result.StoredName, result.SHA256))
+			}
 		}
-
-		log.Infof("Completed upload of file: %s (size: %d bytes)", filename, fileSize)
-		filesUploaded++
+		http.Error(w, strings.Join(msg, "\n"), status)
+		return
+	}
+	for _, result := range results {
+		if result.StoredName != "" {
+			w.Header().Add("X-Stored-Filename", url.PathEscape(result.StoredName))
+		}
+		w.Header().Add("X-Stored-Sha256", result.SHA256)
 	}
-
-	log.Infof("Successfully uploaded %d files", filesUploaded)
 
 	w.Header().Set("HX-Refresh", "true")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+	http.Redirect(w, r, returnURL(r, cleanRelPath(relDir)), http.StatusSeeOther)
 }
 
+// deleteFileHandler handles the delete form post: every name of "files" is
+// checked and deleted on its own, and gets its own result, so that names
+// that cannot be deleted are reported rather than skipped silently. The
+// overall status follows uploadStatus; JSON clients get the results, the web
+// UI a summary on the reloaded page.
 func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
 		return
 	}
 
 	if err := r.ParseForm(); err != nil {
-		log.Errorf("Could not parse form for delete: %v", err)
+		logger.Errorf("Could not parse form for delete: %v", err)
 		http.Error(w, "Could not parse form", http.StatusBadRequest)
 		return
 	}
 
-	filesToDelete := r.Form["files"]
-	for _, filename := range filesToDelete {
-		// Basic security check to prevent path traversal
-		if strings.Contains(filename, "..") {
-			log.Warnf("Attempted path traversal on delete: %s", filename)
-			continue
+	var results []fileResult
+	var trash trashBatch
+	recursive := r.Form.Get("recursive") == "1"
+	for _, value := range r.Form["files"] {
+		result := deleteOne(r.Context(), value, &trash, recursive)
+		if result.Error != "" {
+			logger.Warnf("Could not delete %s: %s", result.Name, result.Error)
 		}
-		filePath := filepath.Join(C.DirpathToServe, filename)
-		log.Infof("Deleting file: %s", filePath)
-		if err := os.Remove(filePath); err != nil {
-			log.Errorf("Failed to delete file %s: %v", filePath, err)
-			// Continue to next file, don't stop the whole process
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		http.Error(w, "No files selected", http.StatusBadRequest)
+		return
+	}
+
+	status := fileStatus(results)
+	if wantsJSON(r) {
+		writeJSON(w, r, status, results)
+		return
+	}
+	if r.Header.Get("HX-Request") != "" {
+		// The page reloads and shows the summary, whatever the status
+		setFlash(w, deleteSummary(results))
+		w.Header().Set("HX-Refresh", "true")
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
 		}
+	} else if status != http.StatusOK {
+		var msg []string
+		for _, result := range results {
+			if result.Error != "" {
+				msg = append(msg, fmt.Sprintf("Not deleted: %s (%s)", result.Name, result.Error))
+			} else {
+				msg = append(msg, fmt.Sprintf("Deleted: %s", result.Name))
+			}
+		}
+		http.Error(w, strings.Join(msg, "\n"), status)
+		return
 	}
+	http.Redirect(w, r, returnURL(r, cleanRelPath(r.URL.Query().Get("dir"))), http.StatusSeeOther)
+}
 
-	w.Header().Set("HX-Refresh", "true")
-	http.Redirect(w, r, "/", http.StatusSeeOther)
+// deleteOne deletes the file or directory named by the form value, or moves
+// it to the trash with --trash. See dirDeleteCheck for directories.
+func deleteOne(ctx context.Context, value string, trash *trashBatch, recursive bool) fileResult {
+	logger := loggerFrom(ctx)
+	filename, err := decodeFormPath(value)
+	if err != nil {
+		return fileResult{Name: value, Status: http.StatusBadRequest, Error: "invalid name"}
+	}
+	filePath, err := resolvePath(ctx, filename)
+	if errors.Is(err, errSymlinkOutside) {
+		return fileResult{Name: filename, Status: http.StatusForbidden, Error: "symlink leads outside the served directory"}
+	}
+	if err != nil {
+		logger.Warnf("Attempted path traversal on delete: %s", filename)
+		return fileResult{Name: filename, Status: http.StatusBadRequest, Error: "invalid path"}
+	}
+	// Hidden and excluded files are not found, as in the listing. Symlinks
+	// to directories are files here, removed as links.
+	info, err := os.Lstat(filePath)
+	if err != nil || cleanRelPath(filename) == "" {
+		return fileResult{Name: filename, Status: http.StatusNotFound, Error: "not found"}
+	}
+	if info.IsDir() && !isServableDir(filename) || !info.IsDir() && !isServable(filename) {
+		logger.Warnf("Refused to delete hidden or excluded file: %s", filename)
+		return fileResult{Name: filename, Status: http.StatusNotFound, Error: "not found"}
+	}
+	entries := 0
+	if info.IsDir() {
+		var status int
+		var reason string
+		if entries, status, reason = dirDeleteCheck(filePath, recursive); status != 0 {
+			return fileResult{Name: filename, Entries: entries, Status: status, Error: reason}
+		}
+		logger.Infof("Deleting directory %s with %d entries", filePath, entries)
+	} else {
+		logger.Infof("Deleting file: %s", filePath)
+	}
+	err = trash.remove(ctx, filename, filePath, info, entries > 0)
+	switch {
+	case err == nil:
+		invalidateListing(filepath.Dir(filePath))
+		invalidateListing(filePath)
+		return fileResult{Name: filename, Entries: entries, Status: http.StatusOK}
+	case os.IsPermission(err):
+		return fileResult{Name: filename, Status: http.StatusForbidden, Error: "permission denied"}
+	default:
+		logger.Errorf("Failed to delete file %s: %v", filePath, err)
+		return fileResult{Name: filename, Status: http.StatusInternalServerError, Error: "could not delete"}
+	}
+}
+
+// dirDeleteCheck decides whether the directory at dirPath may be deleted:
+// empty directories always, others only with recursive and
+// --allow-dir-delete. It returns the number of entries below dirPath, and the
+// status and reason of the refusal if it may not be deleted.
+func dirDeleteCheck(dirPath string, recursive bool) (entries, status int, reason string) {
+	entries = countEntries(dirPath)
+	switch {
+	case entries == 0:
+		return 0, 0, ""
+	case !recursive:
+		return entries, http.StatusConflict, "directory not empty"
+	case !C.AllowDirDelete:
+		return entries, http.StatusForbidden, "deleting directories with their contents is disabled"
+	}
+	return entries, 0, ""
+}
+
+// countEntries returns the number of files and directories below dirPath,
+// without following symlinks.
+func countEntries(dirPath string) int {
+	count := -1 // dirPath itself
+	filepath.WalkDir(dirPath, func(_ string, _ fs.DirEntry, err error) error {
+		if err == nil {
+			count++
+		}
+		return nil
+	})
+	return max(count, 0)
+}
+
+// deleteSummary sums up the results of a delete request for the web UI,
+// e.g. "4 deleted, 1 failed: foo.txt (permission denied)".
+func deleteSummary(results []fileResult) string {
+	deleted := 0
+	var failed []string
+	for _, result := range results {
+		if result.Error == "" {
+			deleted++
+		} else {
+			failed = append(failed, fmt.Sprintf("%s (%s)", result.Name, result.Error))
+		}
+	}
+	verb := "deleted"
+	if C.Trash {
+		verb = "moved to the trash"
+	}
+	summary := fmt.Sprintf("%d %s", deleted, verb)
+	if len(failed) > 0 {
+		summary += fmt.Sprintf(", %d failed: %s", len(failed), strings.Join(failed, ", "))
+	}
+	return summary
+}
+
+// deleteSingleFileHandler removes the file at /files/<path>, for clients like
+// "curl -X DELETE http://host/files/file".
+func deleteSingleFileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	relPath := strings.TrimPrefix(r.URL.Path, "/files/")
+	filePath, err := resolvePath(r.Context(), relPath)
+	if err != nil || cleanRelPath(relPath) == "" {
+		logger.Warnf("Rejected DELETE of invalid path %s from %s", relPath, clientAddr(r))
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+
+	info, err := os.Lstat(filePath)
+	if os.IsNotExist(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		logger.Errorf("Error accessing file %s: %v", filePath, err)
+		http.Error(w, "Error accessing file", http.StatusInternalServerError)
+		return
+	}
+	// Hidden and excluded files are not found, as in deleteOne
+	if info.IsDir() && !isServableDir(relPath) || !info.IsDir() && !isServable(relPath) {
+		logger.Warnf("Refused to delete hidden or excluded file: %s", relPath)
+		http.NotFound(w, r)
+		return
+	}
+
+	entries := 0
+	if info.IsDir() {
+		var status int
+		var reason string
+		if entries, status, reason = dirDeleteCheck(filePath, r.URL.Query().Get("recursive") == "1"); status != 0 {
+			logger.Warnf("Refused to delete directory %s with %d entries: %s", filePath, entries, reason)
+			http.Error(w, fmt.Sprintf("Cannot delete a directory with %d entries: %s", entries, reason), status)
+			return
+		}
+	}
+
+	logger.Infof("Deleting file %s as requested by %s", filePath, clientAddr(r))
+	var trash trashBatch
+	if err := trash.remove(r.Context(), relPath, filePath, info, entries > 0); err != nil {
+		logger.Errorf("Failed to delete file %s: %v", filePath, err)
+		http.Error(w, "Could not delete file", http.StatusInternalServerError)
+		return
+	}
+	invalidateListing(filepath.Dir(filePath))
+	invalidateListing(filePath)
+	w.WriteHeader(http.StatusNoContent)
 }
 
 // downloadFileHandler handles direct file downloads with proper headers for filenames with spaces
 func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	serveFile(w, r, strings.TrimPrefix(r.URL.Path, "/download/"))
+}
+
+// filesHandler serves the /files/ route, dispatching by method: PUT uploads
+// a file, DELETE removes it, GET and HEAD download it. Downloads are a thin wrapper over
+// serveFile so that both download URLs share the same headers and checks.
+func filesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPut:
+		mutating(uploading(transferring(putFileHandler)))(w, r)
+	case http.MethodDelete:
+		mutating(exposing(deleteSingleFileHandler))(w, r)
+	case http.MethodGet, http.MethodHead:
+		exposing(transferring(func(w http.ResponseWriter, r *http.Request) {
+			serveFile(w, r, strings.TrimPrefix(r.URL.Path, "/files/"))
+		}))(w, r)
+	default:
+		allowMethods(w, r, routeMethods(r.URL.Path)...)
+	}
+}
+
+// putFileHandler stores the request body at /files/<path>, for clients like
+// "curl -T file http://host/files/file". It answers 201 with the absolute
+// URL of the file in Location when a file was created and 204 when an existing one was replaced.
+// Upload-only mode leaves out Location and answers failures that depend on
+// existing files alike, see uploadRefused.
+func putFileHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	relPath := strings.TrimPrefix(r.URL.Path, "/files/")
+	targetPath, err := resolvePath(r.Context(), relPath)
+	if err != nil || cleanRelPath(relPath) == "" || strings.HasSuffix(relPath, "/") {
+		logger.Warnf("Rejected PUT to invalid path: %s", relPath)
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	relPath = cleanRelPath(relPath)
+	if !isServable(relPath) {
+		logger.Warnf("Rejected PUT of hidden or excluded file: %s", relPath)
+		http.Error(w, "Hidden or excluded files are not accepted", http.StatusForbidden)
 		return
 	}
 
-	// Extract the filename from the URL path
-	filename := strings.TrimPrefix(r.URL.Path, "/download/")
+	opts := uploadOptions{policy: C.OnConflict}
+	if opts.xattrs, err = headerXattrs(r); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if value := r.Header.Get("X-Content-SHA256"); value != "" {
+		opts.expectedSum, err = parseSHA256(value)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	// Basic security check to prevent path traversal
-	if strings.Contains(filename, "..") {
-		log.Warnf("Attempted path traversal: %s", filename)
-		http.Error(w, "Invalid file path", http.StatusBadRequest)
+	dir := filepath.Dir(targetPath)
+	if info, err := os.Stat(dir); os.IsNotExist(err) && !C.MkdirOnUpload {
+		refuseUpload(w, "Parent directory does not exist", http.StatusNotFound)
+		return
+	} else if err == nil && !info.IsDir() {
+		refuseUpload(w, "Parent path is not a directory", http.StatusConflict)
 		return
 	}
+	if _, err := resolveUploadDir(r.Context(), path.Dir(relPath)); err != nil {
+		logger.Errorf("Could not prepare directory for %s: %v", relPath, err)
+		refuseUpload(w, "Could not create directory on server", http.StatusInternalServerError)
+		return
+	}
+
+	_, err = os.Lstat(targetPath)
+	existed := err == nil
 
-	// Construct the file path
-	filePath := filepath.Join(C.DirpathToServe, filename)
+	result := storeUploadStream(r.Context(), r.Body, relPath, dir, filepath.Base(targetPath), opts)
+	if result.Error != "" {
+		http.Error(w, result.Error, result.status)
+		return
+	}
+	storedPath := path.Join(path.Dir(relPath), result.StoredName)
+	w.Header().Set("X-Stored-Sha256", result.SHA256)
+	if existed && storedPath == relPath {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// In upload-only mode the stored name is not told, see concealStoredNames
+	if !C.UploadOnly {
+		w.Header().Set("Location", absoluteURL(r, "/files/"+storedPath))
+	}
+	w.WriteHeader(http.StatusCreated)
+}
 
-	// Check if the file exists
-	fileInfo, err := os.Stat(filePath)
+// serveFile is the single code path used to send a file from the served
+// directory to the client, whatever route the request came in on.
+func serveFile(w http.ResponseWriter, r *http.Request, filename string) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+
+	body, err := throttle(w, r)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid limit: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	filePath, err := resolvePath(r.Context(), filename)
+	if errors.Is(err, errSymlinkOutside) {
+		logger.Warnf("Refused to serve %s: symlink leads outside the served directory", filename)
+		http.Error(w, "Symlink leads outside the served directory", http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.Warnf("Attempted path traversal: %s", filename)
+		http.Error(w, "Invalid file path", http.StatusBadRequest)
+		return
+	}
+	if !isServable(filename) {
+		logger.Warnf("Refused to serve hidden or excluded file: %s", filename)
+		http.NotFound(w, r)
+		return
+	}
+
+	// Open the file, waiting for its first byte
+	file, fileInfo, err := openForServing(r.Context(), filePath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Warnf("File not found: %s", filePath)
+		switch {
+		case os.IsNotExist(err):
+			logger.Warnf("File not found: %s", filePath)
 			http.NotFound(w, r)
-		} else {
-			log.Errorf("Error accessing file %s: %v", filePath, err)
-			http.Error(w, "Error accessing file", http.StatusInternalServerError)
+		case errors.Is(err, errFirstByteDeadline):
+			w.Header().Set("Retry-After", "30")
+			http.Error(w, "Storage is too slow to respond, try again later", http.StatusServiceUnavailable)
+		default:
+			logger.Errorf("Error opening file %s: %v", filePath, err)
+			http.Error(w, "Error opening file", http.StatusInternalServerError)
 		}
 		return
 	}
+	defer file.Close()
 
 	// Check if it's actually a file
 	if fileInfo.IsDir() {
-		log.Warnf("Requested path is a directory: %s", filePath)
+		logger.Warnf("Requested path is a directory: %s", filePath)
 		http.Error(w, "Cannot download a directory", http.StatusBadRequest)
 		return
 	}
 
-	// Open the file
-	file, err := os.Open(filePath)
-	if err != nil {
-		log.Errorf("Error opening file %s: %v", filePath, err)
-		http.Error(w, "Error opening file", http.StatusInternalServerError)
-		return
-	}
-	defer file.Close()
+	logger.Infof("Serving file: %s (size: %d bytes)", filePath, fileInfo.Size())
 
-	// Set the content disposition header to handle files with spaces properly
-	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	// Files are downloaded unless ?inline=1 asks to view them and their
+	// type is safe to show in the browser
+	ctype := detectContentType(file, fileInfo.Name())
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "1" && inlineAllowed(ctype) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, filepath.Base(filename)))
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	// Stream the file to the response
-	_, err = io.Copy(w, file)
-	if err != nil {
-		log.Errorf("Error streaming file %s: %v", filePath, err)
+	// ServeContent takes care of Content-Length, HEAD and Range requests
+	counted := &countingWriter{ResponseWriter: body}
+	activeTransfers.WithLabelValues(directionDownload).Inc()
+	defer activeTransfers.WithLabelValues(directionDownload).Dec()
+	http.ServeContent(counted, r, fileInfo.Name(), fileInfo.ModTime(), file)
+	if counted.n > 0 {
+		countTransfer(directionDownload, counted.n)
+		bytesServed.Add(counted.n)
 	}
 }
 
@@ -395,8 +1434,17 @@ const indexHTML = `
         .file-list { list-style-type: none; padding: 0; }
         .file-item { display: flex; align-items: center; margin-bottom: 5px; }
         .file-item input { margin-right: 10px; }
+        .file-item .thumb { max-width: 64px; max-height: 64px; margin-right: 10px; }
+        .file-item .rename-button { margin-left: 0.5em; font-size: 0.8em; }
         .file-item a { flex-grow: 1; }
         .actions { margin-top: 20px; }
+        .symlink { color: #888; }
+        .free-space { color: #555; margin-top: 0; }
+        .footer { color: #888; font-size: 0.9em; margin-top: 20px; }
+        .flash { background: #fff8e1; border: 1px solid #e0c97f; padding: 0.5em 1em; margin-bottom: 1em; }
+        .search-form { margin-bottom: 10px; }
+        .pager { margin-top: 10px; color: #555; }
+        .sort-links { margin-bottom: 10px; color: #555; }
         .upload-form { margin-top: 20px; border-top: 1px solid #ccc; padding-top: 20px; }
         progress { width: 100%; }
         .download-link { color: #0066cc; text-decoration: underline; cursor: pointer; }
@@ -425,6 +1473,8 @@ const indexHTML = `
             animation: fadeOut 3s forwards;
             animation-delay: 2s;
         }
+        .conflict-dialog table { border-collapse: collapse; margin: 10px 0; }
+        .conflict-dialog td { padding: 4px 8px; }
         @keyframes fadeOut {
             from { opacity: 1; }
             to { opacity: 0; }
@@ -433,45 +1483,132 @@ const indexHTML = `
 </head>
 <body>
     <div class="container">
-        <h1>Files</h1>
+        {{if .UploadOnly}}
+        <h1>Submit Files</h1>
+        {{else}}
+        <h1>Files{{if .Dir}} in /{{.Dir}}{{end}}</h1>
+        {{if .Flash}}<div class="flash">{{.Flash}}</div>{{end}}
+        <form method="get" action="/" class="search-form">
+            {{if .Dir}}<input type="hidden" name="dir" value="{{.Dir}}">{{end}}
+            {{if ne .Sort.By "name"}}<input type="hidden" name="sort" value="{{.Sort.By}}">{{end}}
+            {{if .Sort.Desc}}<input type="hidden" name="order" value="desc">{{end}}
+            <input type="search" name="q" value="{{.Query}}" placeholder="Filter by name, or a pattern like *.log">
+            <button type="submit">Filter</button>
+            {{if .Query}}<span>{{.Matched}} of {{.Total}} files</span> <a href="/?dir={{.Dir}}">Clear</a>{{end}}
+        </form>
         <form>
+            <div class="sort-links">Sort by:{{range .Columns}} <a href="{{.URL}}">{{.Label}}{{if .Arrow}} {{.Arrow}}{{end}}</a>{{end}}</div>
             <ul class="file-list">
+                {{if .Dir}}
+                <li class="file-item"><a href="/?dir={{.ParentDir}}">.. (parent directory)</a></li>
+                {{end}}
                 {{range .Files}}
                 <li class="file-item">
-                    <input type="checkbox" name="files" value="{{.Name}}">
-                    <a href="/download/{{.Name}}" class="download-link" hx-boost="false" onclick="showDownloadStarted('{{.Name}}')">{{.Name}}</a>
-                    <span style="padding-left: 1em; color: #555; white-space: nowrap;">{{.SizeMB}} &nbsp; {{.ModTime}}</span>
+                    {{if .IsDir}}
+                    <a href="/?dir={{.Path}}">{{.Name}}/</a>{{if .Symlink}} <span class="symlink" title="symbolic link">&#8599;</span>{{end}}
+                    {{if not $.ReadOnly}}<button type="button" class="rename-button" onclick="renameFile('{{.Path}}')">rename</button>
+                    <button type="button" class="rename-button" onclick="deleteDir('{{.Path}}', '{{.FormValue}}')">delete</button>{{end}}
+                    {{else}}
+                    {{if not $.ReadOnly}}<input type="checkbox" name="files" value="{{.FormValue}}">{{end}}
+                    {{if .Thumb}}<img class="thumb" src="/thumb/{{.Path}}?w=64" alt="" loading="lazy" onerror="this.remove()">{{end}}
+                    <a href="/download/{{.Path}}" class="download-link" hx-boost="false" onclick="showDownloadStarted('{{.Name}}')">{{.Name}}</a>{{if .Symlink}} <span class="symlink" title="symbolic link">&#8599;</span>{{end}}
+                    {{if .Inline}}<a href="/download/{{.Path}}?inline=1" target="_blank" hx-boost="false" style="padding-left: 0.5em;">view</a>{{end}}
+                    {{if .Preview}}<a href="/view/{{.Path}}?{{$.State}}" target="_blank" hx-boost="false" style="padding-left: 0.5em;">preview</a>{{end}}
+                    {{if and .Preview (not $.ReadOnly)}}<a href="/edit/{{.Path}}?{{$.State}}" hx-boost="false" style="padding-left: 0.5em;">edit</a>{{end}}
+                    {{if not $.ReadOnly}}<button type="button" class="rename-button" onclick="renameFile('{{.Path}}')">rename</button>{{end}}
+                    <span style="padding-left: 1em; color: #555; white-space: nowrap;">{{if .Pending}}<span class="pending-meta" data-name="{{.Name}}">&hellip;</span>{{else}}<span title="{{.Bytes}} bytes">{{.Size}}</span> &nbsp; {{.ModTime}}{{end}}</span>
+                    {{end}}
                 </li>
                 {{else}}
                 <li>No files found.</li>
                 {{end}}
             </ul>
+            {{if gt .Pages 1}}
+            <div class="pager">
+                {{if .PrevURL}}<a href="{{.PrevURL}}">&laquo; Previous</a>{{end}}
+                Page {{.Page}} of {{.Pages}} ({{.Matched}} entries)
+                {{if .NextURL}}<a href="{{.NextURL}}">Next &raquo;</a>{{end}}
+            </div>
+            {{end}}
+            {{if not .ReadOnly}}
             <div class="actions">
-                <button type="button" hx-post="/delete" hx-target="body" hx-include="[name='files']:checked" hx-confirm="Are you sure you want to delete the selected files?">Delete Selected</button>
+                <button type="button" hx-post="/delete?{{.State}}" hx-target="body" hx-include="[name='files']:checked" hx-confirm="{{if .Trash}}Move the selected files to the trash?{{else}}Are you sure you want to delete the selected files?{{end}}">Delete Selected</button>
+                <button type="button" hx-post="/move?{{.State}}" hx-target="body" hx-include="[name='files']:checked" hx-prompt="Move the selected files to which directory? (path from the top, empty for the top)">Move Selected</button>
+                {{if .Trash}}<a href="/trash" hx-boost="false">Trash</a>{{end}}
                 <!-- Bulk download is complex to implement robustly and is omitted for simplicity -->
             </div>
+            {{end}}
         </form>
+        {{end}}
 
+        {{if not .ReadOnly}}
         <div class="upload-form">
             <h2>Upload Files</h2>
-            <form hx-encoding="multipart/form-data" hx-post="/upload" hx-target="body">
+            {{if .FreeSpace}}<p class="free-space">{{.FreeSpace}} free on the server</p>{{end}}
+            {{if .QuotaUsage}}<p class="free-space">Quota: {{.QuotaUsage}}</p>{{end}}
+            <form hx-encoding="multipart/form-data" hx-post="/upload?{{.State}}" hx-target="body">
                 <label class="custom-file-upload">
                     <input type="file" name="files" multiple
                            class="file-input"
                            hx-trigger="change"
                            hx-encoding="multipart/form-data"
-                           hx-post="/upload"
+                           hx-post="/upload?{{.State}}"
                            hx-target="body">
                     Upload files
                 </label>
+                {{if .NestedUpload}}
+                <label class="custom-file-upload">
+                    <input type="file" name="files" webkitdirectory
+                           class="file-input"
+                           hx-trigger="change"
+                           hx-encoding="multipart/form-data"
+                           hx-post="/upload?{{.State}}"
+                           hx-target="body">
+                    Upload folder
+                </label>
+                {{end}}
                 <progress id="progress" value="0" max="100" style="display: none;"></progress>
             </form>
         </div>
+        {{if not .UploadOnly}}
+        <div class="upload-form">
+            <h2>New File</h2>
+            <form method="post" action="/create?{{.State}}">
+                <input type="text" name="name" placeholder="notes.txt" required>
+                <p><textarea name="content" rows="4" cols="60" placeholder="Content (optional)"></textarea></p>
+                <button type="submit">Create</button>
+            </form>
+        </div>
+        <div class="upload-form">
+            <h2>New Folder</h2>
+            <form method="post" action="/mkdir?{{.State}}">
+                <input type="text" name="dir" placeholder="folder or folder/subfolder" required>
+                <button type="submit">Create folder</button>
+            </form>
+        </div>
+        {{end}}
+        {{end}}
+        <p class="footer">{{.Footer}}</p>
     </div>
 
     <!-- Download notification element -->
     <div id="download-notification" class="download-notification"></div>
 
+    <!-- Shown when uploaded files collide with existing ones -->
+    <dialog id="conflict-dialog" class="conflict-dialog">
+        <form method="dialog">
+            <p>These files already exist. Choose what to do with each one:</p>
+            <table id="conflict-list"></table>
+            <button type="button" onclick="setAllResolutions('overwrite')">Overwrite all</button>
+            <button type="button" onclick="setAllResolutions('rename')">Keep both for all</button>
+            <button type="button" onclick="setAllResolutions('skip')">Skip all</button>
+            <p>
+                <button value="apply">Apply</button>
+                <button value="cancel">Cancel</button>
+            </p>
+        </form>
+    </dialog>
+
     <script>
       document.body.addEventListener('htmx:xhr:progress', function(evt) {
         var progress = document.getElementById('progress');
@@ -488,6 +1625,181 @@ const indexHTML = `
         }
       });
 
+      // Rename or move a file or directory: the prompt starts with its
+      // path, so editing the directories moves it
+      function renameFile(from) {
+        var to = prompt('New name or path:', from);
+        if (!to || to === from) {
+            return;
+        }
+        var form = document.createElement('form');
+        form.method = 'post';
+        form.action = '/rename' + location.search;
+        [['from', from], ['to', to]].forEach(function(field) {
+            var input = document.createElement('input');
+            input.type = 'hidden';
+            input.name = field[0];
+            input.value = field[1];
+            form.appendChild(input);
+        });
+        document.body.appendChild(form);
+        form.submit();
+      }
+
+      // Delete a directory: empty ones go at once, for others the server
+      // answers 409 with the number of entries, which the user confirms
+      var allowDirDelete = {{.AllowDirDelete}};
+      function deleteDir(path, value, recursive) {
+        var data = new URLSearchParams();
+        data.append('files', value);
+        if (recursive) {
+            data.append('recursive', '1');
+        }
+        fetch('/delete' + location.search, {method: 'POST', body: data, headers: {'Accept': 'application/json'}})
+            .then(function(response) { return response.json(); })
+            .then(function(results) {
+                var result = results[0];
+                if (result.status === 409 && allowDirDelete && !recursive) {
+                    if (confirm('Delete /' + path + ' and the ' + result.entries + ' entries in it?')) {
+                        deleteDir(path, value, true);
+                    }
+                    return;
+                }
+                if (result.error) {
+                    alert('Could not delete /' + path + ': ' + result.error);
+                }
+                location.reload();
+            })
+            .catch(function() { alert('Could not delete /' + path); });
+      }
+
+      // Failed uploads come back as JSON results instead of a page: offer to
+      // resolve name conflicts rather than swapping the JSON into the page
+      document.body.addEventListener('htmx:beforeSwap', function(evt) {
+        var xhr = evt.detail.xhr;
+        var files = evt.detail.elt.files;
+        if (!files) {
+            if (evt.detail.isError) {
+                alert(xhr.responseText); // e.g. files of a delete that were not found
+                location.reload();
+            }
+            return;
+        }
+        if ((xhr.getResponseHeader('Content-Type') || '').indexOf('application/json') !== 0) {
+            if (evt.detail.isError) {
+                alert(xhr.responseText); // e.g. too many files in one upload
+            }
+            return;
+        }
+        evt.detail.shouldSwap = false;
+        var results = JSON.parse(xhr.responseText);
+        var conflicts = [], failures = [];
+        results.forEach(function(result) {
+            if (result.error === 'file already exists') {
+                conflicts.push(result.originalName);
+            } else if (result.error) {
+                failures.push(result.originalName + ': ' + result.error);
+            }
+        });
+        if (failures.length > 0) {
+            alert('Some files were not stored:\n' + failures.join('\n'));
+        }
+        if (conflicts.length > 0) {
+            resolveConflicts(xhr.responseURL, files, conflicts);
+        } else {
+            location.reload();
+        }
+      });
+
+      function setAllResolutions(value) {
+        document.querySelectorAll('#conflict-list select').forEach(function(select) {
+            select.value = value;
+        });
+      }
+
+      // Ask how to resolve each conflicting file, then upload those files
+      // again with the chosen resolution
+      function resolveConflicts(url, files, conflicts) {
+        var dialog = document.getElementById('conflict-dialog');
+        var list = document.getElementById('conflict-list');
+        list.innerHTML = '';
+        conflicts.forEach(function(name) {
+            var row = list.insertRow();
+            row.insertCell().textContent = name;
+            var select = document.createElement('select');
+            select.dataset.name = name;
+            [['overwrite', 'Overwrite'], ['rename', 'Keep both'], ['skip', 'Skip']].forEach(function(option) {
+                select.add(new Option(option[1], option[0]));
+            });
+            select.value = 'skip';
+            row.insertCell().appendChild(select);
+        });
+        dialog.onclose = function() {
+            if (dialog.returnValue !== 'apply') {
+                location.reload();
+                return;
+            }
+            var data = new FormData();
+            list.querySelectorAll('select').forEach(function(select) {
+                if (select.value === 'skip') {
+                    return;
+                }
+                for (var i = 0; i < files.length; i++) {
+                    var name = files[i].webkitRelativePath || files[i].name;
+                    if (name === select.dataset.name) {
+                        data.append('resolution', select.value);
+                        data.append('files', files[i], name);
+                        break;
+                    }
+                }
+            });
+            if (!data.has('files')) {
+                location.reload();
+                return;
+            }
+            fetch(url, {method: 'POST', body: data, headers: {'Accept': 'application/json'}})
+                .then(function(response) { return response.json(); })
+                .then(function(results) {
+                    var failures = results.filter(function(result) { return result.error; });
+                    if (failures.length > 0) {
+                        alert('Some files were not stored:\n' + failures.map(function(result) {
+                            return result.originalName + ': ' + result.error;
+                        }).join('\n'));
+                    }
+                    location.reload();
+                });
+        };
+        dialog.showModal();
+      }
+
+      // Progressive listings: fetch sizes and times of the shown entries in batches
+      (function() {
+        var pending = document.querySelectorAll('.pending-meta');
+        var byName = {};
+        var names = [];
+        pending.forEach(function(span) {
+            byName[span.dataset.name] = span;
+            names.push(span.dataset.name);
+        });
+        for (var i = 0; i < names.length; i += 100) {
+            var params = new URLSearchParams();
+            params.set('dir', {{.Dir}});
+            names.slice(i, i + 100).forEach(function(name) { params.append('name', name); });
+            fetch('/api/files/meta?' + params.toString())
+                .then(function(response) { return response.json(); })
+                .then(function(entries) {
+                    entries.forEach(function(entry) {
+                        var span = byName[entry.name];
+                        if (span) {
+                            span.title = entry.size + ' bytes';
+                            span.innerHTML = '';
+                            span.textContent = entry.sizeText + '\u00a0\u00a0' + entry.modTimeText;
+                        }
+                    });
+                });
+        }
+      })();
+
       // Function to show the download started notification
       function showDownloadStarted(filename) {
         var notification = document.getElementById('download-notification');
@@ -0,0 +1,713 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	log "github.com/sirupsen/logrus"
+	"github.com/urfave/cli/v2"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// loadConfig sets C from command line flags, with the defaults of the flags
+// for everything else, without setting up logging or starting the server.
+func loadConfig(t testing.TB, args ...string) {
+	t.Helper()
+	app := newApp()
+	app.Before = func(c *cli.Context) error {
+		C = configFromFlags(c)
+		return nil
+	}
+	app.Action = func(*cli.Context) error { return nil }
+	if err := app.Run(append([]string{"http-file-server"}, args...)); err != nil {
+		t.Fatalf("invalid flags %q: %v", args, err)
+	}
+}
+
+// newTestServer serves a new temporary directory with the flags args and
+// returns the server and the directory.
+func newTestServer(t testing.TB, args ...string) (*httptest.Server, string) {
+	t.Helper()
+	dir := t.TempDir()
+	defaults := []string{"--dir-to-serve", dir, "--access-log", "off", "--min-free-space", "0"}
+	loadConfig(t, append(defaults, args...)...)
+
+	// Undo what earlier tests may have set up
+	listings = nil
+	downloadBucket = nil
+	transferSlots = nil
+	uploadSlots = nil
+	copyBuffers = newCopyBufferPool(copyBufferSize)
+	authAnswers = &authCache{answers: make(map[[sha256.Size]byte]cachedAuth)}
+
+	if err := configure(); err != nil {
+		t.Fatalf("configure: %v", err)
+	}
+	applyLowMemory()
+	applyUploadLimit()
+	server := httptest.NewServer(newServer("", newRoutes(), nil).Handler)
+	t.Cleanup(server.Close)
+	return server, dir
+}
+
+// writeFile creates the file rel in dir, with its parent directories.
+func writeFile(t *testing.T, dir, rel, content string) {
+	t.Helper()
+	filePath := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testClient does not follow redirects, so that tests see them.
+var testClient = &http.Client{
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// send sends req and returns the response with its body read.
+func send(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := testClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+// newRequest returns a request, failing the test if it cannot be built.
+func newRequest(t *testing.T, method, url string, body io.Reader) *http.Request {
+	t.Helper()
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// formPart is a part of a multipart request, a file if it has a filename.
+type formPart struct {
+	name, filename, content string
+}
+
+// multipartRequest returns a POST request to target of the parts, in order.
+func multipartRequest(t *testing.T, target string, parts []formPart) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	for _, p := range parts {
+		var part io.Writer
+		var err error
+		if p.filename != "" {
+			part, err = form.CreateFormFile(p.name, p.filename)
+		} else {
+			part, err = form.CreateFormField(p.name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(part, p.content)
+	}
+	form.Close()
+	req := newRequest(t, http.MethodPost, target, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// multipartUpload returns an upload of the fields and then the files, as a
+// browser sends them. Both are pairs of name and content.
+func multipartUpload(t *testing.T, target string, fields [][2]string, files [][2]string) *http.Request {
+	t.Helper()
+	var parts []formPart
+	for _, field := range fields {
+		parts = append(parts, formPart{name: field[0], content: field[1]})
+	}
+	for _, file := range files {
+		parts = append(parts, formPart{name: "files", filename: file[0], content: file[1]})
+	}
+	return multipartRequest(t, target, parts)
+}
+
+// postForm returns a POST request to target of the url-encoded values.
+func postForm(t *testing.T, target string, values url.Values) *http.Request {
+	t.Helper()
+	req := newRequest(t, http.MethodPost, target, strings.NewReader(values.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req
+}
+
+// snapshot returns the files of dir, by slash-separated relative path, with
+// their contents; directories have the content "/", symlinks "-> target".
+func snapshot(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(filePath string, entry fs.DirEntry, err error) error {
+		if err != nil || filePath == dir {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, filePath)
+		if entry.IsDir() {
+			files[filepath.ToSlash(rel)] = "/"
+			return nil
+		}
+		if entry.Type()&fs.ModeSymlink != 0 {
+			target, err := os.Readlink(filePath)
+			files[filepath.ToSlash(rel)] = "-> " + target
+			return err
+		}
+		content, err := os.ReadFile(filePath)
+		files[filepath.ToSlash(rel)] = string(content)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestReadOnlyRefusesChanges(t *testing.T) {
+	server, dir := newTestServer(t, "--read-only")
+	writeFile(t, dir, "keep.txt", "original")
+	before := snapshot(t, dir)
+
+	for name, req := range map[string]*http.Request{
+		"upload":        multipartUpload(t, server.URL+"/upload", nil, [][2]string{{"keep.txt", "replaced"}, {"new.txt", "new"}}),
+		"delete":        postForm(t, server.URL+"/delete", url.Values{"files": {encodeFormPath("keep.txt")}}),
+		"delete plain":  postForm(t, server.URL+"/delete", url.Values{"files": {"keep.txt"}}),
+		"DELETE /files": newRequest(t, http.MethodDelete, server.URL+"/files/keep.txt", nil),
+		"PUT /files":    newRequest(t, http.MethodPut, server.URL+"/files/keep.txt", strings.NewReader("replaced")),
+	} {
+		if resp, _ := send(t, req); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: %d, want 403", name, resp.StatusCode)
+		}
+	}
+	if after := snapshot(t, dir); !reflect.DeepEqual(before, after) {
+		t.Errorf("directory changed in read-only mode: %v, was %v", after, before)
+	}
+}
+
+func TestUploadOnlyKeepsSubmissionsApart(t *testing.T) {
+	server, dir := newTestServer(t, "--upload-only")
+	writeFile(t, dir, "essay.txt", "first student")
+
+	resp, _ := send(t, multipartUpload(t, server.URL+"/upload", nil, [][2]string{{"essay.txt", "second student"}}))
+	if resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("upload: %d, want 303", resp.StatusCode)
+	}
+	want := map[string]string{"essay.txt": "first student", "essay (1).txt": "second student"}
+	if got := snapshot(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after upload of a taken name: %v, want %v", got, want)
+	}
+
+	resp, _ = send(t, multipartUpload(t, server.URL+"/upload", [][2]string{{"resolution", "overwrite"}}, [][2]string{{"essay.txt", "overwritten"}}))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("upload with resolution=overwrite: %d, want 403", resp.StatusCode)
+	}
+	resp, _ = send(t, postForm(t, server.URL+"/create", url.Values{"name": {"essay.txt"}, "content": {"x"}}))
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("POST /create: %d, want 403", resp.StatusCode)
+	}
+	if got := snapshot(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("directory changed: %v, want %v", got, want)
+	}
+
+	_, page := send(t, newRequest(t, http.MethodGet, server.URL+"/", nil))
+	if strings.Contains(page, "/create") || strings.Contains(page, "essay") {
+		t.Errorf("upload-only page shows the New File form or the files")
+	}
+}
+
+func TestUploadOnlyHidesCollisions(t *testing.T) {
+	server, dir := newTestServer(t, "--upload-only")
+	if err := os.Mkdir(filepath.Join(dir, "photos"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, "notes", "a file, not a directory")
+
+	// What a response tells the submitter
+	answer := func(req *http.Request) string {
+		t.Helper()
+		resp, body := send(t, req)
+		return fmt.Sprintf("%d X-Stored-Filename=%q Location=%q %s", resp.StatusCode,
+			resp.Header.Values("X-Stored-Filename"), resp.Header.Get("Location"), body)
+	}
+	jsonUpload := func(name string) *http.Request {
+		req := multipartUpload(t, server.URL+"/upload", nil, [][2]string{{name, "same content"}})
+		req.Header.Set("Accept", "application/json")
+		return req
+	}
+	for name, newReq := range map[string]func(name string) *http.Request{
+		"form": func(name string) *http.Request {
+			return multipartUpload(t, server.URL+"/upload", nil, [][2]string{{name, "same content"}})
+		},
+		"JSON": jsonUpload,
+		"PUT": func(name string) *http.Request {
+			return newRequest(t, http.MethodPut, fileURL(server, name), strings.NewReader("same content"))
+		},
+	} {
+		// A taken name, then one that a directory has
+		first, second := answer(newReq(name+".txt")), answer(newReq(name+".txt"))
+		if first != second || strings.Contains(second, "(1)") {
+			t.Errorf("%s: the second upload of a name answers %s, the first %s", name, second, first)
+		}
+		if got := answer(newReq("photos")); strings.Contains(got, "(1)") || !strings.HasPrefix(got, first[:3]) {
+			t.Errorf("%s: upload of a name a directory has answers %s, another name %s", name, got, first)
+		}
+	}
+	if got := snapshot(t, dir); got["form (1).txt"] != "same content" || got["PUT (1).txt"] != "same content" || got["photos (2)"] != "same content" {
+		t.Errorf("uploads were not stored apart: %v", got)
+	}
+
+	// Failures that depend on what exists all look the same
+	failures := map[string]*http.Request{
+		"PUT into a missing directory":    newRequest(t, http.MethodPut, fileURL(server, "missing/a.txt"), strings.NewReader("x")),
+		"PUT into a file":                 newRequest(t, http.MethodPut, fileURL(server, "notes/a.txt"), strings.NewReader("x")),
+		"upload into a missing directory": multipartUpload(t, server.URL+"/upload?dir=missing", nil, [][2]string{{"a.txt", "x"}}),
+		"upload into a file":              multipartUpload(t, server.URL+"/upload?dir=notes", nil, [][2]string{{"a.txt", "x"}}),
+	}
+	var want string
+	for name, req := range failures {
+		got := answer(req)
+		if want == "" {
+			want = got
+		}
+		if got != want || !strings.HasPrefix(got, "403") {
+			t.Errorf("%s: %s, want the same 403 as the others (%s)", name, got, want)
+		}
+	}
+}
+
+func TestUploadOnlyRefusesOtherConflictPolicies(t *testing.T) {
+	for _, policy := range []string{conflictOverwrite, conflictReject} {
+		loadConfig(t, "--upload-only", "--on-conflict", policy, "--access-log", "off")
+		if err := configure(); err == nil {
+			t.Errorf("--upload-only --on-conflict %s was accepted", policy)
+		}
+	}
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	loadConfig(t, "--dir-to-serve", t.TempDir(), "--access-log", "off", "--read-header-timeout", "300ms")
+	if err := configure(); err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer("", newRoutes(), nil)
+	go server.Serve(listener)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Send a header line every 100ms, never ending the headers
+	start := time.Now()
+	closed := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		closed <- err
+	}()
+	if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: localhost\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-closed:
+			if err == nil {
+				t.Fatalf("server answered instead of closing the connection")
+			}
+			if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+				t.Fatalf("connection closed after %s, before --read-header-timeout", elapsed)
+			}
+			return
+		case <-ticker.C:
+			if time.Since(start) > 3*time.Second {
+				t.Fatalf("slow header sender still connected after %s", time.Since(start))
+			}
+			io.WriteString(conn, "X-Slow: 1\r\n")
+		}
+	}
+}
+
+// fileURL returns the /files/ URL of rel, escaped as a client does.
+func fileURL(server *httptest.Server, rel string) string {
+	return server.URL + (&url.URL{Path: "/files/" + rel}).EscapedPath()
+}
+
+func TestDeleteFiles(t *testing.T) {
+	server, dir := newTestServer(t)
+	names := []string{"with space.txt", "ünïcödé 日本語.txt", "sub dir/naïve file.txt", "a+b.txt", "100%.txt", "keep.txt", "full/inside.txt"}
+	for _, name := range names {
+		writeFile(t, dir, name, name)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "empty dir"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		path string
+		want int
+	}{
+		{"with space.txt", http.StatusNoContent},
+		{"ünïcödé 日本語.txt", http.StatusNoContent},
+		{"sub dir/naïve file.txt", http.StatusNoContent},
+		{"a+b.txt", http.StatusNoContent},
+		{"100%.txt", http.StatusNoContent},
+		{"empty dir", http.StatusNoContent},
+		{"with space.txt", http.StatusNotFound},
+		{"missing.txt", http.StatusNotFound},
+		{"full", http.StatusConflict},
+		{"full?recursive=1", http.StatusForbidden}, // Without --allow-dir-delete
+	} {
+		target := fileURL(server, tc.path)
+		if base, query, ok := strings.Cut(tc.path, "?"); ok {
+			target = fileURL(server, base) + "?" + query
+		}
+		if resp, body := send(t, newRequest(t, http.MethodDelete, target, nil)); resp.StatusCode != tc.want {
+			t.Errorf("DELETE %s: %d %q, want %d", tc.path, resp.StatusCode, body, tc.want)
+		}
+	}
+	want := map[string]string{"keep.txt": "keep.txt", "full": "/", "full/inside.txt": "full/inside.txt", "sub dir": "/"}
+	if got := snapshot(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("after the deletes: %v, want %v", got, want)
+	}
+}
+
+func TestDeleteBatchWithPermissionDenied(t *testing.T) {
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs file permissions that apply, which root ignores")
+	}
+	server, dir := newTestServer(t)
+	writeFile(t, dir, "locked/a.txt", "a")
+	writeFile(t, dir, "ok.txt", "ok")
+	writeFile(t, dir, "ok2.txt", "ok")
+	locked := filepath.Join(dir, "locked")
+	if err := os.Chmod(locked, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(locked, 0755) })
+	batch := func(ok string) url.Values {
+		return url.Values{"files": {encodeFormPath(ok), encodeFormPath("locked/a.txt"), encodeFormPath("missing.txt")}}
+	}
+
+	req := postForm(t, server.URL+"/delete", batch("ok.txt"))
+	req.Header.Set("Accept", "application/json")
+	resp, body := send(t, req)
+	var results []fileResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatalf("invalid delete results %q: %v", body, err)
+	}
+	want := []fileResult{
+		{Name: "ok.txt", Status: http.StatusOK},
+		{Name: "locked/a.txt", Status: http.StatusForbidden, Error: "permission denied"},
+		{Name: "missing.txt", Status: http.StatusNotFound, Error: "not found"},
+	}
+	if resp.StatusCode != http.StatusMultiStatus || !reflect.DeepEqual(results, want) {
+		t.Errorf("JSON delete: %d %+v, want 207 %+v", resp.StatusCode, results, want)
+	}
+
+	resp, body = send(t, postForm(t, server.URL+"/delete", batch("ok2.txt")))
+	wantBody := "Deleted: ok2.txt\nNot deleted: locked/a.txt (permission denied)\nNot deleted: missing.txt (not found)\n"
+	if resp.StatusCode != http.StatusMultiStatus || body != wantBody {
+		t.Errorf("form delete: %d %q, want 207 %q", resp.StatusCode, body, wantBody)
+	}
+	if location := resp.Header.Get("Location"); location != "" {
+		t.Errorf("form delete redirected to %s although files were not deleted", location)
+	}
+
+	if _, err := os.Stat(filepath.Join(locked, "a.txt")); err != nil {
+		t.Errorf("locked/a.txt: %v", err)
+	}
+}
+
+// checkboxValue matches the delete checkboxes of the listing page.
+var checkboxValue = regexp.MustCompile(`<input type="checkbox" name="files" value="([^"]*)">`)
+
+func TestDeleteHostileNamesFromListing(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("names with trailing spaces and quotes cannot be created on Windows")
+	}
+	server, dir := newTestServer(t)
+	selected := []string{" leading space.txt", "trailing space.txt ", "a+b.txt", "%41.txt", "caf\u00e9.txt", "x&files=keep.txt", `quote"s.txt`}
+	// Names that the selected ones turn into when decoded carelessly, or
+	// normalized to another Unicode form
+	kept := []string{"a b.txt", "A.txt", "100%.txt", "cafe\u0301.txt", "keep.txt", "日本 語.txt"}
+	want := make(map[string]string)
+	for _, name := range append(slices.Clone(selected), kept...) {
+		writeFile(t, dir, name, name)
+	}
+	for _, name := range kept {
+		want[name] = name
+	}
+
+	// Select the checkboxes as a browser would, by their rendered values
+	_, page := send(t, newRequest(t, http.MethodGet, server.URL+"/", nil))
+	values := make(map[string]string)
+	for _, match := range checkboxValue.FindAllStringSubmatch(page, -1) {
+		value := html.UnescapeString(match[1])
+		name, err := decodeFormPath(value)
+		if err != nil {
+			t.Fatalf("checkbox value %q: %v", value, err)
+		}
+		values[name] = value
+	}
+	form := url.Values{}
+	for _, name := range selected {
+		value, ok := values[name]
+		if !ok {
+			t.Fatalf("no checkbox for %q in %v", name, values)
+		}
+		form.Add("files", value)
+	}
+	// A name deleted in the meantime is reported, not skipped
+	form.Add("files", encodeFormPath("gone.txt"))
+
+	req := postForm(t, server.URL+"/delete", form)
+	req.Header.Set("Accept", "application/json")
+	resp, body := send(t, req)
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Errorf("delete: %d, want 207", resp.StatusCode)
+	}
+	var results []fileResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatalf("invalid results %q: %v", body, err)
+	}
+	got := make(map[string]int)
+	for _, result := range results {
+		got[result.Name] = result.Status
+	}
+	for _, name := range selected {
+		if got[name] != http.StatusOK {
+			t.Errorf("%q: %d, want 200", name, got[name])
+		}
+	}
+	if got["gone.txt"] != http.StatusNotFound {
+		t.Errorf("gone.txt: %d, want 404", got["gone.txt"])
+	}
+
+	if after := snapshot(t, dir); !reflect.DeepEqual(after, want) {
+		t.Errorf("after the delete: %q, want %q", after, want)
+	}
+}
+
+func TestDeleteDirectoryRecursively(t *testing.T) {
+	server, dir := newTestServer(t, "--allow-dir-delete")
+	writeFile(t, dir, "full/sub/inside.txt", "x")
+	if resp, _ := send(t, newRequest(t, http.MethodDelete, fileURL(server, "full")+"?recursive=1", nil)); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE full?recursive=1: %d, want 204", resp.StatusCode)
+	}
+	if got := snapshot(t, dir); len(got) != 0 {
+		t.Errorf("after the delete: %v", got)
+	}
+}
+
+func TestDeleteInReadOnlyMode(t *testing.T) {
+	server, dir := newTestServer(t, "--read-only")
+	writeFile(t, dir, "with space.txt", "x")
+	if resp, _ := send(t, newRequest(t, http.MethodDelete, fileURL(server, "with space.txt"), nil)); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("DELETE in read-only mode: %d, want 403", resp.StatusCode)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "with space.txt")); err != nil {
+		t.Errorf("file deleted in read-only mode: %v", err)
+	}
+}
+
+// downloadRoutes are the two URLs of a file, which must behave the same.
+var downloadRoutes = []string{"/download/", "/files/"}
+
+func TestDownloadRoutesSendSameHeaders(t *testing.T) {
+	server, dir := newTestServer(t)
+	writeFile(t, dir, "sub/a report.txt", "hello world\n")
+
+	headers := make(map[string]http.Header)
+	for _, route := range downloadRoutes {
+		resp, body := send(t, newRequest(t, http.MethodGet, server.URL+route+"sub/a%20report.txt", nil))
+		if resp.StatusCode != http.StatusOK || body != "hello world\n" {
+			t.Fatalf("GET %s: %d %q", route, resp.StatusCode, body)
+		}
+		headers[route] = resp.Header
+	}
+	for _, name := range []string{"Content-Disposition", "Content-Type", "Content-Length", "Last-Modified", "Accept-Ranges", "X-Content-Type-Options"} {
+		download, files := headers["/download/"].Get(name), headers["/files/"].Get(name)
+		if download == "" || download != files {
+			t.Errorf("%s: /download/ sent %q, /files/ sent %q", name, download, files)
+		}
+	}
+}
+
+func TestDownloadRoutesCountTransfers(t *testing.T) {
+	server, dir := newTestServer(t)
+	writeFile(t, dir, "a.bin", strings.Repeat("x", 1000))
+
+	for _, route := range downloadRoutes {
+		served := bytesServed.Load()
+		transferred := testutil.ToFloat64(transferredBytes.WithLabelValues(directionDownload))
+		resp, _ := send(t, newRequest(t, http.MethodGet, server.URL+route+"a.bin", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET %s: %d", route, resp.StatusCode)
+		}
+		if n := bytesServed.Load() - served; n != 1000 {
+			t.Errorf("GET %s: bytesServed grew by %d, want 1000", route, n)
+		}
+		if n := testutil.ToFloat64(transferredBytes.WithLabelValues(directionDownload)) - transferred; n != 1000 {
+			t.Errorf("GET %s: hfs_transferred_bytes_total grew by %v, want 1000", route, n)
+		}
+	}
+}
+
+// newVerifier returns a stub --auth-url that only accepts alice/secret.
+func newVerifier(t *testing.T) *httptest.Server {
+	t.Helper()
+	verifier := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var credentials struct{ Username, Password string }
+		json.NewDecoder(r.Body).Decode(&credentials)
+		if credentials.Username != "alice" || credentials.Password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(verifier.Close)
+	return verifier
+}
+
+func TestDownloadRoutesRequireAuth(t *testing.T) {
+	server, dir := newTestServer(t, "--auth-url", newVerifier(t).URL)
+	writeFile(t, dir, "a.txt", "a")
+
+	for _, route := range downloadRoutes {
+		for _, tc := range []struct {
+			user, password string
+			want           int
+		}{
+			{"", "", http.StatusUnauthorized},
+			{"alice", "wrong", http.StatusUnauthorized},
+			{"alice", "secret", http.StatusOK},
+		} {
+			req := newRequest(t, http.MethodGet, server.URL+route+"a.txt", nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			if resp, _ := send(t, req); resp.StatusCode != tc.want {
+				t.Errorf("GET %s as %q/%q: %d, want %d", route, tc.user, tc.password, resp.StatusCode, tc.want)
+			}
+		}
+	}
+}
+
+func TestDownloadRoutesApplyExclusions(t *testing.T) {
+	server, dir := newTestServer(t, "--include", "*.iso", "--exclude", "old")
+	for _, rel := range []string{"disk.iso", "notes.txt", ".secret.iso", "old/disk.iso"} {
+		writeFile(t, dir, rel, "data")
+	}
+
+	for _, route := range downloadRoutes {
+		for rel, want := range map[string]int{
+			"disk.iso":     http.StatusOK,
+			"notes.txt":    http.StatusNotFound,
+			".secret.iso":  http.StatusNotFound,
+			"old/disk.iso": http.StatusNotFound,
+		} {
+			if resp, _ := send(t, newRequest(t, http.MethodGet, server.URL+route+rel, nil)); resp.StatusCode != want {
+				t.Errorf("GET %s%s: %d, want %d", route, rel, resp.StatusCode, want)
+			}
+		}
+	}
+}
+
+// levelRecorder is an output of LogHook remembering the messages it got.
+type levelRecorder struct {
+	messages []string
+}
+
+func (rec *levelRecorder) Write(p []byte) (int, error) {
+	rec.messages = append(rec.messages, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// leveledRecorder is a levelRecorder written to with WriteLevel, like
+// syslog, remembering the level in front of each message.
+type leveledRecorder struct {
+	levelRecorder
+}
+
+func (rec *leveledRecorder) WriteLevel(level log.Level, p []byte) error {
+	_, err := rec.Write([]byte(level.String() + " " + string(p)))
+	return err
+}
+
+func TestLogHookLevels(t *testing.T) {
+	console, file, syslog := &levelRecorder{}, &levelRecorder{}, &leveledRecorder{}
+	hook := &LogHook{}
+	hook.Add(console, &log.TextFormatter{DisableTimestamp: true, DisableColors: true}, levelsUpTo(log.InfoLevel))
+	hook.Add(file, &log.JSONFormatter{DisableTimestamp: true}, levelsUpTo(log.TraceLevel))
+	hook.Add(syslog, &log.TextFormatter{DisableTimestamp: true, DisableColors: true}, levelsUpTo(log.WarnLevel))
+	logger := log.New()
+	logger.SetOutput(io.Discard)
+	logger.SetLevel(log.TraceLevel)
+	logger.AddHook(hook)
+
+	for _, level := range []log.Level{log.PanicLevel, log.ErrorLevel, log.WarnLevel, log.InfoLevel, log.DebugLevel, log.TraceLevel} {
+		func() {
+			defer func() { recover() }()
+			logger.Log(level, level.String())
+		}()
+	}
+
+	for _, tc := range []struct {
+		name string
+		got  []string
+		want []string
+	}{
+		{"console", console.messages, []string{
+			"level=panic msg=panic", "level=error msg=error", "level=warning msg=warning", "level=info msg=info",
+		}},
+		{"file", file.messages, []string{
+			`{"level":"panic","msg":"panic"}`, `{"level":"error","msg":"error"}`, `{"level":"warning","msg":"warning"}`,
+			`{"level":"info","msg":"info"}`, `{"level":"debug","msg":"debug"}`, `{"level":"trace","msg":"trace"}`,
+		}},
+		{"syslog", syslog.messages, []string{
+			"panic level=panic msg=panic", "error level=error msg=error", "warning level=warning msg=warning",
+		}},
+	} {
+		if !reflect.DeepEqual(tc.got, tc.want) {
+			t.Errorf("%s got %q, want %q", tc.name, tc.got, tc.want)
+		}
+	}
+}
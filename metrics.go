@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// The collectors of --metrics. They are updated whether or not /metrics is
+// enabled, which costs next to nothing.
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hfs_http_requests_total",
+		Help: "HTTP requests by handler and status code.",
+	}, []string{"handler", "code"})
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hfs_http_request_duration_seconds",
+		Help:    "Time to answer HTTP requests by handler, including whole transfers.",
+		Buckets: []float64{0.005, 0.025, 0.1, 0.5, 2.5, 10, 60, 300, 1800},
+	}, []string{"handler"})
+	transferredBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "hfs_transferred_bytes_total",
+		Help: "Bytes of file content uploaded or downloaded.",
+	}, []string{"direction"})
+	transferSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hfs_transfer_size_bytes",
+		Help:    "Size of the uploaded or downloaded files.",
+		Buckets: prometheus.ExponentialBuckets(1<<10, 8, 9), // 1 KiB to 16 TiB
+	}, []string{"direction"})
+	activeTransfers = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hfs_active_transfers",
+		Help: "Uploads and downloads in progress.",
+	}, []string{"direction"})
+	uploadsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hfs_uploads_total",
+		Help: "Files stored by uploads.",
+	})
+	deletesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "hfs_deletes_total",
+		Help: "Files and directories deleted.",
+	})
+	bandwidthLimit = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "hfs_bandwidth_limit_bytes_per_second",
+		Help: "Current limit of all downloads together, 0 if unlimited.",
+	})
+	bandwidthRule = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hfs_bandwidth_schedule_rule",
+		Help: "1 for the rule of --rate-schedule in effect, \"default\" outside of the rules.",
+	}, []string{"rule"})
+)
+
+// Label values of the direction of a transfer.
+const (
+	directionUpload   = "upload"
+	directionDownload = "download"
+)
+
+// countTransfer records a completed transfer of n bytes.
+func countTransfer(direction string, n int64) {
+	transferredBytes.WithLabelValues(direction).Add(float64(n))
+	transferSizes.WithLabelValues(direction).Observe(float64(n))
+}
+
+// statusRecorder remembers the status code and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	if s.status == 0 {
+		s.status = status
+	}
+	s.ResponseWriter.WriteHeader(status)
+}
+
+func (s *statusRecorder) Write(p []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(p)
+	s.written += int64(n)
+	return n, err
+}
+
+// code returns the status code sent, 200 if the handler wrote nothing.
+func (s *statusRecorder) code() int {
+	if s.status == 0 {
+		return http.StatusOK
+	}
+	return s.status
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusRecorder) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (c *countingWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// metricsHandler counts the requests and their duration by route, the
+// pattern of mux that serves them, which keeps the number of label values
+// small. It wraps every other handler, so that requests refused by the IP
+// filter or the authentication are counted as well.
+func metricsHandler(mux *http.ServeMux, next http.Handler) http.Handler {
+	if !C.Metrics {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, route := mux.Handler(r)
+		if route == "" {
+			route = "none"
+		}
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, r)
+		requestsTotal.WithLabelValues(route, strconv.Itoa(recorder.code())).Inc()
+		requestDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// startMetrics serves /metrics with --metrics: on its own listener with
+// --metrics-port, else on mux of the main port, where it needs
+// authentication if it is enabled and is only answered to local clients if
+// not.
+func startMetrics(mux *http.ServeMux) error {
+	if !C.Metrics {
+		return nil
+	}
+	if C.MetricsPort == 0 {
+		mux.Handle("/metrics", localUnlessAuth(promhttp.Handler()))
+		log.Infof("Metrics are served at /metrics")
+		return nil
+	}
+	addr := net.JoinHostPort(C.ListenIp, strconv.Itoa(C.MetricsPort))
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("could not listen on --metrics-port: %w", err)
+	}
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", promhttp.Handler())
+	metricsServer := &http.Server{
+		Handler:           metricsMux,
+		ReadHeaderTimeout: C.ReadHeaderTimeout,
+		IdleTimeout:       C.IdleTimeout,
+	}
+	go func() {
+		if err := metricsServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("Metrics server stopped: %v", err)
+		}
+	}()
+	log.Infof("Metrics are served at http://%s/metrics", addr)
+	return nil
+}
+
+// localUnlessAuth answers 403 to clients other than the local host when no
+// authentication is configured, so that the handler is not world-readable.
+func localUnlessAuth(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if addr, ok := clientIP(r); !authEnabled() && (!ok || !addr.Unmap().IsLoopback()) {
+			loggerFrom(r.Context()).Warnf("Refused %s to %s: only local clients are allowed without authentication", r.URL.Path, clientAddr(r))
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Limits on the names of directories created with /mkdir, those of common
+// filesystems.
+const (
+	maxNameLen = 255
+	maxPathLen = 4096
+)
+
+// newDirMode is the permission of every directory the server creates, from
+// --dir-mode (before the umask is applied).
+var newDirMode os.FileMode = 0755
+
+// parseDirMode parses --dir-mode, octal permissions like 0755.
+func parseDirMode(value string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("invalid --dir-mode %q, expected octal permissions like 0755", value)
+	}
+	return os.FileMode(mode), nil
+}
+
+// validateDirName checks the path of a directory to create, which may have
+// several components, and returns it cleaned, with forward slashes.
+func validateDirName(name string) (string, error) {
+	if len(name) > maxPathLen {
+		return "", fmt.Errorf("path longer than %d bytes", maxPathLen)
+	}
+	cleaned, err := sanitizeNestedPath(strings.TrimSuffix(name, "/"))
+	if err != nil {
+		return "", err
+	}
+	for _, component := range strings.Split(cleaned, "/") {
+		if len(component) > maxNameLen {
+			return "", fmt.Errorf("name longer than %d bytes", maxNameLen)
+		}
+		if strings.IndexFunc(component, unicode.IsControl) >= 0 {
+			return "", fmt.Errorf("control character in %q", component)
+		}
+	}
+	return cleaned, nil
+}
+
+// mkdirResult is the JSON answer of POST /api/mkdir.
+type mkdirResult struct {
+	Path    string `json:"path"`
+	Created bool   `json:"created"` // False if the directory already existed
+}
+
+// mkdirHandler handles POST /mkdir and POST /api/mkdir: it creates the
+// directory given by the "dir" field (form or JSON body), which may contain
+// several components, inside the directory ?dir= of the listing. It answers
+// 409 if a file is in the way. /api/mkdir answers with JSON, /mkdir
+// redirects back to the listing like the other forms.
+func mkdirHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	api := r.URL.Path == "/api/mkdir" || wantsJSON(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 2*maxPathLen+1024)
+	fields, err := readFields(r)
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	name := fields.Get("dir")
+	if strings.TrimSpace(name) == "" {
+		http.Error(w, "Missing directory name", http.StatusBadRequest)
+		return
+	}
+	cleaned, err := validateDirName(name)
+	if err != nil {
+		logger.Warnf("Rejected mkdir of %q: %v", name, err)
+		http.Error(w, fmt.Sprintf("Invalid directory name: %v", err), http.StatusBadRequest)
+		return
+	}
+	name = cleaned
+
+	relParent := cleanRelPath(r.URL.Query().Get("dir"))
+	parent, err := resolvePath(r.Context(), relParent)
+	if err != nil || !isServableDir(relParent) {
+		http.Error(w, "Parent directory not found", http.StatusNotFound)
+		return
+	}
+	if info, err := os.Stat(parent); err != nil || !info.IsDir() {
+		http.Error(w, "Parent directory not found", http.StatusNotFound)
+		return
+	}
+	relPath := path.Join(relParent, name)
+	if !isServableDir(relPath) {
+		logger.Warnf("Rejected mkdir of hidden or excluded directory: %s", relPath)
+		http.Error(w, "Hidden or excluded directories are not accepted", http.StatusForbidden)
+		return
+	}
+	if _, err := resolvePath(r.Context(), relPath); errors.Is(err, errSymlinkOutside) {
+		logger.Warnf("Rejected mkdir of %s: symlink leads outside the served directory", relPath)
+		http.Error(w, "Symlink leads outside the served directory", http.StatusForbidden)
+		return
+	}
+
+	// MkdirAll fails with a less helpful error when a file is in the way
+	target := parent
+	created := false
+	for _, component := range strings.Split(name, "/") {
+		target = filepath.Join(target, component)
+		info, err := os.Lstat(target)
+		if err == nil && !info.IsDir() {
+			logger.Warnf("Rejected mkdir of %s: a file with that name exists", target)
+			http.Error(w, fmt.Sprintf("A file named %s already exists", component), http.StatusConflict)
+			return
+		}
+		created = created || errors.Is(err, os.ErrNotExist)
+	}
+	if err := os.MkdirAll(target, newDirMode); err != nil {
+		logger.Errorf("Could not create directory %s: %v", target, err)
+		http.Error(w, "Could not create directory", http.StatusInternalServerError)
+		return
+	}
+	if created {
+		invalidateListingTree(target)
+		logger.Infof("Created directory %s", target)
+	}
+
+	if api {
+		status := http.StatusOK
+		if created {
+			status = http.StatusCreated
+		}
+		writeJSON(w, r, status, mkdirResult{Path: relPath, Created: created})
+		return
+	}
+	http.Redirect(w, r, returnURL(r, relParent), http.StatusSeeOther)
+}
@@ -0,0 +1,68 @@
+package main
+
+import "strings"
+
+// naturalLess orders names the way people expect: runs of digits compare
+// by their numeric value (part2 before part10) and everything else
+// ignoring case. Names that are still equal, like file01 and file1, fall
+// back to comparing the raw bytes so the order is total and stable.
+func naturalLess(a, b string) bool {
+	if c := naturalCompare(a, b); c != 0 {
+		return c < 0
+	}
+	return a < b
+}
+
+// naturalCompare compares a and b chunk by chunk, a chunk being a run of
+// ASCII digits or a run of anything else.
+func naturalCompare(a, b string) int {
+	for a != "" && b != "" {
+		chunkA, restA := nextChunk(a)
+		chunkB, restB := nextChunk(b)
+		var c int
+		if isDigit(chunkA[0]) && isDigit(chunkB[0]) {
+			c = compareNumeric(chunkA, chunkB)
+		} else {
+			c = strings.Compare(strings.ToLower(chunkA), strings.ToLower(chunkB))
+		}
+		if c != 0 {
+			return c
+		}
+		a, b = restA, restB
+	}
+	switch {
+	case a == b:
+		return 0
+	case a == "":
+		return -1
+	default:
+		return 1
+	}
+}
+
+// nextChunk splits s, which must not be empty, after its first chunk.
+// Multi-byte UTF-8 sequences never contain ASCII digits, so splitting on
+// bytes is safe.
+func nextChunk(s string) (string, string) {
+	digits := isDigit(s[0])
+	i := 1
+	for i < len(s) && isDigit(s[i]) == digits {
+		i++
+	}
+	return s[:i], s[i:]
+}
+
+// compareNumeric compares two runs of digits by value, without parsing
+// them, so arbitrarily long numbers work.
+func compareNumeric(a, b string) int {
+	a = strings.TrimLeft(a, "0")
+	b = strings.TrimLeft(b, "0")
+	if len(a) != len(b) {
+		return len(a) - len(b)
+	}
+	return strings.Compare(a, b)
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"slices"
+	"sort"
+	"testing"
+)
+
+func TestNaturalLess(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"part2.bin", "part10.bin", true},
+		{"part10.bin", "part2.bin", false},
+		{"file01", "file1", true}, // Equal values, raw bytes decide
+		{"file1", "file01", false},
+		{"file01", "file2", true},
+		{"file001", "file01", true},
+		{"File2", "file10", true}, // Case is ignored
+		{"apple", "Banana", true},
+		{"Banana", "apple", false},
+		{"a", "A", false}, // Equal but for case, raw bytes decide
+		{"A", "a", true},
+		{"x", "x1", true}, // A prefix comes first
+		{"x9", "x", false},
+		{"1", "a", true},                                        // Digits come before letters
+		{"99999999999999999999", "100000000000000000000", true}, // Beyond int64
+		{"écran 2", "écran 10", true},
+		{"ß01", "ß1", true},
+		{"日本2", "日本10", true},
+		{"日本", "中国", false},
+		{"same", "same", false},
+		{"", "a", true},
+		{"a", "", false},
+	} {
+		if got := naturalLess(tc.a, tc.b); got != tc.want {
+			t.Errorf("naturalLess(%q, %q) = %t, want %t", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestNaturalSortIsTotal(t *testing.T) {
+	want := []string{"01", "1", "2", "A", "a", "b2", "B10", "file", "File1", "file01", "file1", "file2", "file10", "Ä1", "ä1", "日本2", "日本10"}
+	for _, input := range [][]string{want, reversedStrings(want)} {
+		got := slices.Clone(input)
+		sort.Slice(got, func(i, j int) bool { return naturalLess(got[i], got[j]) })
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("sorted %v: %v, want %v", input, got, want)
+		}
+	}
+}
+
+func reversedStrings(s []string) []string {
+	r := slices.Clone(s)
+	slices.Reverse(r)
+	return r
+}
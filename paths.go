@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// errOutsideRoot is returned when a user supplied path does not stay inside
+// the served directory.
+var errOutsideRoot = errors.New("path is outside the served directory")
+
+// errSymlinkOutside is returned when a user supplied path leads outside the
+// served directory through a symlink, without --follow-symlinks.
+var errSymlinkOutside = fmt.Errorf("%w through a symlink", errOutsideRoot)
+
+// errInvalidPath is returned for user supplied paths with NUL bytes or empty
+// components, which no served file has.
+var errInvalidPath = errors.New("invalid path")
+
+// errNotServed is returned when a user supplied path is hidden or left out
+// by --include/--exclude, see isServable.
+var errNotServed = errors.New("path is not served")
+
+// resolvePath turns a user supplied path, relative to the served directory,
+// into a filesystem path, see resolveInRoot. An empty path resolves to the
+// served directory itself.
+func resolvePath(ctx context.Context, rel string) (string, error) {
+	return resolveInRoot(ctx, C.DirpathToServe, rel)
+}
+
+// resolveInRoot joins userPath to root, making sure the result stays inside
+// root, also through symlinks: every handler goes through it before touching
+// the filesystem. Backslashes are taken as separators, as clients on Windows
+// send them. A trailing slash is accepted, other empty components are not.
+func resolveInRoot(ctx context.Context, root, userPath string) (string, error) {
+	if strings.ContainsRune(userPath, 0) {
+		return "", errInvalidPath
+	}
+	slashed := strings.ReplaceAll(userPath, "\\", "/")
+	if path.IsAbs(slashed) || filepath.IsAbs(userPath) || filepath.VolumeName(userPath) != "" {
+		return "", errOutsideRoot
+	}
+	if strings.Contains(strings.TrimSuffix(slashed, "/"), "//") {
+		return "", errInvalidPath
+	}
+	cleaned := path.Clean(slashed)
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", errOutsideRoot
+	}
+	joined := filepath.Join(root, filepath.FromSlash(cleaned))
+	if err := checkInsideRoot(ctx, root, joined); err != nil {
+		return "", err
+	}
+	return joined, nil
+}
+
+// checkInsideRoot verifies that target, a path below root, does not leave
+// root through a symlink, unless --follow-symlinks allows it, which is then
+// logged. Only its longest existing part is resolved, as uploads and renames
+// name files that do not exist yet. If root itself cannot be resolved, the
+// later filesystem access reports the error.
+func checkInsideRoot(ctx context.Context, root, target string) error {
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return nil
+	}
+	existing, rest := target, ""
+	for {
+		real, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			existing = filepath.Join(real, rest)
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return nil
+		}
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = parent
+	}
+	rel, err := filepath.Rel(realRoot, existing)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		if C.FollowSymlinks {
+			loggerFrom(ctx).Infof("Following symlink out of the served directory: %s -> %s", target, existing)
+			return nil
+		}
+		return errSymlinkOutside
+	}
+	return nil
+}
+
+// isHiddenPath reports whether rel, relative to the served directory, is or
+// lies inside a dotfile or dot directory that is hidden without --show-hidden.
+func isHiddenPath(rel string) bool {
+	if C.ShowHidden {
+		return false
+	}
+	for _, name := range strings.Split(cleanRelPath(rel), "/") {
+		if strings.HasPrefix(name, ".") {
+			return true
+		}
+	}
+	return false
+}
+
+// formPathPrefix marks form values that carry a path in base64url, see
+// encodeFormPath.
+const formPathPrefix = "b64:"
+
+// encodeFormPath encodes a relative path for a form value, such as the
+// checkboxes of the listing. Browsers and form decoding do not reliably
+// preserve names with spaces, plus signs or percent sequences, base64url does.
+func encodeFormPath(rel string) string {
+	return formPathPrefix + base64.RawURLEncoding.EncodeToString([]byte(rel))
+}
+
+// decodeFormPath reverses encodeFormPath. Values without the prefix are
+// taken as plain paths, as sent by scripts.
+func decodeFormPath(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, formPathPrefix)
+	if !ok {
+		return value, nil
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(encoded)
+	return string(decoded), err
+}
+
+// cleanRelPath normalizes a user supplied relative path for use in URLs,
+// returning "" for the served directory itself. Backslashes are separators,
+// as in resolveInRoot, so that both see the same components.
+func cleanRelPath(rel string) string {
+	cleaned := path.Clean("/" + strings.ReplaceAll(filepath.ToSlash(rel), "\\", "/"))
+	return strings.TrimPrefix(cleaned, "/")
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// symlink creates a symlink at link to target, skipping the test where
+// symlinks cannot be created (e.g. Windows without developer mode).
+func symlink(t *testing.T, target, link string) {
+	t.Helper()
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+}
+
+func TestResolveInRoot(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	loadConfig(t, "--dir-to-serve", root)
+	writeFile(t, root, "inside/a.txt", "a")
+	writeFile(t, outside, "secret.txt", "secret")
+	symlink(t, outside, filepath.Join(root, "out"))
+	symlink(t, filepath.Join(outside, "secret.txt"), filepath.Join(root, "outfile"))
+	symlink(t, "inside", filepath.Join(root, "in"))
+
+	cases := []struct {
+		path string
+		want string // Relative to root, if accepted
+		err  error
+	}{
+		{"", ".", nil},
+		{"inside/a.txt", "inside/a.txt", nil},
+		{"inside/", "inside", nil},
+		{"inside/../inside/a.txt", "inside/a.txt", nil},
+		{"in/a.txt", "in/a.txt", nil},                   // Relative symlink inside the root
+		{"in/new.txt", "in/new.txt", nil},               // Files that do not exist yet
+		{"%2e%2e/secret.txt", "%2e%2e/secret.txt", nil}, // Already decoded, a plain name
+		{"..", "", errOutsideRoot},
+		{"../secret.txt", "", errOutsideRoot},
+		{"..\\secret.txt", "", errOutsideRoot},
+		{"foo/../../etc/passwd", "", errOutsideRoot},
+		{"foo\\..\\..\\etc\\passwd", "", errOutsideRoot},
+		{"/etc/passwd", "", errOutsideRoot},
+		{"\\etc\\passwd", "", errOutsideRoot},
+		{"inside//a.txt", "", errInvalidPath},
+		{"inside/a.txt\x00.png", "", errInvalidPath},
+		{"out/secret.txt", "", errSymlinkOutside},
+		{"out/new.txt", "", errSymlinkOutside},
+		{"out", "", errSymlinkOutside},
+		{"outfile", "", errSymlinkOutside},
+	}
+	if runtime.GOOS == "windows" {
+		cases = append(cases, []struct {
+			path string
+			want string
+			err  error
+		}{
+			{"C:\\Windows", "", errOutsideRoot},
+			{"C:secret.txt", "", errOutsideRoot},
+			{"\\\\server\\share\\secret.txt", "", errOutsideRoot},
+		}...)
+	}
+	for _, tc := range cases {
+		got, err := resolveInRoot(context.Background(), root, tc.path)
+		switch {
+		case tc.err != nil && !errors.Is(err, tc.err):
+			t.Errorf("resolveInRoot(%q) = %q, %v, want %v", tc.path, got, err, tc.err)
+		case tc.err == nil && (err != nil || got != filepath.Join(root, filepath.FromSlash(tc.want))):
+			t.Errorf("resolveInRoot(%q) = %q, %v, want %q", tc.path, got, err, tc.want)
+		}
+	}
+}
+
+// traversals are user supplied paths that try to reach secret.txt outside
+// the served directory, directly or through the symlinks "out" (to a
+// directory outside) and "outfile" (to the file itself).
+var traversals = []string{
+	"../secret.txt",
+	"..\\secret.txt",
+	"foo/../../secret.txt",
+	"foo\\..\\..\\secret.txt",
+	"a.txt\x00/../../secret.txt",
+	"out/secret.txt",
+	"out/new.txt",
+	"outfile",
+}
+
+// urlTraversals are traversals as they appear in the path of a URL, also
+// percent-encoded.
+var urlTraversals = []string{
+	"../secret.txt",
+	"%2e%2e/secret.txt",
+	"%2E%2E%2Fsecret.txt",
+	"..%2fsecret.txt",
+	"..%5csecret.txt",
+	"..\\secret.txt",
+	"foo/../../secret.txt",
+	"foo%2f..%2f..%2fsecret.txt",
+	"a.txt%00/../../secret.txt",
+	"out/secret.txt",
+	"out%2fsecret.txt",
+	"out/new.txt",
+	"outfile",
+}
+
+func TestTraversalIsRefusedEverywhere(t *testing.T) {
+	server, dir := newTestServer(t, "--allow-nested-upload", "--mkdir-on-upload", "--trash")
+	writeFile(t, dir, "a.txt", "a")
+	writeFile(t, dir, "sub/b.txt", "b")
+	// The parent of the served directory, and another directory
+	parent, outside := filepath.Dir(dir), t.TempDir()
+	writeFile(t, parent, "secret.txt", "top secret")
+	writeFile(t, outside, "secret.txt", "top secret")
+	symlink(t, outside, filepath.Join(dir, "out"))
+	symlink(t, filepath.Join(outside, "secret.txt"), filepath.Join(dir, "outfile"))
+	absolute := filepath.Join(outside, "secret.txt")
+	// Everything but the served directory, outside included
+	outsideFiles := func() map[string]string {
+		files := snapshot(t, parent)
+		for rel := range files {
+			if rel == filepath.Base(dir) || strings.HasPrefix(rel, filepath.Base(dir)+"/") {
+				delete(files, rel)
+			}
+		}
+		return files
+	}
+	before := outsideFiles()
+
+	// Requests with the traversal in the URL path, sent as they are
+	requests := make(map[string]*http.Request)
+	for _, p := range urlTraversals {
+		for _, route := range []string{"/download/", "/files/", "/view/", "/thumb/", "/edit/"} {
+			requests["GET "+route+p] = rawRequest(t, http.MethodGet, server.URL+route+p, "")
+		}
+		requests["PUT /files/"+p] = rawRequest(t, http.MethodPut, server.URL+"/files/"+p, "overwritten")
+		requests["DELETE /files/"+p] = rawRequest(t, http.MethodDelete, server.URL+"/files/"+p, "")
+		requests["POST /save/"+p] = rawRequest(t, http.MethodPost, server.URL+"/save/"+p, "content=overwritten&mtime=0")
+	}
+	// Requests with the traversal in a query or form value
+	for _, p := range append(traversals, absolute) {
+		query := url.Values{"dir": {p}}.Encode()
+		requests["GET /?dir="+p] = newRequest(t, http.MethodGet, server.URL+"/?"+query, nil)
+		requests["GET /api/files?dir="+p] = newRequest(t, http.MethodGet, server.URL+"/api/files?"+query, nil)
+		requests["GET /api/files/meta?dir="+p] = newRequest(t, http.MethodGet, server.URL+"/api/files/meta?name=secret.txt&"+query, nil)
+		requests["POST /upload?dir="+p] = multipartUpload(t, server.URL+"/upload?"+query, nil, [][2]string{{"secret.txt", "overwritten"}})
+		requests["POST /upload dir="+p] = multipartUpload(t, server.URL+"/upload", [][2]string{{"dir", p}}, [][2]string{{"secret.txt", "overwritten"}})
+		requests["POST /upload filename="+p] = multipartUpload(t, server.URL+"/upload", nil, [][2]string{{p, "overwritten"}})
+		requests["POST /create?dir="+p] = postForm(t, server.URL+"/create?"+query, url.Values{"name": {"secret.txt"}, "content": {"overwritten"}})
+		requests["POST /delete "+p] = postForm(t, server.URL+"/delete", url.Values{"files": {p}})
+		requests["POST /delete b64 "+p] = postForm(t, server.URL+"/delete", url.Values{"files": {encodeFormPath(p)}})
+		requests["POST /rename to "+p] = postForm(t, server.URL+"/rename", url.Values{"from": {"a.txt"}, "to": {p}})
+		requests["POST /rename from "+p] = postForm(t, server.URL+"/rename", url.Values{"from": {p}, "to": {"stolen.txt"}})
+		requests["POST /move to "+p] = postForm(t, server.URL+"/move", url.Values{"files": {encodeFormPath("a.txt")}, "dest": {p}})
+		requests["POST /move from "+p] = postForm(t, server.URL+"/move", url.Values{"files": {encodeFormPath(p)}, "dest": {"sub"}})
+		requests["POST /mkdir "+p] = postForm(t, server.URL+"/mkdir", url.Values{"dir": {p}})
+		requests["POST /trash/restore "+p] = postForm(t, server.URL+"/trash/restore", url.Values{"id": {p}})
+	}
+
+	for name, req := range requests {
+		resp, body := sendFollowing(t, req)
+		switch resp.StatusCode {
+		case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound:
+		default:
+			t.Errorf("%q: %d %q, want 400, 403 or 404", name, resp.StatusCode, body)
+		}
+		if strings.Contains(body, "top secret") {
+			t.Errorf("%q: the file outside was served", name)
+		}
+	}
+
+	if after := outsideFiles(); !reflect.DeepEqual(after, before) {
+		t.Errorf("files outside the served directory changed: %v, were %v", after, before)
+	}
+	if content, err := os.ReadFile(filepath.Join(dir, "a.txt")); err != nil || string(content) != "a" {
+		t.Errorf("a.txt was moved or changed: %q, %v", content, err)
+	}
+}
+
+// rawRequest returns a request for target, whose path is sent exactly as
+// given, percent-encodings and dot segments included. A body is sent as a
+// form.
+func rawRequest(t *testing.T, method, target, body string) *http.Request {
+	t.Helper()
+	scheme, rest, _ := strings.Cut(target, "://")
+	host, rawPath, _ := strings.Cut(rest, "/")
+	req := newRequest(t, method, scheme+"://"+host+"/", strings.NewReader(body))
+	req.URL.Opaque = "//" + host + "/" + rawPath
+	if body != "" {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return req
+}
+
+// sendFollowing is send, following redirects: ServeMux redirects paths
+// with dot segments to their clean form before any handler runs, and the
+// clean form must not lead outside either.
+func sendFollowing(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, body := send(t, req)
+	for i := 0; i < 5 && resp.StatusCode >= 300 && resp.StatusCode < 400; i++ {
+		location, err := resp.Location()
+		if err != nil {
+			t.Fatalf("redirect without Location: %v", err)
+		}
+		resp, body = send(t, newRequest(t, http.MethodGet, location.String(), nil))
+	}
+	return resp, body
+}
+
+func TestSymlinkPolicy(t *testing.T) {
+	outside := t.TempDir()
+	writeFile(t, outside, "secret.txt", "top secret")
+
+	for _, follow := range []bool{false, true} {
+		args := []string{}
+		if follow {
+			args = append(args, "--follow-symlinks")
+		}
+		server, dir := newTestServer(t, args...)
+		writeFile(t, dir, "real/a.txt", "inside")
+		symlink(t, "real/a.txt", filepath.Join(dir, "in"))
+		symlink(t, "real", filepath.Join(dir, "indir"))
+		symlink(t, filepath.Join(outside, "secret.txt"), filepath.Join(dir, "out"))
+		symlink(t, outside, filepath.Join(dir, "outdir"))
+		symlink(t, "missing.txt", filepath.Join(dir, "dangling"))
+
+		// Every link is listed and marked, wherever it leads
+		resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/api/files", nil))
+		var l listing
+		if err := json.Unmarshal([]byte(body), &l); err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("follow %t: listing: %d %q, %v", follow, resp.StatusCode, body, err)
+		}
+		symlinks := map[string]bool{}
+		for _, entry := range l.Entries {
+			symlinks[entry.Name] = entry.Symlink
+		}
+		want := map[string]bool{"real": false, "in": true, "indir": true, "out": true, "outdir": true, "dangling": true}
+		if !reflect.DeepEqual(symlinks, want) {
+			t.Errorf("follow %t: listed symlinks %v, want %v", follow, symlinks, want)
+		}
+
+		outStatus, outBody := http.StatusForbidden, ""
+		if follow {
+			outStatus, outBody = http.StatusOK, "top secret"
+		}
+		for _, route := range downloadRoutes {
+			for rel, tc := range map[string]struct {
+				status int
+				body   string
+			}{
+				"in":                {http.StatusOK, "inside"},
+				"indir/a.txt":       {http.StatusOK, "inside"},
+				"out":               {outStatus, outBody},
+				"outdir/secret.txt": {outStatus, outBody},
+				"dangling":          {http.StatusNotFound, ""},
+			} {
+				resp, body := send(t, newRequest(t, http.MethodGet, server.URL+route+rel, nil))
+				if resp.StatusCode != tc.status || tc.body != "" && body != tc.body {
+					t.Errorf("follow %t: GET %s%s: %d %q, want %d %q", follow, route, rel, resp.StatusCode, body, tc.status, tc.body)
+				}
+				if tc.body == "" && strings.Contains(body, "top secret") {
+					t.Errorf("follow %t: GET %s%s served the file outside", follow, route, rel)
+				}
+			}
+		}
+
+		for rel, status := range map[string]int{"indir": http.StatusOK, "outdir": outStatus, "dangling": http.StatusNotFound} {
+			if resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/api/files?dir="+rel, nil)); resp.StatusCode != status {
+				t.Errorf("follow %t: listing %s: %d %q, want %d", follow, rel, resp.StatusCode, body, status)
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	maxMetaNames = 500
+	statWorkers  = 8
+)
+
+// pendingEntry is an entry of a names-only listing, see readListing.
+type pendingEntry struct {
+	Name        string `json:"name"`
+	Path        string `json:"path"`
+	IsDir       bool   `json:"isDir"`
+	DownloadURL string `json:"downloadUrl,omitempty"`
+}
+
+// pendingListing converts a Pending listing for the JSON API, leaving out
+// the size and modTime fields that were not read.
+func pendingListing(l listing) interface{} {
+	entries := make([]pendingEntry, 0, len(l.Entries))
+	for _, entry := range l.Entries {
+		entries = append(entries, pendingEntry{Name: entry.Name, Path: entry.Path, IsDir: entry.IsDir, DownloadURL: entry.DownloadURL})
+	}
+	return struct {
+		Entries []pendingEntry `json:"entries"`
+		Total   int            `json:"total"`
+		Page    int            `json:"page"`
+		PerPage int            `json:"perPage"`
+		Pending bool           `json:"pending"`
+	}{entries, l.Total, l.Page, l.PerPage, true}
+}
+
+// metaEntry is an Entry together with its size and time formatted the way
+// the HTML listing shows them.
+type metaEntry struct {
+	Entry
+	SizeText    string `json:"sizeText"`
+	ModTimeText string `json:"modTimeText"`
+}
+
+// apiFilesMetaHandler serves GET /api/files/meta?dir=<relpath>&name=a&name=b,
+// the stat details of the named entries of one directory, which progressive
+// listings fetch after showing the names. Names that do not exist or are not
+// served are left out of the response.
+func apiFilesMetaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+		writeJSONError(w, r, http.StatusMethodNotAllowed, "Method not allowed")
+		return
+	}
+
+	rel := r.URL.Query().Get("dir")
+	names := r.URL.Query()["name"]
+	if len(names) > maxMetaNames {
+		writeJSONError(w, r, http.StatusBadRequest, "Too many names, at most 500 per request")
+		return
+	}
+	dirPath, err := resolvePath(r.Context(), rel)
+	if err == nil && !isServableDir(rel) {
+		err = errNotServed
+	}
+	if err != nil {
+		status, msg := listDirError(r.Context(), rel, err)
+		writeJSONError(w, r, status, msg)
+		return
+	}
+	for _, name := range names {
+		if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+			writeJSONError(w, r, http.StatusBadRequest, "Invalid name")
+			return
+		}
+	}
+
+	relDir := cleanRelPath(rel)
+	infos := statNames(r.Context(), dirPath, names)
+	entries := make([]metaEntry, 0, len(names))
+	for _, info := range infos {
+		if info == nil || isPartialFile(info.Name()) || info.Name() == instanceLockName {
+			continue
+		}
+		entry := entryFromInfo(relDir, info)
+		if entry.IsDir && !isServableDir(entry.Path) || !entry.IsDir && !isServable(entry.Path) {
+			continue
+		}
+		if len(C.ExposeXattrs) > 0 {
+			entry.Xattrs = exposedXattrs(filepath.Join(dirPath, info.Name()))
+		}
+		entries = append(entries, metaEntry{
+			Entry:       entry,
+			SizeText:    humanSize(entry.Size),
+			ModTimeText: entry.ModTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+	writeJSON(w, r, http.StatusOK, entries)
+}
+
+// statNames stats the given names inside dirPath with a few parallel
+// workers, as slow storage is mostly latency bound. The result has the
+// same order as names, with nil for the ones that could not be stat'ed.
+func statNames(ctx context.Context, dirPath string, names []string) []os.FileInfo {
+	infos := make([]os.FileInfo, len(names))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < min(statWorkers, len(names)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				info, err := os.Lstat(filepath.Join(dirPath, names[index]))
+				if err != nil {
+					if !os.IsNotExist(err) {
+						loggerFrom(ctx).Warnf("Could not get file info for %s: %v", names[index], err)
+					}
+					continue
+				}
+				infos[index] = info
+			}
+		}()
+	}
+	for i := range names {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return infos
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// trustedProxies is --trusted-proxies, parsed by parseIPRules at startup.
+var trustedProxies []netip.Prefix
+
+// trustedProxy reports whether addr is one of --trusted-proxies.
+func trustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap().WithZone("")
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client of the request. That is the
+// peer, unless the peer is one of --trusted-proxies: then it is the
+// rightmost address of X-Forwarded-For that is not a trusted proxy, or
+// X-Real-IP without X-Forwarded-For. Entries left of it were written by the
+// client and could be anything, and forwarded headers from other peers are
+// ignored for the same reason.
+func clientIP(r *http.Request) (netip.Addr, bool) {
+	addr, ok := remoteAddr(r)
+	if !ok || !trustedProxy(addr) {
+		return addr, ok
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+	if len(forwarded) == 0 {
+		if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+			return realIP.Unmap().WithZone(""), true
+		}
+		return addr, true
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		entries := strings.Split(forwarded[i], ",")
+		for j := len(entries) - 1; j >= 0; j-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(entries[j]))
+			if err != nil {
+				// Whatever is left of a malformed entry cannot be trusted
+				// either, so the last proxy is the best answer.
+				return addr, true
+			}
+			addr = hop.Unmap().WithZone("")
+			if !trustedProxy(addr) {
+				return addr, true
+			}
+		}
+	}
+	return addr, true
+}
+
+// clientAddr returns clientIP as a string for log lines, r.RemoteAddr if it
+// cannot be parsed.
+func clientAddr(r *http.Request) string {
+	if addr, ok := clientIP(r); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
+
+// requestScheme returns the scheme the client used: that of the connection,
+// or X-Forwarded-Proto when a trusted proxy sent it, as it may terminate TLS.
+func requestScheme(r *http.Request) string {
+	if addr, ok := remoteAddr(r); ok && trustedProxy(addr) {
+		switch proto := strings.ToLower(strings.TrimSpace(r.Header.Get("X-Forwarded-Proto"))); proto {
+		case "http", "https":
+			return proto
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// absoluteURL returns the URL of path on this server as the client sees it.
+func absoluteURL(r *http.Request, path string) string {
+	return (&url.URL{Scheme: requestScheme(r), Host: r.Host, Path: path}).String()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dirQuota keeps the total size of the regular files in the served
+// directory, the trash aside, against --quota. The total is computed once at
+// startup and then updated by every upload, save, delete and restore, so
+// changes made outside the server are only seen after a restart.
+type dirQuota struct {
+	mu    sync.Mutex
+	limit int64
+	used  int64 // Including the bytes of uploads in progress
+}
+
+// quota is nil without --quota.
+var quota *dirQuota
+
+// errQuotaExceeded is wrapped with the remaining capacity when a write would
+// exceed --quota.
+var errQuotaExceeded = fmt.Errorf("quota exceeded")
+
+// startQuota sets up --quota, walking the served directory for its size.
+func startQuota(limit int64) {
+	if limit <= 0 {
+		return
+	}
+	used := dirUsage(C.DirpathToServe)
+	quota = &dirQuota{limit: limit, used: used}
+	log.Infof("Quota: %s of %s used", humanSize(used), humanSize(limit))
+	if used > limit {
+		log.Warnf("The served directory is already over its quota, uploads are refused")
+	}
+}
+
+// dirUsage returns the total size of the regular files below dirPath,
+// without the trash and without following symlinks.
+func dirUsage(dirPath string) int64 {
+	return walkTotals(dirPath).Bytes
+}
+
+// usage returns how much of the quota the file or directory at filePath
+// takes, 0 without --quota.
+func usage(filePath string, info os.FileInfo) int64 {
+	switch {
+	case quota == nil:
+		return 0
+	case info.IsDir():
+		return dirUsage(filePath)
+	case info.Mode().IsRegular():
+		return info.Size()
+	}
+	return 0
+}
+
+// replacedSize returns the usage of the file at filePath if an upload with
+// policy would overwrite it.
+func replacedSize(filePath, policy string) int64 {
+	if policy != conflictOverwrite {
+		return 0
+	}
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return 0
+	}
+	return usage(filePath, info)
+}
+
+// quotaReserve accounts for n more bytes, or returns an error stating the
+// remaining capacity if they do not fit.
+func quotaReserve(n int64) error {
+	if quota == nil || n <= 0 {
+		return nil
+	}
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	if quota.used+n > quota.limit {
+		return quota.exceeded()
+	}
+	quota.used += n
+	return nil
+}
+
+// quotaCheck returns the error of quotaReserve for n more bytes, without
+// reserving them.
+func quotaCheck(n int64) error {
+	if quota == nil || n <= 0 {
+		return nil
+	}
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	if quota.used+n > quota.limit {
+		return quota.exceeded()
+	}
+	return nil
+}
+
+// quotaRelease accounts for n bytes that were freed or not written after all.
+func quotaRelease(n int64) {
+	if quota == nil || n <= 0 {
+		return
+	}
+	quota.mu.Lock()
+	quota.used = max(quota.used-n, 0)
+	quota.mu.Unlock()
+}
+
+// quotaExceeded returns errQuotaExceeded with the capacity now remaining.
+func quotaExceeded() error {
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	return quota.exceeded()
+}
+
+// exceeded returns errQuotaExceeded with the remaining capacity. q.mu must
+// be held.
+func (q *dirQuota) exceeded() error {
+	return fmt.Errorf("%w, %s left", errQuotaExceeded, humanSize(max(q.limit-q.used, 0)))
+}
+
+// quotaUsage returns the used bytes and the limit, or false without --quota.
+func quotaUsage() (used, limit int64, ok bool) {
+	if quota == nil {
+		return 0, 0, false
+	}
+	quota.mu.Lock()
+	defer quota.mu.Unlock()
+	return quota.used, quota.limit, true
+}
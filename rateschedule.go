@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// rateScheduleInterval is how often the rules of --rate-schedule are
+// checked against the clock.
+const rateScheduleInterval = 10 * time.Second
+
+const minutesPerDay = 24 * 60
+
+// rateRule is one rule of --rate-schedule: the rate of all downloads
+// together from start until end, in minutes after midnight. A rule whose
+// end is before its start spans midnight.
+type rateRule struct {
+	start, end int
+	rate       int64 // Bytes per second, 0 for no limit
+	text       string
+}
+
+// covers reports whether the rule applies at minute of the day.
+func (r rateRule) covers(minute int) bool {
+	if r.start < r.end {
+		return minute >= r.start && minute < r.end
+	}
+	return minute >= r.start || minute < r.end
+}
+
+// rateSchedule sets the rate of downloadBucket by the time of day. Outside
+// its rules, --max-bandwidth applies.
+type rateSchedule struct {
+	rules    []rateRule
+	base     int64
+	location *time.Location
+
+	mu      sync.Mutex
+	applied bool
+	rate    int64  // Applied to downloadBucket
+	rule    string // The rule of rate, empty for --max-bandwidth
+}
+
+// schedule is the --rate-schedule, nil without one.
+var schedule *rateSchedule
+
+// parseRateSchedule parses rules like "09:00-18:00=2MB/s,18:00-09:00=50MB/s",
+// with the rates of parseBandwidth. Rules must not overlap; times are wall
+// clock times in location, so the rules follow daylight saving time.
+func parseRateSchedule(value string, base int64, location *time.Location) (*rateSchedule, error) {
+	s := &rateSchedule{base: base, location: location}
+	for _, text := range strings.Split(value, ",") {
+		text = strings.TrimSpace(text)
+		span, rate, ok := strings.Cut(text, "=")
+		from, to, ok2 := strings.Cut(span, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid rule %q, expected e.g. 09:00-18:00=2MB/s", text)
+		}
+		var rule rateRule
+		var err error
+		if rule.start, err = parseClock(from, false); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+		if rule.end, err = parseClock(to, true); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+		if rule.start == rule.end {
+			return nil, fmt.Errorf("invalid rule %q: it starts when it ends", text)
+		}
+		if rule.rate, err = parseBandwidth(rate); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", text, err)
+		}
+		rule.end %= minutesPerDay
+		rule.text = text
+		s.rules = append(s.rules, rule)
+	}
+	for minute := 0; minute < minutesPerDay; minute++ {
+		var covering []string
+		for _, rule := range s.rules {
+			if rule.covers(minute) {
+				covering = append(covering, rule.text)
+			}
+		}
+		if len(covering) > 1 {
+			return nil, fmt.Errorf("rules %s overlap at %02d:%02d", strings.Join(covering, " and "), minute/60, minute%60)
+		}
+	}
+	return s, nil
+}
+
+// parseClock parses a time of day like "09:00" into minutes after
+// midnight. "24:00" is accepted as the end of a rule.
+func parseClock(value string, end bool) (int, error) {
+	hours, minutes, ok := strings.Cut(strings.TrimSpace(value), ":")
+	h, err := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	switch {
+	case !ok || err != nil || err2 != nil || len(minutes) != 2:
+		return 0, fmt.Errorf("invalid time %q, expected e.g. 09:00", value)
+	case end && h == 24 && m == 0:
+		return minutesPerDay, nil
+	case h < 0 || h > 23 || m < 0 || m > 59:
+		return 0, fmt.Errorf("invalid time %q, expected e.g. 09:00", value)
+	}
+	return h*60 + m, nil
+}
+
+// at returns the rate at t and the rule it comes from, empty outside the
+// rules.
+func (s *rateSchedule) at(t time.Time) (int64, string) {
+	local := t.In(s.location)
+	minute := local.Hour()*60 + local.Minute()
+	for _, rule := range s.rules {
+		if rule.covers(minute) {
+			return rule.rate, rule.text
+		}
+	}
+	return s.base, ""
+}
+
+// apply sets the rate of downloadBucket to that at now. Transfers in
+// progress are not interrupted, they go on at the new rate.
+func (s *rateSchedule) apply(now time.Time) {
+	rate, rule := s.at(now)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.applied && rate == s.rate && rule == s.rule {
+		return
+	}
+	s.applied, s.rate, s.rule = true, rate, rule
+	downloadBucket.setRate(rate)
+	bandwidthLimit.Set(float64(rate))
+	bandwidthRule.Reset()
+	if rule == "" {
+		bandwidthRule.WithLabelValues("default").Set(1)
+	} else {
+		bandwidthRule.WithLabelValues(rule).Set(1)
+	}
+	switch {
+	case rule == "" && rate == 0:
+		log.Infof("Bandwidth schedule: downloads are not limited outside of the rules")
+	case rule == "":
+		log.Infof("Bandwidth schedule: downloads are limited to %s/s outside of the rules", humanSize(rate))
+	case rate == 0:
+		log.Infof("Bandwidth schedule: downloads are not limited (%s)", rule)
+	default:
+		log.Infof("Bandwidth schedule: downloads are limited to %s/s (%s)", humanSize(rate), rule)
+	}
+}
+
+// current returns the rate applied to the bucket and its rule.
+func (s *rateSchedule) current() (int64, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate, s.rule
+}
+
+// setupRateSchedule parses --rate-schedule and --rate-schedule-tz and
+// applies the rate of the moment, base being --max-bandwidth.
+func setupRateSchedule(base int64) error {
+	schedule = nil
+	if C.RateSchedule == "" {
+		return nil
+	}
+	location := time.Local
+	if C.RateScheduleTZ != "" {
+		var err error
+		if location, err = time.LoadLocation(C.RateScheduleTZ); err != nil {
+			return fmt.Errorf("--rate-schedule-tz: %v", err)
+		}
+	}
+	s, err := parseRateSchedule(C.RateSchedule, base, location)
+	if err != nil {
+		return fmt.Errorf("--rate-schedule: %v", err)
+	}
+	if downloadBucket == nil {
+		downloadBucket = newTokenBucket(base)
+	}
+	schedule = s
+	schedule.apply(time.Now())
+	return nil
+}
+
+// startRateSchedule follows the clock with the --rate-schedule.
+func startRateSchedule() {
+	if schedule == nil {
+		return
+	}
+	go func() {
+		for now := range time.Tick(rateScheduleInterval) {
+			schedule.apply(now)
+		}
+	}()
+}
+
+// bandwidthStatus describes the limit of all downloads together for
+// /healthz, nil without one.
+func bandwidthStatus() map[string]interface{} {
+	switch {
+	case schedule != nil:
+		rate, rule := schedule.current()
+		return map[string]interface{}{"limit": rate, "schedule": C.RateSchedule, "rule": rule}
+	case downloadBucket != nil:
+		return map[string]interface{}{"limit": downloadBucket.limit()}
+	}
+	return nil
+}
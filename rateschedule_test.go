@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestParseRateSchedule(t *testing.T) {
+	for _, tc := range []struct {
+		value string
+		err   string // Part of the error, empty if valid
+	}{
+		{"09:00-18:00=2MB/s,18:00-09:00=50MB/s", ""},
+		{" 09:00-18:00=2MBps , 22:00-06:00=0 ", ""},
+		{"00:00-24:00=1MBps", ""},
+		{"18:00-24:00=1MBps,00:00-06:00=2MBps", ""},
+		{"9:30-17:00=80Mbps", ""},
+		{"09:00-18:00", "invalid rule"},
+		{"09:00=2MBps", "invalid rule"},
+		{"", "invalid rule"},
+		{"09:00-18:00=2MBps,", "invalid rule"},
+		{"9-18=2MBps", "invalid time"},
+		{"09:0-18:00=2MBps", "invalid time"},
+		{"24:00-06:00=2MBps", "invalid time"},
+		{"09:00-24:01=2MBps", "invalid time"},
+		{"09:60-18:00=2MBps", "invalid time"},
+		{"09:00-09:00=2MBps", "starts when it ends"},
+		{"00:00-24:00=2MBps,12:00-13:00=1MBps", "overlap at 12:00"},
+		{"22:00-06:00=1MBps,05:00-07:00=2MBps", "overlap at 05:00"},
+		{"09:00-18:00=2MBps,17:59-20:00=1MBps", "overlap at 17:59"},
+		{"09:00-18:00=fast", "invalid bandwidth"},
+	} {
+		_, err := parseRateSchedule(tc.value, 0, time.UTC)
+		switch {
+		case tc.err == "" && err != nil:
+			t.Errorf("parseRateSchedule(%q): %v", tc.value, err)
+		case tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)):
+			t.Errorf("parseRateSchedule(%q) = %v, want an error with %q", tc.value, err, tc.err)
+		}
+	}
+}
+
+func TestRateScheduleBoundaries(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("no time zone database: %v", err)
+	}
+	const base = 5_000_000
+	for _, tc := range []struct {
+		schedule string
+		location *time.Location
+		at       time.Time
+		rate     int64
+		rule     string
+	}{
+		// A day split in two
+		{"09:00-18:00=2MBps,18:00-09:00=50MBps", time.UTC, time.Date(2026, 6, 1, 8, 59, 59, 0, time.UTC), 50_000_000, "18:00-09:00=50MBps"},
+		{"09:00-18:00=2MBps,18:00-09:00=50MBps", time.UTC, time.Date(2026, 6, 1, 9, 0, 0, 0, time.UTC), 2_000_000, "09:00-18:00=2MBps"},
+		{"09:00-18:00=2MBps,18:00-09:00=50MBps", time.UTC, time.Date(2026, 6, 1, 17, 59, 59, 0, time.UTC), 2_000_000, "09:00-18:00=2MBps"},
+		{"09:00-18:00=2MBps,18:00-09:00=50MBps", time.UTC, time.Date(2026, 6, 1, 18, 0, 0, 0, time.UTC), 50_000_000, "18:00-09:00=50MBps"},
+
+		// Across midnight, with --max-bandwidth outside of the rules
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 1, 21, 59, 0, 0, time.UTC), base, ""},
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 1, 22, 0, 0, 0, time.UTC), 1_000_000, "22:00-06:00=1MBps"},
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 1, 23, 59, 59, 0, time.UTC), 1_000_000, "22:00-06:00=1MBps"},
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), 1_000_000, "22:00-06:00=1MBps"},
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 2, 5, 59, 59, 0, time.UTC), 1_000_000, "22:00-06:00=1MBps"},
+		{"22:00-06:00=1MBps", time.UTC, time.Date(2026, 6, 2, 6, 0, 0, 0, time.UTC), base, ""},
+		{"18:00-24:00=1MBps,00:00-06:00=0", time.UTC, time.Date(2026, 6, 1, 23, 59, 59, 0, time.UTC), 1_000_000, "18:00-24:00=1MBps"},
+		{"18:00-24:00=1MBps,00:00-06:00=0", time.UTC, time.Date(2026, 6, 2, 0, 0, 0, 0, time.UTC), 0, "00:00-06:00=0"},
+
+		// Wall clock time of the time zone, not UTC
+		{"09:00-18:00=2MBps", newYork, time.Date(2026, 6, 1, 13, 0, 0, 0, time.UTC), 2_000_000, "09:00-18:00=2MBps"},
+		{"09:00-18:00=2MBps", newYork, time.Date(2026, 6, 1, 12, 59, 0, 0, time.UTC), base, ""},
+
+		// Office hours start an hour earlier in UTC once New York springs
+		// forward, on March 8th 2026
+		{"09:00-18:00=2MBps", newYork, time.Date(2026, 3, 7, 13, 30, 0, 0, time.UTC), base, ""},
+		{"09:00-18:00=2MBps", newYork, time.Date(2026, 3, 9, 13, 30, 0, 0, time.UTC), 2_000_000, "09:00-18:00=2MBps"},
+		// The hour from 02:00 to 03:00 does not happen that night
+		{"02:00-03:00=1MBps", newYork, time.Date(2026, 3, 8, 6, 59, 59, 0, time.UTC), base, ""},
+		{"02:00-03:00=1MBps", newYork, time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC), base, ""},
+		{"22:00-02:30=1MBps", newYork, time.Date(2026, 3, 8, 6, 59, 59, 0, time.UTC), 1_000_000, "22:00-02:30=1MBps"},
+		{"22:00-02:30=1MBps", newYork, time.Date(2026, 3, 8, 7, 0, 0, 0, time.UTC), base, ""},
+
+		// The hour from 01:00 to 02:00 happens twice when New York falls
+		// back, on November 1st 2026, and the rule applies both times
+		{"01:00-02:00=1MBps", newYork, time.Date(2026, 11, 1, 4, 59, 59, 0, time.UTC), base, ""},
+		{"01:00-02:00=1MBps", newYork, time.Date(2026, 11, 1, 5, 30, 0, 0, time.UTC), 1_000_000, "01:00-02:00=1MBps"},
+		{"01:00-02:00=1MBps", newYork, time.Date(2026, 11, 1, 6, 30, 0, 0, time.UTC), 1_000_000, "01:00-02:00=1MBps"},
+		{"01:00-02:00=1MBps", newYork, time.Date(2026, 11, 1, 7, 0, 0, 0, time.UTC), base, ""},
+	} {
+		s, err := parseRateSchedule(tc.schedule, base, tc.location)
+		if err != nil {
+			t.Fatalf("parseRateSchedule(%q): %v", tc.schedule, err)
+		}
+		rate, rule := s.at(tc.at)
+		if rate != tc.rate || rule != tc.rule {
+			t.Errorf("%q at %s in %s = %d (%q), want %d (%q)", tc.schedule, tc.at.Format(time.RFC3339), tc.location, rate, rule, tc.rate, tc.rule)
+		}
+	}
+}
+
+func TestTokenBucketSetRate(t *testing.T) {
+	b := newTokenBucket(1_000_000)
+	b.tokens = -500_000 // Writers are waiting for half a second
+	b.setRate(100_000_000)
+	if b.tokens > -400_000 || b.tokens > b.burst {
+		t.Errorf("tokens after raising the rate = %.0f, want the debt kept", b.tokens)
+	}
+	if b.burst != bucketBurst(100_000_000) {
+		t.Errorf("burst = %.0f, want %.0f", b.burst, bucketBurst(100_000_000))
+	}
+
+	b.tokens = b.burst
+	b.setRate(1_000_000)
+	if b.tokens != bucketBurst(1_000_000) {
+		t.Errorf("tokens after lowering the rate = %.0f, want the new burst %.0f", b.tokens, bucketBurst(1_000_000))
+	}
+
+	b.setRate(0)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		if err := b.wait(t.Context(), throttleChunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("100 chunks without a limit took %v", elapsed)
+	}
+	b.setRate(1_000_000)
+	if b.tokens != b.burst {
+		t.Errorf("tokens after limiting again = %.0f, want a full burst %.0f", b.tokens, b.burst)
+	}
+}
+
+func TestRateScheduleStatus(t *testing.T) {
+	t.Cleanup(func() { schedule = nil })
+	server, _ := newTestServer(t, "--max-bandwidth", "1MBps", "--rate-schedule", "00:00-24:00=3MBps", "--rate-schedule-tz", "Europe/Paris")
+
+	resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/healthz", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("/healthz: %d", resp.StatusCode)
+	}
+	var status struct {
+		Bandwidth struct {
+			Limit    int64
+			Schedule string
+			Rule     string
+		}
+	}
+	if err := json.Unmarshal([]byte(body), &status); err != nil {
+		t.Fatalf("/healthz: %v in %s", err, body)
+	}
+	if status.Bandwidth.Limit != 3_000_000 || status.Bandwidth.Rule != "00:00-24:00=3MBps" || status.Bandwidth.Schedule != "00:00-24:00=3MBps" {
+		t.Errorf("/healthz bandwidth = %+v, want the rule 00:00-24:00=3MBps", status.Bandwidth)
+	}
+	if got := downloadBucket.limit(); got != 3_000_000 {
+		t.Errorf("download limit = %d, want 3000000", got)
+	}
+	if got := testutil.ToFloat64(bandwidthLimit); got != 3_000_000 {
+		t.Errorf("hfs_bandwidth_limit_bytes_per_second = %v, want 3000000", got)
+	}
+	if got := testutil.ToFloat64(bandwidthRule.WithLabelValues("00:00-24:00=3MBps")); got != 1 {
+		t.Errorf("hfs_bandwidth_schedule_rule = %v, want 1", got)
+	}
+
+	loadConfig(t, "--rate-schedule", "09:00-18:00=2MBps", "--rate-schedule-tz", "Nowhere/Atlantis")
+	if err := configure(); err == nil || !strings.Contains(err.Error(), "--rate-schedule-tz") {
+		t.Errorf("configure with an unknown time zone: %v", err)
+	}
+	loadConfig(t, "--rate-schedule", "09:00-18:00=2MBps,12:00-13:00=1MBps")
+	if err := configure(); err == nil || !strings.Contains(err.Error(), "--rate-schedule") {
+		t.Errorf("configure with overlapping rules: %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// recoverHandler turns a panic in a handler into a logged error with its
+// stack, and a 500 if the response has not started. Otherwise the response
+// is cut off, as net/http does, so that the client does not take it for a
+// complete one. http.ErrAbortHandler, the way to abort a response on
+// purpose, is passed on untouched.
+func recoverHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			p := recover()
+			if p == nil {
+				return
+			}
+			if p == http.ErrAbortHandler {
+				panic(p)
+			}
+			loggerFrom(r.Context()).WithField("stack", string(debug.Stack())).
+				Errorf("Panic serving %s %s: %v", r.Method, r.URL.RequestURI(), p)
+			if recorder.status != 0 {
+				panic(http.ErrAbortHandler)
+			}
+			// Drop what the handler prepared for its own response
+			for _, header := range []string{"Content-Disposition", "Content-Encoding", "Content-Range", "ETag", "Last-Modified"} {
+				w.Header().Del(header)
+			}
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(recorder, r)
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// panicServer serves handler behind recoverHandler, with request IDs as in
+// the real chain.
+func panicServer(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(requestIDHandler(recoverHandler(handler)))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestRecoverBeforeWrite(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	server := panicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="a.txt"`)
+		w.Header().Set("ETag", `"1"`)
+		panic("boom")
+	})
+
+	resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/files/a.txt", nil))
+	if resp.StatusCode != http.StatusInternalServerError || body != "Internal server error\n" {
+		t.Errorf("panic before any write: %d %q, want 500 %q", resp.StatusCode, body, "Internal server error\n")
+	}
+	for _, header := range []string{"Content-Disposition", "ETag"} {
+		if value := resp.Header.Get(header); value != "" {
+			t.Errorf("%s %q of the failed response was sent", header, value)
+		}
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries logged, want 1", len(entries))
+	}
+	entry := entries[0]
+	if id := resp.Header.Get(requestIDHeader); id == "" || entry.Data["request_id"] != id {
+		t.Errorf("panic logged with request_id %v, want %q", entry.Data["request_id"], id)
+	}
+	if entry.Level != log.ErrorLevel || !strings.Contains(entry.Message, "GET /files/a.txt: boom") {
+		t.Errorf("logged %s %q", entry.Level, entry.Message)
+	}
+	if stack, _ := entry.Data["stack"].(string); !strings.Contains(stack, "recover_test.go") {
+		t.Errorf("logged stack does not lead to the panic:\n%s", stack)
+	}
+}
+
+func TestRecoverAfterHeaders(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	server := panicServer(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		io.WriteString(w, "partial")
+		http.NewResponseController(w).Flush()
+		panic("boom")
+	})
+
+	resp, err := testClient.Do(newRequest(t, http.MethodGet, server.URL+"/files/a.txt", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("panic after the headers: %d, want the 200 already sent", resp.StatusCode)
+	}
+	// The connection is dropped, the client cannot take the partial body
+	// for the whole file
+	body, err := io.ReadAll(resp.Body)
+	if err == nil {
+		t.Errorf("panic after the headers: got the whole response %q", body)
+	}
+	if strings.Contains(string(body), "Internal server error") {
+		t.Errorf("error message appended to the started response: %q", body)
+	}
+
+	entries := hook.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("%d entries logged, want 1", len(entries))
+	}
+	if id := resp.Header.Get(requestIDHeader); id == "" || entries[0].Data["request_id"] != id {
+		t.Errorf("panic logged with request_id %v, want %q", entries[0].Data["request_id"], id)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// renameResult is the JSON answer of POST /api/rename.
+type renameResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// renameHandler handles POST /rename and POST /api/rename with the fields
+// "from" and "to", paths relative to the served directory, so files and
+// directories can also be moved to another directory. An existing target
+// gives 409 unless "overwrite" is 1; directories are never replaced. Files
+// are copied when the rename crosses filesystems. /api/rename answers with
+// JSON, /rename redirects back to the listing ?dir=.
+func renameHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	api := r.URL.Path == "/api/rename" || wantsJSON(r)
+
+	r.Body = http.MaxBytesReader(w, r.Body, 4*maxPathLen+1024)
+	fields, err := readFields(r)
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	from, to := cleanRelPath(fields.Get("from")), cleanRelPath(fields.Get("to"))
+	fromPath, fromErr := resolvePath(r.Context(), fields.Get("from"))
+	toPath, toErr := resolvePath(r.Context(), fields.Get("to"))
+	if fromErr != nil || toErr != nil || from == "" || to == "" {
+		logger.Warnf("Rejected rename of %q to %q: invalid path", fields.Get("from"), fields.Get("to"))
+		http.Error(w, "Invalid path in from or to", http.StatusBadRequest)
+		return
+	}
+	if _, err := validateDirName(to); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid target name: %v", err), http.StatusBadRequest)
+		return
+	}
+	overwrite := fields.Get("overwrite") == "1"
+
+	srcInfo, err := os.Lstat(fromPath)
+	if err != nil || srcInfo.IsDir() && !isServableDir(from) || !srcInfo.IsDir() && !isServable(from) {
+		http.Error(w, "Source not found", http.StatusNotFound)
+		return
+	}
+	if srcInfo.IsDir() && !isServableDir(to) || !srcInfo.IsDir() && !isServable(to) {
+		logger.Warnf("Rejected rename of %s to hidden or excluded %s", from, to)
+		http.Error(w, "Hidden or excluded targets are not accepted", http.StatusForbidden)
+		return
+	}
+	if srcInfo.IsDir() && (to == from || strings.HasPrefix(to, from+"/")) {
+		http.Error(w, "Cannot move a directory into itself", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(toPath)); err != nil || !info.IsDir() {
+		http.Error(w, "Target directory does not exist", http.StatusNotFound)
+		return
+	}
+	dstInfo, err := os.Lstat(toPath)
+	// The target is the source itself when only the case changes on a
+	// case-insensitive filesystem, which a plain rename handles
+	sameFile := err == nil && os.SameFile(srcInfo, dstInfo)
+	if err == nil && !sameFile && (!overwrite || dstInfo.IsDir() || srcInfo.IsDir()) {
+		logger.Warnf("Rejected rename of %s to %s: target exists", from, to)
+		http.Error(w, fmt.Sprintf("%s already exists", to), http.StatusConflict)
+		return
+	}
+
+	var replaced int64
+	if err == nil && !sameFile {
+		replaced = usage(toPath, dstInfo)
+	}
+	if err := moveFile(r.Context(), fromPath, toPath, srcInfo, overwrite || sameFile); err != nil {
+		if errors.Is(err, errFileExists) {
+			http.Error(w, fmt.Sprintf("%s already exists", to), http.StatusConflict)
+			return
+		}
+		logger.Errorf("Could not rename %s to %s: %v", fromPath, toPath, err)
+		http.Error(w, "Could not rename", http.StatusInternalServerError)
+		return
+	}
+	quotaRelease(replaced)
+	invalidateListing(filepath.Dir(fromPath))
+	invalidateListing(filepath.Dir(toPath))
+	invalidateListing(fromPath)
+	logger.Infof("Renamed %s -> %s", from, to)
+
+	if api {
+		writeJSON(w, r, http.StatusOK, renameResult{From: from, To: to})
+		return
+	}
+	http.Redirect(w, r, returnURL(r, cleanRelPath(r.URL.Query().Get("dir"))), http.StatusSeeOther)
+}
+
+// moveFile renames fromPath to toPath, replacing an existing file only if
+// overwrite is set. Across filesystems, files are copied to a temporary file
+// next to the target, with their mode, time and user.* extended attributes,
+// placed, and only then removed at the source.
+func moveFile(ctx context.Context, fromPath, toPath string, srcInfo os.FileInfo, overwrite bool) error {
+	var err error
+	if overwrite {
+		err = os.Rename(fromPath, toPath)
+	} else {
+		err = placeNoClobber(fromPath, toPath)
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if !srcInfo.Mode().IsRegular() {
+		return fmt.Errorf("only files can be moved across filesystems: %w", err)
+	}
+
+	src, err := os.Open(fromPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := createPartialFile(filepath.Dir(toPath), filepath.Base(toPath))
+	if err != nil {
+		return err
+	}
+	tmpPath := dst.Name()
+	buf := copyBuffers.Get().(*[]byte)
+	_, err = io.CopyBuffer(struct{ io.Writer }{dst}, src, *buf)
+	copyBuffers.Put(buf)
+	if err == nil {
+		err = dst.Chmod(srcInfo.Mode().Perm())
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = copyXattrs(fromPath, tmpPath)
+	}
+	if err == nil {
+		// Keep the modification time, which the listing shows and sorts by
+		err = os.Chtimes(tmpPath, srcInfo.ModTime(), srcInfo.ModTime())
+	}
+	if err == nil {
+		policy := conflictReject
+		if overwrite {
+			policy = conflictOverwrite
+		}
+		_, err = placeUploadFile(tmpPath, filepath.Dir(toPath), filepath.Base(toPath), policy)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	loggerFrom(ctx).Debugf("Copied %s to %s across filesystems", fromPath, toPath)
+	return os.Remove(fromPath)
+}
+
+// fileResult describes what happened to one file of a move or delete
+// request.
+type fileResult struct {
+	Name   string `json:"name"`
+	To     string `json:"to,omitempty"` // Relative to the served directory
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+
+	// Entries below a deleted directory, or one not deleted for them
+	Entries int `json:"entries,omitempty"`
+}
+
+// moveHandler handles POST /move: it moves the files selected with the
+// listing's checkboxes ("files" or "files[]") into the directory "dest",
+// which the web UI sends in the HX-Prompt header. Every file is moved on its
+// own and gets its own status; the overall status follows uploadStatus.
+func moveHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	// An empty dest is the served directory itself, so it must be given
+	dest := r.PostForm.Get("dest")
+	switch {
+	case r.PostForm.Has("dest"):
+	case len(r.Header.Values("HX-Prompt")) > 0:
+		dest = r.Header.Get("HX-Prompt")
+	default:
+		http.Error(w, "Missing destination directory (dest)", http.StatusBadRequest)
+		return
+	}
+	relDest := cleanRelPath(dest)
+	destPath, err := resolvePath(r.Context(), dest)
+	if err != nil || !isServableDir(relDest) {
+		http.Error(w, "Invalid destination directory", http.StatusBadRequest)
+		return
+	}
+	if info, err := os.Stat(destPath); err != nil || !info.IsDir() {
+		http.Error(w, fmt.Sprintf("Destination directory /%s does not exist", relDest), http.StatusNotFound)
+		return
+	}
+
+	var results []fileResult
+	for _, value := range append(r.PostForm["files"], r.PostForm["files[]"]...) {
+		result := moveToDir(r.Context(), value, relDest, destPath)
+		if result.Error != "" {
+			logger.Warnf("Could not move %s to /%s: %s", result.Name, relDest, result.Error)
+		} else {
+			logger.Infof("Moved %s -> %s", result.Name, result.To)
+		}
+		results = append(results, result)
+	}
+	if len(results) == 0 {
+		http.Error(w, "No files selected", http.StatusBadRequest)
+		return
+	}
+
+	// Same rules as for uploads, on the statuses of the failed moves
+	status := fileStatus(results)
+	if wantsJSON(r) {
+		writeJSON(w, r, status, results)
+		return
+	}
+	if status != http.StatusOK {
+		var msg []string
+		for _, result := range results {
+			if result.Error != "" {
+				msg = append(msg, fmt.Sprintf("Not moved: %s (%s)", result.Name, result.Error))
+			} else {
+				msg = append(msg, fmt.Sprintf("Moved: %s", result.Name))
+			}
+		}
+		http.Error(w, strings.Join(msg, "\n"), status)
+		return
+	}
+	w.Header().Set("HX-Refresh", "true")
+	http.Redirect(w, r, returnURL(r, cleanRelPath(r.URL.Query().Get("dir"))), http.StatusSeeOther)
+}
+
+// moveToDir moves the file named by the form value into destPath, the
+// directory relDest.
+func moveToDir(ctx context.Context, value, relDest, destPath string) fileResult {
+	logger := loggerFrom(ctx)
+	name, err := decodeFormPath(value)
+	if err != nil {
+		return fileResult{Name: value, Status: http.StatusBadRequest, Error: "invalid name"}
+	}
+	from := cleanRelPath(name)
+	fromPath, err := resolvePath(ctx, name)
+	if err != nil || from == "" {
+		return fileResult{Name: name, Status: http.StatusBadRequest, Error: "invalid name"}
+	}
+	srcInfo, err := os.Lstat(fromPath)
+	if err != nil || srcInfo.IsDir() && !isServableDir(from) || !srcInfo.IsDir() && !isServable(from) {
+		return fileResult{Name: from, Status: http.StatusNotFound, Error: "source not found"}
+	}
+	to := path.Join(relDest, path.Base(from))
+	if srcInfo.IsDir() && (relDest == from || strings.HasPrefix(relDest, from+"/")) {
+		return fileResult{Name: from, Status: http.StatusBadRequest, Error: "cannot move a directory into itself"}
+	}
+	if to == from {
+		return fileResult{Name: from, Status: http.StatusConflict, Error: "already in the destination"}
+	}
+	if srcInfo.IsDir() && !isServableDir(to) || !srcInfo.IsDir() && !isServable(to) {
+		return fileResult{Name: from, Status: http.StatusForbidden, Error: "excluded in the destination"}
+	}
+
+	toPath := filepath.Join(destPath, filepath.Base(fromPath))
+	err = moveFile(ctx, fromPath, toPath, srcInfo, false)
+	switch {
+	case err == nil:
+		invalidateListing(filepath.Dir(fromPath))
+		invalidateListing(destPath)
+		return fileResult{Name: from, To: to, Status: http.StatusOK}
+	case errors.Is(err, errFileExists):
+		return fileResult{Name: from, Status: http.StatusConflict, Error: "destination exists"}
+	case os.IsPermission(err):
+		return fileResult{Name: from, Status: http.StatusForbidden, Error: "permission denied"}
+	default:
+		logger.Errorf("Could not move %s to %s: %v", fromPath, toPath, err)
+		return fileResult{Name: from, Status: http.StatusInternalServerError, Error: "could not move file"}
+	}
+}
+
+// fileStatus is uploadStatus for the results of a move or delete request.
+func fileStatus(results []fileResult) int {
+	uploads := make([]uploadResult, len(results))
+	for i, result := range results {
+		uploads[i] = uploadResult{Error: result.Error, status: result.Status}
+	}
+	return uploadStatus(uploads)
+}
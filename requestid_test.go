@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandlersLogRequestID(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		req  func(server *httptest.Server) *http.Request
+	}{
+		{"mkdir", nil, func(server *httptest.Server) *http.Request {
+			return postForm(t, server.URL+"/mkdir", url.Values{"dir": {"new"}})
+		}},
+		{"rejected mkdir", nil, func(server *httptest.Server) *http.Request {
+			return postForm(t, server.URL+"/mkdir", url.Values{"dir": {"a\tb"}})
+		}},
+		{"rename", nil, func(server *httptest.Server) *http.Request {
+			return postForm(t, server.URL+"/rename", url.Values{"from": {"a.txt"}, "to": {"b.txt"}})
+		}},
+		{"rejected rename", nil, func(server *httptest.Server) *http.Request {
+			return postForm(t, server.URL+"/rename", url.Values{"from": {""}, "to": {"c.txt"}})
+		}},
+		{"DELETE", nil, func(server *httptest.Server) *http.Request {
+			return newRequest(t, http.MethodDelete, fileURL(server, "a.txt"), nil)
+		}},
+		{"listing error", nil, func(server *httptest.Server) *http.Request {
+			return newRequest(t, http.MethodGet, server.URL+"/?dir=..%2Fx", nil)
+		}},
+		{"read-only rejection", []string{"--read-only"}, func(server *httptest.Server) *http.Request {
+			return newRequest(t, http.MethodDelete, fileURL(server, "a.txt"), nil)
+		}},
+		{"upload-only rejection", []string{"--upload-only"}, func(server *httptest.Server) *http.Request {
+			return newRequest(t, http.MethodGet, fileURL(server, "a.txt"), nil)
+		}},
+	} {
+		server, dir := newTestServer(t, tc.args...)
+		writeFile(t, dir, "a.txt", "a")
+		hook.Reset()
+		resp, _ := send(t, tc.req(server))
+		id := resp.Header.Get(requestIDHeader)
+		if id == "" {
+			t.Errorf("%s: no %s header", tc.name, requestIDHeader)
+		}
+		if len(hook.AllEntries()) == 0 {
+			t.Errorf("%s: nothing logged", tc.name)
+		}
+		for _, entry := range hook.AllEntries() {
+			if entry.Data["request_id"] != id {
+				t.Errorf("%s: %q logged with request_id %v, want %q", tc.name, entry.Message, entry.Data["request_id"], id)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	rootProbeInterval    = 5 * time.Second
+	rootSummaryInterval  = time.Minute
+	maintenanceRetrySecs = 10
+)
+
+// rootState tracks whether the served directory is reachable. When the
+// filesystem holding it goes away (unplugged USB drive, stale NFS mount) the
+// server switches to a degraded state and answers 503 until it comes back.
+type rootState struct {
+	mu          sync.Mutex
+	degraded    bool
+	lastErr     error
+	since       time.Time
+	rejected    int
+	lastSummary time.Time
+}
+
+var root rootState
+
+// isRootUnavailableErr reports whether err may mean the root itself is gone,
+// as opposed to an ordinary per-file error.
+func isRootUnavailableErr(err error) bool {
+	return errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ESTALE) ||
+		errors.Is(err, syscall.EIO) || errors.Is(err, syscall.ENOTDIR)
+}
+
+// check probes the root directory and updates the degraded state,
+// logging only the transitions. It returns true when the root is usable.
+func (s *rootState) check() bool {
+	info, err := os.Stat(C.DirpathToServe)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", C.DirpathToServe)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		if !s.degraded {
+			log.Errorf("Served directory %s became unavailable, entering degraded mode: %v", C.DirpathToServe, err)
+			s.degraded = true
+			s.since = time.Now()
+			s.rejected = 0
+			s.lastSummary = time.Now()
+		}
+		s.lastErr = err
+		return false
+	}
+	if s.degraded {
+		log.Infof("Served directory %s is available again after %s (%d requests rejected meanwhile)",
+			C.DirpathToServe, time.Since(s.since).Round(time.Second), s.rejected)
+		s.degraded = false
+		s.lastErr = nil
+	}
+	return true
+}
+
+// available reports the last known state without touching the filesystem.
+func (s *rootState) available() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.degraded
+}
+
+// reject counts a request refused while degraded, logging a summary at most
+// once per rootSummaryInterval instead of one error per request.
+func (s *rootState) reject() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rejected++
+	if time.Since(s.lastSummary) >= rootSummaryInterval {
+		log.Warnf("Served directory still unavailable since %s (%v), %d requests rejected so far",
+			s.since.Format("2006-01-02 15:04:05"), s.lastErr, s.rejected)
+		s.lastSummary = time.Now()
+	}
+}
+
+// startRootProbe checks the root periodically so that the server recovers
+// by itself once the filesystem returns.
+func startRootProbe() {
+	root.check()
+	go func() {
+		for range time.Tick(rootProbeInterval) {
+			root.check()
+		}
+	}()
+}
+
+// rootGuard answers requests with a 503 maintenance page while the root is
+// unavailable. /healthz is always passed through.
+func rootGuard(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" || root.available() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		root.reject()
+		writeMaintenance(w)
+	})
+}
+
+// writeMaintenance sends the 503 page, which reloads itself periodically.
+func writeMaintenance(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", fmt.Sprintf("%d", maintenanceRetrySecs))
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintf(w, maintenanceHTML, maintenanceRetrySecs)
+}
+
+// healthzHandler reports whether the served directory is available, and the
+// limit of downloads in effect.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	root.mu.Lock()
+	status := map[string]interface{}{"status": "ok", "lowMemory": C.LowMemory}
+	if bandwidth := bandwidthStatus(); bandwidth != nil {
+		status["bandwidth"] = bandwidth
+	}
+	if root.degraded {
+		status["status"] = "degraded"
+		status["since"] = root.since.Format(time.RFC3339)
+		status["error"] = root.lastErr.Error()
+	}
+	degraded := root.degraded
+	root.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if degraded {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+const maintenanceHTML = `<!DOCTYPE html>
+<html>
+<head>
+    <title>File Server - Unavailable</title>
+    <meta http-equiv="refresh" content="%d">
+    <style>body { font-family: sans-serif; } .container { max-width: 800px; margin: auto; padding: 20px; }</style>
+</head>
+<body>
+    <div class="container">
+        <h1>Temporarily unavailable</h1>
+        <p>The shared directory is currently not reachable. This page will retry automatically.</p>
+    </div>
+</body>
+</html>
+`
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// validateServePatterns checks the --include and --exclude globs, so that a
+// typo fails at startup instead of silently hiding or exposing files.
+func validateServePatterns() error {
+	for _, flag := range []struct {
+		name     string
+		patterns []string
+	}{{"--include", C.Includes}, {"--exclude", C.Excludes}} {
+		for _, pattern := range flag.patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid %s pattern %q: %v", flag.name, pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// matchesAny reports whether rel matches one of patterns. Patterns with a
+// slash match the whole path relative to the served directory, others
+// only its last element, so "*.iso" matches in every subdirectory.
+func matchesAny(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		target := path.Base(rel)
+		if strings.Contains(pattern, "/") {
+			target = rel
+		}
+		if matched, _ := path.Match(pattern, target); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// isServableDir reports whether the directory rel, relative to the served
+// directory, may be listed and entered: it must not be hidden, the trash,
+// nor be or lie inside an excluded path. --include only applies to files.
+func isServableDir(rel string) bool {
+	rel = cleanRelPath(rel)
+	if rel == "" {
+		return true
+	}
+	if isHiddenPath(rel) || isTrashPath(rel) {
+		return false
+	}
+	prefix := ""
+	for _, name := range strings.Split(rel, "/") {
+		prefix = path.Join(prefix, name)
+		if matchesAny(C.Excludes, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// isServable reports whether the file rel, relative to the served
+// directory, may be listed, downloaded, deleted or uploaded. Every handler
+// consults it, so that a file left out of the listing cannot be fetched
+// directly either. --exclude wins over --include.
+func isServable(rel string) bool {
+	rel = cleanRelPath(rel)
+	if rel == "" || !isServableDir(rel) {
+		return false
+	}
+	return len(C.Includes) == 0 || matchesAny(C.Includes, rel)
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestServePatternsWithDirectories(t *testing.T) {
+	loadConfig(t,
+		"--include", "*.iso", "--include", "docs/*.pdf",
+		"--exclude", "build/*", "--exclude", "*/secret.iso", "--exclude", "tmp")
+	if err := validateServePatterns(); err != nil {
+		t.Fatal(err)
+	}
+
+	for rel, want := range map[string]bool{
+		"disk.iso":             true,
+		"images/disk.iso":      true, // Patterns without a slash match the name in every directory
+		"notes.txt":            false,
+		"docs/manual.pdf":      true,
+		"docs/old/manual.pdf":  false, // * does not match a slash
+		"manual.pdf":           false,
+		"other/docs/guide.pdf": false, // Patterns with a slash match from the served directory
+		"build/disk.iso":       false, // Exclude wins over include
+		"build/sub/disk.iso":   false, // Also below an excluded directory
+		"images/secret.iso":    false,
+		"images/a/secret.iso":  true,
+		"secret.iso":           true,
+		"tmp/disk.iso":         false,
+		"a/tmp/disk.iso":       false,
+		"tmpfile.iso":          true,
+		".hidden.iso":          false,
+		"images/.cache/a.iso":  false,
+	} {
+		if got := isServable(rel); got != want {
+			t.Errorf("isServable(%q) = %t, want %t", rel, got, want)
+		}
+	}
+
+	// --include only applies to files, so that matching files in
+	// subdirectories can be reached
+	for rel, want := range map[string]bool{
+		"":          true,
+		"docs":      true,
+		"images/a":  true,
+		"build":     true,
+		"build/sub": false,
+		"tmp":       false,
+		"a/tmp":     false,
+		".git":      false,
+	} {
+		if got := isServableDir(rel); got != want {
+			t.Errorf("isServableDir(%q) = %t, want %t", rel, got, want)
+		}
+	}
+}
+
+func TestInvalidServePatterns(t *testing.T) {
+	for _, args := range [][]string{{"--include", "[a-"}, {"--exclude", "docs/[*.pdf"}} {
+		loadConfig(t, args...)
+		if err := validateServePatterns(); err == nil {
+			t.Errorf("%v was accepted", args)
+		}
+	}
+}
+
+func TestDeleteRespectsServePatterns(t *testing.T) {
+	server, dir := newTestServer(t, "--include", "*.iso", "--exclude", "private/*")
+	for _, rel := range []string{"disk.iso", "secret.txt", "private/disk.iso", "sub/notes.txt"} {
+		writeFile(t, dir, rel, "x")
+	}
+
+	for rel, want := range map[string]int{
+		"secret.txt":       http.StatusNotFound,
+		"private/disk.iso": http.StatusNotFound,
+		"sub/notes.txt":    http.StatusNotFound,
+		"sub":              http.StatusConflict, // A directory, not empty
+		"disk.iso":         http.StatusNoContent,
+	} {
+		if resp, _ := send(t, newRequest(t, http.MethodDelete, fileURL(server, rel), nil)); resp.StatusCode != want {
+			t.Errorf("DELETE %s: %d, want %d", rel, resp.StatusCode, want)
+		}
+	}
+	send(t, postForm(t, server.URL+"/delete", url.Values{"files": {encodeFormPath("secret.txt"), encodeFormPath("private/disk.iso")}}))
+
+	for _, rel := range []string{"secret.txt", "private/disk.iso", "sub/notes.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(rel))); err != nil {
+			t.Errorf("%s, which is not served, was deleted", rel)
+		}
+	}
+}
+
+func TestMoveRespectsServePatterns(t *testing.T) {
+	server, dir := newTestServer(t, "--include", "*.iso", "--exclude", "dest/old")
+	for _, rel := range []string{"disk.iso", "notes.txt", "isos/a.iso", "old/b.iso", "dest/keep.iso"} {
+		writeFile(t, dir, rel, "x")
+	}
+
+	for _, tc := range []struct {
+		name, dest string
+		want       int
+		moved      string // Where the file is afterwards, if moved
+	}{
+		{"isos", "dest", http.StatusOK, "dest/isos/a.iso"}, // --include only applies to files
+		{"disk.iso", "dest", http.StatusOK, "dest/disk.iso"},
+		{"notes.txt", "dest", http.StatusNotFound, ""},
+		{"old", "dest", http.StatusForbidden, ""},
+	} {
+		form := url.Values{"files": {encodeFormPath(tc.name)}, "dest": {tc.dest}}
+		if resp, body := send(t, postForm(t, server.URL+"/move?json=1", form)); resp.StatusCode != tc.want {
+			t.Errorf("move %s to %s: %d %q, want %d", tc.name, tc.dest, resp.StatusCode, body, tc.want)
+		}
+		if tc.moved == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(tc.moved))); err != nil {
+			t.Errorf("move %s to %s: %v", tc.name, tc.dest, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "notes.txt")); err != nil {
+		t.Errorf("notes.txt, which is not served, was moved: %v", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// humanSize formats a byte count with the largest fitting unit and one
+// decimal, e.g. "3.2 KB" or "11.7 GB". Units are 1024-based unless --si is
+// set, in which case they are 1000-based.
+func humanSize(bytes int64) string {
+	base := int64(1024)
+	if C.SIUnits {
+		base = 1000
+	}
+	if bytes < base {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	units := []string{"KB", "MB", "GB", "TB", "PB", "EB"}
+	value := float64(bytes) / float64(base)
+	unit := 0
+	// Move up while the value would print as base or more, so that
+	// e.g. 1048575 bytes shows as "1.0 MB" and not "1024.0 KB"
+	for value >= float64(base)-0.05 && unit < len(units)-1 {
+		value /= float64(base)
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+// sizeUnits are the units accepted by parseSize, upper-cased: powers of
+// 1000, or of 1024 with "i".
+var sizeUnits = map[string]float64{
+	"": 1, "B": 1, "KB": 1e3, "MB": 1e6, "GB": 1e9, "TB": 1e12,
+	"K": 1e3, "M": 1e6, "G": 1e9, "T": 1e12,
+	"KIB": 1 << 10, "MIB": 1 << 20, "GIB": 1 << 30, "TIB": 1 << 40,
+}
+
+// parseSize parses a size like "500MB", "2GiB" or "1024" (bytes). An empty
+// value is 0.
+func parseSize(value string) (int64, error) {
+	if strings.TrimSpace(value) == "" {
+		return 0, nil
+	}
+	amount, unit, err := splitQuantity(value)
+	factor, ok := sizeUnits[strings.ToUpper(unit)]
+	if !ok || err != nil {
+		return 0, fmt.Errorf("invalid size %q, expected e.g. 500MB or 2GiB", value)
+	}
+	return int64(amount * factor), nil
+}
+
+// splitQuantity splits a value like "10 MB" into its non-negative number
+// and its unit.
+func splitQuantity(value string) (float64, string, error) {
+	value = strings.TrimSpace(value)
+	end := strings.IndexFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if end < 0 {
+		end = len(value)
+	}
+	amount, err := strconv.ParseFloat(value[:end], 64)
+	return amount, strings.TrimSpace(value[end:]), err
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestHumanSize(t *testing.T) {
+	for _, tc := range []struct {
+		si    bool
+		bytes int64
+		want  string
+	}{
+		{false, 0, "0 B"},
+		{false, 1023, "1023 B"},
+		{false, 1024, "1.0 KB"},
+		{false, 1075, "1.0 KB"},
+		{false, 1076, "1.1 KB"},
+		{false, 1048524, "1023.9 KB"},
+		{false, 1048525, "1.0 MB"}, // Would print as 1024.0 KB
+		{false, 1<<20 - 1, "1.0 MB"},
+		{false, 1 << 20, "1.0 MB"},
+		{false, 1<<30 - 1, "1.0 GB"},
+		{false, 1 << 30, "1.0 GB"},
+		{false, 5 << 40, "5.0 TB"},
+		{false, 1 << 50, "1.0 PB"},
+		{false, 1 << 60, "1.0 EB"},
+		{false, math.MaxInt64, "8.0 EB"},
+		{true, 999, "999 B"},
+		{true, 1000, "1.0 KB"},
+		{true, 1023, "1.0 KB"},
+		{true, 1024, "1.0 KB"},
+		{true, 999949, "999.9 KB"},
+		{true, 999951, "1.0 MB"},
+		{true, 1000000, "1.0 MB"},
+		{true, 1 << 20, "1.0 MB"},
+		{true, 1e9, "1.0 GB"},
+		{true, 1.5e12, "1.5 TB"},
+		{true, math.MaxInt64, "9.2 EB"},
+	} {
+		C.SIUnits = tc.si
+		if got := humanSize(tc.bytes); got != tc.want {
+			t.Errorf("humanSize(%d) with --si=%t = %q, want %q", tc.bytes, tc.si, got, tc.want)
+		}
+	}
+}
+
+func TestSIFlag(t *testing.T) {
+	loadConfig(t, "--si")
+	if got := humanSize(1000); got != "1.0 KB" {
+		t.Errorf("humanSize(1000) with --si = %q, want 1.0 KB", got)
+	}
+	loadConfig(t)
+	if got := humanSize(1000); got != "1000 B" {
+		t.Errorf("humanSize(1000) = %q, want 1000 B", got)
+	}
+}
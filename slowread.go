@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// errFirstByteDeadline is returned when a file could not be read within
+// --first-byte-deadline.
+var errFirstByteDeadline = errors.New("storage did not deliver the first byte in time")
+
+// storedFile is a file opened for download: an *os.File, or in tests a
+// fake storage with scripted delays.
+type storedFile interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+	Stat() (os.FileInfo, error)
+}
+
+// openStored opens a file for download.
+var openStored = func(filePath string) (storedFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// openedFile is a file opened for download together with the time it took
+// until its first byte was available.
+type openedFile struct {
+	file    storedFile
+	info    os.FileInfo
+	latency time.Duration
+	err     error
+}
+
+// openForServing opens filePath and reads its first byte, which is when a
+// dying disk usually stalls. Slow reads are logged beyond
+// --slow-read-threshold. With --first-byte-deadline, errFirstByteDeadline is
+// returned once it passes; nothing has been sent to the client by then, so
+// no started transfer is ever cut off.
+func openForServing(ctx context.Context, filePath string) (storedFile, os.FileInfo, error) {
+	if C.FirstByteDeadline <= 0 {
+		opened := openFirstByte(filePath)
+		logSlowRead(ctx, filePath, opened)
+		return opened.file, opened.info, opened.err
+	}
+
+	done := make(chan openedFile, 1)
+	go func() { done <- openFirstByte(filePath) }()
+	select {
+	case opened := <-done:
+		logSlowRead(ctx, filePath, opened)
+		return opened.file, opened.info, opened.err
+	case <-time.After(C.FirstByteDeadline):
+		loggerFrom(ctx).Warnf("Slow storage: no data from %s after %s, giving up", filePath, C.FirstByteDeadline)
+		go func() {
+			// Clean up whenever the storage finally answers
+			opened := <-done
+			logSlowRead(ctx, filePath, opened)
+			if opened.file != nil {
+				opened.file.Close()
+			}
+		}()
+		return nil, nil, errFirstByteDeadline
+	}
+}
+
+// openFirstByte opens filePath and, unless it is a directory, waits for
+// its first byte.
+func openFirstByte(filePath string) openedFile {
+	start := time.Now()
+	file, err := openStored(filePath)
+	if err != nil {
+		return openedFile{err: err, latency: time.Since(start)}
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return openedFile{err: err, latency: time.Since(start)}
+	}
+	if !info.IsDir() {
+		var first [1]byte
+		if _, err := file.ReadAt(first[:], 0); err != nil && err != io.EOF {
+			file.Close()
+			return openedFile{err: err, latency: time.Since(start)}
+		}
+	}
+	return openedFile{file: file, info: info, latency: time.Since(start)}
+}
+
+// logSlowRead warns when opening a file took longer than --slow-read-threshold.
+func logSlowRead(ctx context.Context, filePath string, opened openedFile) {
+	if C.SlowReadThreshold <= 0 || opened.latency < C.SlowReadThreshold {
+		return
+	}
+	hint := ""
+	if opened.info != nil {
+		hint = " on " + deviceHint(opened.info)
+	}
+	loggerFrom(ctx).Warnf("Slow storage: first byte of %s%s took %s", filePath, hint, opened.latency.Round(time.Millisecond))
+}
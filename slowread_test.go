@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+// slowFile is a file of a fake storage, waiting before its first byte and
+// before every read.
+type slowFile struct {
+	*os.File
+	firstByte, perRead time.Duration
+	closed             chan struct{}
+}
+
+func (f *slowFile) ReadAt(p []byte, off int64) (int, error) {
+	time.Sleep(f.firstByte)
+	return f.File.ReadAt(p, off)
+}
+
+func (f *slowFile) Read(p []byte) (int, error) {
+	time.Sleep(f.perRead)
+	return f.File.Read(p)
+}
+
+func (f *slowFile) Close() error {
+	close(f.closed)
+	return f.File.Close()
+}
+
+// slowStorage makes downloads wait open before opening a file, and then as
+// slowFile. The returned channel is closed when the file is.
+func slowStorage(t *testing.T, open, firstByte, perRead time.Duration) <-chan struct{} {
+	t.Helper()
+	closed := make(chan struct{})
+	orig := openStored
+	t.Cleanup(func() { openStored = orig })
+	openStored = func(filePath string) (storedFile, error) {
+		time.Sleep(open)
+		file, err := os.Open(filePath)
+		if err != nil {
+			return nil, err
+		}
+		return &slowFile{File: file, firstByte: firstByte, perRead: perRead, closed: closed}, nil
+	}
+	return closed
+}
+
+// slowReadWarnings returns the slow storage warnings logged.
+func slowReadWarnings(hook *test.Hook) []*log.Entry {
+	var warnings []*log.Entry
+	for _, entry := range hook.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.HasPrefix(entry.Message, "Slow storage") {
+			warnings = append(warnings, entry)
+		}
+	}
+	return warnings
+}
+
+func TestSlowReadThreshold(t *testing.T) {
+	hook := test.NewGlobal()
+	t.Cleanup(func() { log.StandardLogger().ReplaceHooks(make(log.LevelHooks)) })
+	server, dir := newTestServer(t, "--slow-read-threshold", "50ms", "--first-byte-deadline", "0")
+	writeFile(t, dir, "a.txt", "hello")
+
+	for _, tc := range []struct {
+		name            string
+		open, firstByte time.Duration
+		warned          bool
+	}{
+		{"fast", 0, 0, false},
+		{"slow open", 100 * time.Millisecond, 0, true},
+		{"slow first byte", 0, 100 * time.Millisecond, true},
+	} {
+		slowStorage(t, tc.open, tc.firstByte, 0)
+		hook.Reset()
+		resp, body := send(t, newRequest(t, http.MethodGet, fileURL(server, "a.txt"), nil))
+		if resp.StatusCode != http.StatusOK || body != "hello" {
+			t.Errorf("%s: %d %q, want 200 %q", tc.name, resp.StatusCode, body, "hello")
+		}
+		warnings := slowReadWarnings(hook)
+		if warned := len(warnings) > 0; warned != tc.warned {
+			t.Errorf("%s: warned %t, want %t", tc.name, warned, tc.warned)
+			continue
+		}
+		if tc.warned && !strings.Contains(warnings[0].Message, "first byte of "+dir) {
+			t.Errorf("%s: warning %q does not name the file", tc.name, warnings[0].Message)
+		}
+	}
+}
+
+func TestFirstByteDeadline(t *testing.T) {
+	server, dir := newTestServer(t, "--first-byte-deadline", "100ms")
+	writeFile(t, dir, "a.txt", "hello")
+	closed := slowStorage(t, 0, time.Second, 0)
+
+	start := time.Now()
+	resp, body := send(t, newRequest(t, http.MethodGet, fileURL(server, "a.txt"), nil))
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Errorf("answered after %s, the deadline is 100ms", elapsed)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" {
+		t.Errorf("past the deadline: %d Retry-After %q %q, want 503 with Retry-After",
+			resp.StatusCode, resp.Header.Get("Retry-After"), body)
+	}
+	// The file is closed once the storage finally answers
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the late file was not closed")
+	}
+}
+
+func TestFirstByteDeadlineSparesStartedTransfers(t *testing.T) {
+	server, dir := newTestServer(t, "--first-byte-deadline", "100ms")
+	content := strings.Repeat("x", 256<<10)
+	writeFile(t, dir, "big.bin", content)
+	// Each read is fast enough, all of them take longer than the deadline
+	slowStorage(t, 0, 0, 20*time.Millisecond)
+
+	start := time.Now()
+	resp, body := send(t, newRequest(t, http.MethodGet, fileURL(server, "big.bin"), nil))
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Fatalf("the download took %s, not longer than the deadline", elapsed)
+	}
+	if resp.StatusCode != http.StatusOK || body != content {
+		t.Errorf("started transfer: %d with %d of %d bytes", resp.StatusCode, len(body), len(content))
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import "net/http"
+
+// serverStats is the answer of GET /api/stats.
+type serverStats struct {
+	ActiveUploads        int64  `json:"activeUploads"`
+	MaxConcurrentUploads int    `json:"maxConcurrentUploads,omitempty"` // 0 = unlimited
+	FreeBytes            *int64 `json:"freeBytes,omitempty"`            // On the filesystem of the served directory
+	MinFreeBytes         int64  `json:"minFreeBytes,omitempty"`         // --min-free-space
+	QuotaUsedBytes       *int64 `json:"quotaUsedBytes,omitempty"`       // Size of the served directory
+	QuotaBytes           int64  `json:"quotaBytes,omitempty"`           // --quota
+
+	// Totals of the served directory, left out while they are first computed
+	Files     *int64 `json:"files,omitempty"`
+	UsedBytes *int64 `json:"usedBytes,omitempty"`
+}
+
+// apiStatsHandler serves GET /api/stats, figures about the running server.
+func apiStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	stats := serverStats{
+		ActiveUploads:        activeUploads.Load(),
+		MaxConcurrentUploads: C.MaxConcurrentUploads,
+		MinFreeBytes:         minFreeSpace,
+	}
+	if free, err := freeSpace(C.DirpathToServe); err == nil {
+		stats.FreeBytes = &free
+	}
+	if totals, ok := currentTotals(); ok {
+		stats.Files, stats.UsedBytes = &totals.Files, &totals.Bytes
+	}
+	if used, limit, ok := quotaUsage(); ok {
+		stats.QuotaUsedBytes, stats.QuotaBytes = &used, limit
+	}
+	writeJSON(w, r, http.StatusOK, stats)
+}
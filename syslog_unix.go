@@ -0,0 +1,117 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+	"net/url"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// syslogTag is the tag of the messages sent to syslog.
+const syslogTag = "hfs"
+
+// syslogRetryInterval is how long entries are dropped after syslog could
+// not be reached, before connecting again.
+const syslogRetryInterval = 30 * time.Second
+
+// syslogWriter sends log entries to syslog with the severity of their
+// level. If syslog cannot be reached, entries are dropped with a single
+// warning on the other outputs, and the connection is retried every
+// syslogRetryInterval: logging must never stop the server.
+type syslogWriter struct {
+	network, addr string // Empty for the local daemon
+
+	mu        sync.Mutex
+	writer    *syslog.Writer
+	lastDial  time.Time
+	degraded  bool
+	reporting bool // Logging the warning, whose own entry is dropped
+}
+
+// newSyslogWriter parses --log-syslog: "local", or network://host:port
+// with udp or tcp.
+func newSyslogWriter(target string) (*syslogWriter, error) {
+	if target == "local" {
+		return &syslogWriter{}, nil
+	}
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "udp" && u.Scheme != "tcp") || u.Host == "" {
+		return nil, fmt.Errorf("invalid --log-syslog %q, expected local, udp://host:port or tcp://host:port", target)
+	}
+	return &syslogWriter{network: u.Scheme, addr: u.Host}, nil
+}
+
+func (s *syslogWriter) Write(p []byte) (int, error) {
+	return len(p), s.WriteLevel(log.InfoLevel, p)
+}
+
+// WriteLevel sends p with the syslog severity of level.
+func (s *syslogWriter) WriteLevel(level log.Level, p []byte) error {
+	s.mu.Lock()
+	if s.reporting {
+		s.mu.Unlock()
+		return nil
+	}
+	err := s.send(level, string(p))
+	if err == nil {
+		s.degraded = false
+		s.mu.Unlock()
+		return nil
+	}
+	if s.degraded {
+		s.mu.Unlock()
+		return nil
+	}
+	s.degraded = true
+	s.reporting = true
+	s.mu.Unlock()
+
+	log.Warnf("Could not send the log to syslog, dropping entries until it is back: %v", err)
+	s.mu.Lock()
+	s.reporting = false
+	s.mu.Unlock()
+	return nil
+}
+
+// send writes message to syslog, connecting first if needed. s.mu must be
+// held.
+func (s *syslogWriter) send(level log.Level, message string) error {
+	if s.writer == nil {
+		if time.Since(s.lastDial) < syslogRetryInterval {
+			return errSyslogDown
+		}
+		s.lastDial = time.Now()
+		writer, err := syslog.Dial(s.network, s.addr, syslog.LOG_INFO|syslog.LOG_DAEMON, syslogTag)
+		if err != nil {
+			return err
+		}
+		s.writer = writer
+	}
+	var err error
+	switch level {
+	case log.PanicLevel, log.FatalLevel:
+		err = s.writer.Crit(message)
+	case log.ErrorLevel:
+		err = s.writer.Err(message)
+	case log.WarnLevel:
+		err = s.writer.Warning(message)
+	case log.InfoLevel:
+		err = s.writer.Info(message)
+	default:
+		err = s.writer.Debug(message)
+	}
+	if err != nil {
+		s.writer.Close()
+		s.writer = nil
+		s.lastDial = time.Now()
+	}
+	return err
+}
+
+// errSyslogDown is returned while waiting to connect to syslog again.
+var errSyslogDown = fmt.Errorf("syslog unreachable, retrying in %s", syslogRetryInterval)
@@ -0,0 +1,13 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// newSyslogWriter fails: Windows has no syslog daemon, use --log-file.
+func newSyslogWriter(target string) (io.Writer, error) {
+	return nil, fmt.Errorf("--log-syslog is not available on Windows, use --log-file")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultThumbWidth = 128
+	maxThumbWidth     = 512
+	thumbCacheBytes   = 16 << 20
+	thumbJPEGQuality  = 80
+)
+
+// thumbSlots bounds how many images are decoded at once, as a decoded
+// image takes several bytes per pixel.
+var thumbSlots = make(chan struct{}, 2)
+
+// thumbnails caches encoded thumbnails in memory.
+var thumbnails = newThumbCache(thumbCacheBytes)
+
+// hasThumbnail reports whether the listing should show a thumbnail for
+// name, judged by the extension only.
+func hasThumbnail(name string) bool {
+	if C.LowMemory {
+		return false
+	}
+	switch strings.ToLower(path.Ext(name)) {
+	case ".jpg", ".jpeg", ".png", ".gif":
+		return true
+	}
+	return false
+}
+
+// thumbHandler serves GET /thumb/<path>?w=<width>: a JPEG thumbnail of an
+// image, at most w pixels wide and high. Files that are no images get 404,
+// images that cannot be decoded 415, and images above --thumb-max-pixels
+// 422, so that a small file cannot make the server decode a huge image.
+func thumbHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	if C.LowMemory {
+		http.Error(w, "Thumbnails are disabled in low-memory mode", http.StatusNotFound)
+		return
+	}
+
+	relPath := strings.TrimPrefix(r.URL.Path, "/thumb/")
+	filePath, err := resolvePath(r.Context(), relPath)
+	if err != nil || !isServable(relPath) || !hasThumbnail(relPath) {
+		http.NotFound(w, r)
+		return
+	}
+	width := defaultThumbWidth
+	if value := r.URL.Query().Get("w"); value != "" {
+		width, err = strconv.Atoi(value)
+		if err != nil || width < 16 || width > maxThumbWidth {
+			http.Error(w, fmt.Sprintf("Invalid width, must be 16 to %d", maxThumbWidth), http.StatusBadRequest)
+			return
+		}
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	key := fmt.Sprintf("%s\x00%d\x00%d\x00%d", filePath, info.ModTime().UnixNano(), info.Size(), width)
+	thumb, ok := thumbnails.get(key)
+	if !ok {
+		thumb, err = makeThumbnail(filePath, width)
+		if err != nil {
+			switch {
+			case errors.Is(err, errImageTooLarge):
+				logger.Warnf("Refused thumbnail of %s: %v", filePath, err)
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			case errors.Is(err, image.ErrFormat) || errors.Is(err, errBadImage):
+				http.Error(w, "Not a readable image", http.StatusUnsupportedMediaType)
+			default:
+				logger.Errorf("Could not make thumbnail of %s: %v", filePath, err)
+				http.Error(w, "Could not make thumbnail", http.StatusInternalServerError)
+			}
+			return
+		}
+		thumbnails.put(key, thumb)
+	}
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Cache-Control", "private, max-age=3600")
+	http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(thumb))
+}
+
+var (
+	errImageTooLarge = errors.New("image too large")
+	errBadImage      = errors.New("corrupt image")
+)
+
+// makeThumbnail decodes the image at filePath and returns it as a JPEG
+// scaled down to fit width x width, keeping the aspect ratio.
+func makeThumbnail(filePath string, width int) ([]byte, error) {
+	thumbSlots <- struct{}{}
+	defer func() { <-thumbSlots }()
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// Check the dimensions from the header before decoding anything
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		return nil, err
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > C.ThumbMaxPixels {
+		return nil, fmt.Errorf("%w: %dx%d pixels, at most %d allowed", errImageTooLarge, config.Width, config.Height, C.ThumbMaxPixels)
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadImage, err)
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, width), &jpeg.Options{Quality: thumbJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown shrinks src to fit into size x size by averaging the source
+// pixels covered by each target pixel. Smaller images are not enlarged.
+func scaleDown(src image.Image, size int) image.Image {
+	bounds := src.Bounds()
+	srcW, srcH := bounds.Dx(), bounds.Dy()
+	dstW, dstH := srcW, srcH
+	if srcW > size || srcH > size {
+		if srcW >= srcH {
+			dstW, dstH = size, max(1, srcH*size/srcW)
+		} else {
+			dstW, dstH = max(1, srcW*size/srcH), size
+		}
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dstW, dstH))
+	for y := 0; y < dstH; y++ {
+		y0, y1 := y*srcH/dstH, max((y+1)*srcH/dstH, y*srcH/dstH+1)
+		for x := 0; x < dstW; x++ {
+			x0, x1 := x*srcW/dstW, max((x+1)*srcW/dstW, x*srcW/dstW+1)
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(bounds.Min.X+sx, bounds.Min.Y+sy).RGBA()
+					r, g, b, a, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca), n+1
+				}
+			}
+			dst.Set(x, y, color.RGBA64{uint16(r / n), uint16(g / n), uint16(b / n), uint16(a / n)})
+		}
+	}
+	return dst
+}
+
+// thumbCache is an LRU cache of encoded thumbnails bounded by their total size.
+type thumbCache struct {
+	mu       sync.Mutex
+	maxBytes int
+	bytes    int
+	order    *list.List // Front is the most recently used
+	items    map[string]*list.Element
+}
+
+type thumbCacheItem struct {
+	key   string
+	thumb []byte
+}
+
+func newThumbCache(maxBytes int) *thumbCache {
+	return &thumbCache{maxBytes: maxBytes, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+func (c *thumbCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(element)
+	return element.Value.(*thumbCacheItem).thumb, true
+}
+
+func (c *thumbCache) put(key string, thumb []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.items[key]; ok || len(thumb) > c.maxBytes {
+		return
+	}
+	c.items[key] = c.order.PushFront(&thumbCacheItem{key: key, thumb: thumb})
+	c.bytes += len(thumb)
+	for c.bytes > c.maxBytes {
+		oldest := c.order.Back()
+		item := oldest.Value.(*thumbCacheItem)
+		c.order.Remove(oldest)
+		delete(c.items, item.key)
+		c.bytes -= len(item.thumb)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// buildTLSConfig returns the TLS configuration for the server, or nil when
+// TLS is not enabled. Both --tls-cert and --tls-key must be given together.
+func buildTLSConfig() (*tls.Config, error) {
+	if C.TlsCertFile == "" && C.TlsKeyFile == "" {
+		return nil, nil
+	}
+	if C.TlsCertFile == "" || C.TlsKeyFile == "" {
+		return nil, fmt.Errorf("both --tls-cert and --tls-key must be given to enable TLS")
+	}
+
+	minVersion, err := parseTLSVersion(C.TlsMinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.LoadX509KeyPair(C.TlsCertFile, C.TlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load TLS certificate %s and key %s: %w", C.TlsCertFile, C.TlsKeyFile, err)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
+
+// parseTLSVersion maps the --tls-min-version value to a tls.Version* constant.
+func parseTLSVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("invalid --tls-min-version %q (valid: 1.2, 1.3)", version)
+	}
+}
+
+// serveACME serves the application over :443 with certificates obtained
+// automatically from Let's Encrypt, answering HTTP-01 challenges on :80.
+func serveACME(server *http.Server) error {
+	if C.TlsCertFile != "" || C.TlsKeyFile != "" {
+		return fmt.Errorf("--acme-domain cannot be combined with --tls-cert/--tls-key")
+	}
+	if C.AcmeCacheDir == "" {
+		return fmt.Errorf("--acme-cache-dir must not be empty when --acme-domain is set")
+	}
+	minVersion, err := parseTLSVersion(C.TlsMinVersion)
+	if err != nil {
+		return err
+	}
+
+	manager := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(C.AcmeDomains...),
+		Cache:      loggingCertCache{autocert.DirCache(C.AcmeCacheDir)},
+	}
+
+	// Bind both ports before serving anything, so we fail fast
+	httpListener, err := net.Listen("tcp", net.JoinHostPort(C.ListenIp, "80"))
+	if err != nil {
+		return fmt.Errorf("could not bind port 80 for ACME HTTP-01 challenges: %w", err)
+	}
+	httpsListener, err := net.Listen("tcp", net.JoinHostPort(C.ListenIp, "443"))
+	if err != nil {
+		httpListener.Close()
+		return fmt.Errorf("could not bind port 443: %w", err)
+	}
+
+	challengeServer := &http.Server{
+		Handler:           manager.HTTPHandler(nil),
+		ReadHeaderTimeout: server.ReadHeaderTimeout,
+		IdleTimeout:       server.IdleTimeout,
+	}
+	go func() {
+		if err := challengeServer.Serve(httpListener); err != nil && err != http.ErrServerClosed {
+			log.Errorf("ACME challenge server stopped: %v", err)
+		}
+	}()
+
+	tlsConfig := manager.TLSConfig()
+	tlsConfig.MinVersion = minVersion
+	server.TLSConfig = tlsConfig
+	for _, domain := range C.AcmeDomains {
+		log.Infof("Starting server on https://%s (ACME certificates cached in %s)", domain, C.AcmeCacheDir)
+	}
+	return server.ServeTLS(httpsListener, "", "")
+}
+
+// loggingCertCache wraps an autocert.Cache to log certificate issuance and
+// renewal, which autocert otherwise performs silently.
+type loggingCertCache struct {
+	autocert.Cache
+}
+
+// Put is called by autocert whenever a certificate (or the account key) is stored.
+func (c loggingCertCache) Put(ctx context.Context, key string, data []byte) error {
+	if err := c.Cache.Put(ctx, key, data); err != nil {
+		log.Errorf("Could not store ACME data %s: %v", key, err)
+		return err
+	}
+	if strings.HasPrefix(key, "acme_account") {
+		log.Infof("Stored ACME account key")
+	} else {
+		log.Infof("Obtained certificate for %s", key)
+	}
+	return nil
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// trashDirName is the directory inside the served directory where --trash
+// keeps deleted files, one subdirectory per delete request. It is never
+// listed or served, not even with --show-hidden.
+const trashDirName = ".hfs-trash"
+
+// trashBatchLayout names the subdirectories of the trash after the time of
+// the deletion.
+const trashBatchLayout = "20060102-150405.000"
+
+var trashTmpl = template.Must(template.New("trash").Parse(trashHTML))
+
+// trashPath returns the trash directory of the served directory.
+func trashPath() string {
+	return filepath.Join(C.DirpathToServe, trashDirName)
+}
+
+// isTrashPath reports whether rel, relative to the served directory, is or
+// lies inside the trash directory.
+func isTrashPath(rel string) bool {
+	first, _, _ := strings.Cut(cleanRelPath(rel), "/")
+	return first == trashDirName
+}
+
+// trashBatch moves the files of one delete request into the same
+// subdirectory of the trash, created on first use.
+type trashBatch struct {
+	dir string
+}
+
+// remove deletes the file rel at filePath: with --trash it is moved to the
+// trash, keeping its path below the batch directory so it can be restored.
+// Empty directories are always removed; others only with recursive, and
+// then moved to the trash as a whole. Either way, the files no longer count
+// against the quota.
+func (b *trashBatch) remove(ctx context.Context, rel, filePath string, info os.FileInfo, recursive bool) error {
+	freed := usage(filePath, info)
+	if err := b.removeFile(ctx, rel, filePath, info, recursive); err != nil {
+		return err
+	}
+	quotaRelease(freed)
+	deletesTotal.Inc()
+	return nil
+}
+
+func (b *trashBatch) removeFile(ctx context.Context, rel, filePath string, info os.FileInfo, recursive bool) error {
+	switch {
+	case info.IsDir() && !recursive:
+		return os.Remove(filePath)
+	case !C.Trash && info.IsDir():
+		return os.RemoveAll(filePath)
+	case !C.Trash:
+		return os.Remove(filePath)
+	}
+	if b.dir == "" {
+		dir, err := createTrashBatch(time.Now())
+		if err != nil {
+			return err
+		}
+		b.dir = dir
+	}
+	target := filepath.Join(b.dir, filepath.FromSlash(cleanRelPath(rel)))
+	if err := os.MkdirAll(filepath.Dir(target), newDirMode); err != nil {
+		return err
+	}
+	return moveFile(ctx, filePath, target, info, false)
+}
+
+// createTrashBatch creates the trash subdirectory for a deletion at now,
+// adding a counter to its name when another deletion got the same name.
+func createTrashBatch(now time.Time) (string, error) {
+	if err := os.MkdirAll(trashPath(), newDirMode); err != nil {
+		return "", err
+	}
+	name := now.Format(trashBatchLayout)
+	for i := 2; ; i++ {
+		dir := filepath.Join(trashPath(), name)
+		err := os.Mkdir(dir, newDirMode)
+		if err == nil {
+			return dir, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return "", err
+		}
+		name = fmt.Sprintf("%s-%d", now.Format(trashBatchLayout), i)
+	}
+}
+
+// trashItem is a file in the trash, as listed by GET /trash.
+type trashItem struct {
+	ID      string    `json:"id"`   // Batch and path, for /trash/restore and /trash/purge
+	Path    string    `json:"path"` // Where the file was, relative to the served directory
+	Size    int64     `json:"size"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// listTrash returns the files in the trash, most recently deleted first.
+func listTrash(ctx context.Context) ([]trashItem, error) {
+	batches, err := os.ReadDir(trashPath())
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var items []trashItem
+	for _, batch := range batches {
+		if !batch.IsDir() {
+			continue
+		}
+		batchPath := filepath.Join(trashPath(), batch.Name())
+		deleted := trashBatchTime(batch)
+		err := filepath.WalkDir(batchPath, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(batchPath, filePath)
+			if err != nil {
+				return err
+			}
+			item := trashItem{
+				ID:      path.Join(batch.Name(), filepath.ToSlash(rel)),
+				Path:    filepath.ToSlash(rel),
+				Deleted: deleted,
+			}
+			if info, err := d.Info(); err == nil {
+				item.Size = info.Size()
+			}
+			items = append(items, item)
+			return nil
+		})
+		if err != nil {
+			loggerFrom(ctx).Warnf("Could not read trash batch %s: %v", batchPath, err)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if !items[i].Deleted.Equal(items[j].Deleted) {
+			return items[i].Deleted.After(items[j].Deleted)
+		}
+		return items[i].ID < items[j].ID
+	})
+	return items, nil
+}
+
+// trashBatchTime returns when the files of a trash subdirectory were
+// deleted, from its name, or its modification time for a foreign name.
+func trashBatchTime(batch fs.DirEntry) time.Time {
+	name := batch.Name()
+	if len(name) >= len(trashBatchLayout) {
+		if deleted, err := time.ParseInLocation(trashBatchLayout, name[:len(trashBatchLayout)], time.Local); err == nil {
+			return deleted
+		}
+	}
+	if info, err := batch.Info(); err == nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+// resolveTrashItem turns the ID of a trashed file into its path in the
+// trash and the path it was deleted from, relative to the served directory.
+func resolveTrashItem(ctx context.Context, id string) (trashFile, origin string, err error) {
+	trashFile, err = resolveInRoot(ctx, trashPath(), id)
+	if err != nil {
+		return "", "", err
+	}
+	batch, origin, ok := strings.Cut(cleanRelPath(id), "/")
+	if !ok || batch == "" || origin == "" {
+		return "", "", fmt.Errorf("invalid trash item %q", id)
+	}
+	return trashFile, origin, nil
+}
+
+// pruneTrash removes dir and its parents inside the trash while they are
+// empty, after a file was restored or purged.
+func pruneTrash(dir string) {
+	for dir != trashPath() && strings.HasPrefix(dir, trashPath()+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// trashHandler serves GET /trash: the files in the trash, as JSON on
+// request, with restore and purge buttons otherwise.
+func trashHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !C.Trash {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	items, err := listTrash(r.Context())
+	if err != nil {
+		logger.Errorf("Could not read trash %s: %v", trashPath(), err)
+		http.Error(w, "Could not read trash", http.StatusInternalServerError)
+		return
+	}
+	if wantsJSON(r) {
+		if items == nil {
+			items = []trashItem{}
+		}
+		writeJSON(w, r, http.StatusOK, items)
+		return
+	}
+	type itemView struct {
+		trashItem
+		Size    string
+		Deleted string
+	}
+	views := make([]itemView, len(items))
+	for i, item := range items {
+		views[i] = itemView{trashItem: item, Size: humanSize(item.Size), Deleted: item.Deleted.Format("2006-01-02 15:04:05")}
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := trashTmpl.Execute(w, views); err != nil {
+		logger.Errorf("Error rendering trash: %v", err)
+	}
+}
+
+// trashRestoreHandler handles POST /trash/restore with the field "id": it
+// moves the file back to where it was deleted from, creating its directory
+// if needed. An existing file there gives 409 unless "force" is 1.
+func trashRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !C.Trash {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	fields, err := readFields(r)
+	if err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+	trashFile, origin, err := resolveTrashItem(r.Context(), fields.Get("id"))
+	if err != nil {
+		http.Error(w, "Invalid trash item", http.StatusBadRequest)
+		return
+	}
+	info, err := os.Lstat(trashFile)
+	if err != nil || info.IsDir() {
+		http.Error(w, "Not in the trash", http.StatusNotFound)
+		return
+	}
+	toPath, err := resolvePath(r.Context(), origin)
+	if err != nil || !isServable(origin) {
+		logger.Warnf("Refused to restore %s to hidden or excluded %s", trashFile, origin)
+		http.Error(w, "Hidden or excluded files are not restored", http.StatusForbidden)
+		return
+	}
+	force := fields.Get("force") == "1"
+	if existing, err := os.Lstat(toPath); err == nil && (!force || existing.IsDir()) {
+		logger.Warnf("Refused to restore %s: /%s exists", trashFile, origin)
+		http.Error(w, fmt.Sprintf("/%s already exists", origin), http.StatusConflict)
+		return
+	}
+
+	if err := quotaReserve(info.Size()); err != nil {
+		logger.Warnf("Refused to restore /%s: %v", origin, err)
+		http.Error(w, "Cannot restore: "+err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	restored := false
+	defer func() {
+		if !restored {
+			quotaRelease(info.Size())
+		}
+	}()
+	var replaced int64
+	if existing, err := os.Lstat(toPath); err == nil {
+		replaced = usage(toPath, existing)
+	}
+	if err := os.MkdirAll(filepath.Dir(toPath), newDirMode); err != nil {
+		logger.Errorf("Could not create directory for restoring /%s: %v", origin, err)
+		http.Error(w, fmt.Sprintf("Could not create the directory of /%s", origin), http.StatusConflict)
+		return
+	}
+	if err := moveFile(r.Context(), trashFile, toPath, info, force); err != nil {
+		if errors.Is(err, errFileExists) {
+			http.Error(w, fmt.Sprintf("/%s already exists", origin), http.StatusConflict)
+			return
+		}
+		logger.Errorf("Could not restore %s to %s: %v", trashFile, toPath, err)
+		http.Error(w, "Could not restore file", http.StatusInternalServerError)
+		return
+	}
+	restored = true
+	quotaRelease(replaced)
+	pruneTrash(filepath.Dir(trashFile))
+	invalidateListingTree(filepath.Dir(toPath))
+	logger.Infof("Restored /%s from the trash", origin)
+
+	if wantsJSON(r) {
+		writeJSON(w, r, http.StatusOK, map[string]string{"path": origin})
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+// trashPurgeHandler handles POST /trash/purge: it deletes the files given
+// by one or more "id" fields for good, or the whole trash if "all" is 1.
+func trashPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !C.Trash {
+		http.NotFound(w, r)
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Could not parse form", http.StatusBadRequest)
+		return
+	}
+
+	purged := []string{}
+	if r.PostForm.Get("all") == "1" {
+		items, _ := listTrash(r.Context())
+		if err := os.RemoveAll(trashPath()); err != nil {
+			logger.Errorf("Could not empty trash %s: %v", trashPath(), err)
+			http.Error(w, "Could not empty trash", http.StatusInternalServerError)
+			return
+		}
+		for _, item := range items {
+			purged = append(purged, item.ID)
+		}
+		logger.Infof("Emptied the trash (%d files)", len(items))
+	} else {
+		ids := r.PostForm["id"]
+		if len(ids) == 0 {
+			http.Error(w, "Missing id, or all=1 to empty the trash", http.StatusBadRequest)
+			return
+		}
+		for _, id := range ids {
+			trashFile, _, err := resolveTrashItem(r.Context(), id)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Invalid trash item %q", id), http.StatusBadRequest)
+				return
+			}
+			if err := os.Remove(trashFile); err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					continue // Purged meanwhile, which is what was asked
+				}
+				logger.Errorf("Could not purge %s: %v", trashFile, err)
+				http.Error(w, fmt.Sprintf("Could not purge %s", id), http.StatusInternalServerError)
+				return
+			}
+			pruneTrash(filepath.Dir(trashFile))
+			purged = append(purged, id)
+			logger.Infof("Purged %s from the trash", id)
+		}
+	}
+
+	if wantsJSON(r) {
+		writeJSON(w, r, http.StatusOK, map[string][]string{"purged": purged})
+		return
+	}
+	http.Redirect(w, r, "/trash", http.StatusSeeOther)
+}
+
+const trashHTML = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>Trash - File Server</title>
+    <style>
+        body { font-family: sans-serif; }
+        .container { max-width: 800px; margin: auto; padding: 20px; }
+        table { border-collapse: collapse; width: 100%; }
+        td { padding: 0.3em 0.5em; border-bottom: 1px solid #eee; }
+        td form { display: inline; }
+        .meta { color: #555; white-space: nowrap; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <a href="/">&larr; back to listing</a>
+        <h1>Trash</h1>
+        {{if .}}
+        <table>
+            {{range .}}
+            <tr>
+                <td>/{{.Path}}</td>
+                <td class="meta">{{.Size}}</td>
+                <td class="meta">deleted {{.Deleted}}</td>
+                <td>
+                    <form method="post" action="/trash/restore"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Restore</button></form>
+                    <form method="post" action="/trash/purge" onsubmit="return confirm('Delete /{{.Path}} for good?')"><input type="hidden" name="id" value="{{.ID}}"><button type="submit">Purge</button></form>
+                </td>
+            </tr>
+            {{end}}
+        </table>
+        <form method="post" action="/trash/purge" onsubmit="return confirm('Delete all files in the trash for good?')">
+            <input type="hidden" name="all" value="1">
+            <p><button type="submit">Empty Trash</button></p>
+        </form>
+        {{else}}
+        <p>The trash is empty.</p>
+        {{end}}
+    </div>
+</body>
+</html>
+`
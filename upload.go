@@ -0,0 +1,521 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Values accepted by --on-conflict.
+const (
+	conflictOverwrite = "overwrite"
+	conflictRename    = "rename"
+	conflictReject    = "reject"
+)
+
+// maxRenameAttempts bounds the "name (N).ext" search of the rename policy.
+const maxRenameAttempts = 10000
+
+// errFileExists is returned by placeUploadFile when the reject policy
+// refuses to replace an existing file.
+var errFileExists = errors.New("file already exists")
+
+func validateConflictPolicy(policy string) error {
+	switch policy {
+	case conflictOverwrite, conflictRename, conflictReject:
+		return nil
+	default:
+		return fmt.Errorf("invalid --on-conflict %q (valid: %s, %s, %s)", policy, conflictOverwrite, conflictRename, conflictReject)
+	}
+}
+
+// uploadOptions tune how a single uploaded file is stored.
+type uploadOptions struct {
+	expectedSum string            // Verify the content against this SHA-256, when not empty
+	policy      string            // Conflict policy, --on-conflict unless the client chose one
+	xattrs      map[string]string // Extended attributes to set, see --expose-xattrs
+}
+
+// parseResolution maps a per-file conflict resolution chosen by the client
+// (overwrite, rename or skip) to the conflict policy applied to that file.
+func parseResolution(value string) (string, error) {
+	switch strings.TrimSpace(value) {
+	case "overwrite":
+		return conflictOverwrite, nil
+	case "rename":
+		return conflictRename, nil
+	case "skip":
+		return conflictReject, nil
+	default:
+		return "", fmt.Errorf("invalid resolution %q (valid: overwrite, rename, skip)", value)
+	}
+}
+
+// uploadResult describes what happened to one file of an upload request.
+type uploadResult struct {
+	OriginalName string `json:"originalName"`
+	StoredName   string `json:"storedName,omitempty"` // Relative to the served directory
+	Size         int64  `json:"size"`
+	SHA256       string `json:"sha256,omitempty"`
+	Error        string `json:"error,omitempty"`
+	status       int
+}
+
+// uploadStatus is the overall HTTP status of an upload request: 200 when
+// every file was stored, 207 when only some were, and otherwise the status
+// shared by all failures (400 if they differ).
+func uploadStatus(results []uploadResult) int {
+	failed, status := 0, 0
+	for _, result := range results {
+		if result.Error == "" {
+			continue
+		}
+		failed++
+		if status == 0 {
+			status = result.status
+		} else if status != result.status {
+			status = http.StatusBadRequest
+		}
+	}
+	switch {
+	case failed == 0:
+		return http.StatusOK
+	case failed < len(results):
+		return http.StatusMultiStatus
+	default:
+		return status
+	}
+}
+
+// failedUpload builds the result of a part that could not be stored.
+func failedUpload(originalName string, status int, format string, args ...interface{}) uploadResult {
+	return uploadResult{OriginalName: originalName, Error: fmt.Sprintf(format, args...), status: status}
+}
+
+// uploadRefused is the answer of upload-only mode to every failure that
+// depends on what already exists in the served directory, so that
+// submitters cannot probe it for the files of others.
+const uploadRefused = "The file cannot be stored here"
+
+// refusedUpload is failedUpload for failures that depend on existing files,
+// see uploadRefused.
+func refusedUpload(originalName string, status int, format string, args ...interface{}) uploadResult {
+	if C.UploadOnly {
+		return failedUpload(originalName, http.StatusForbidden, "%s", uploadRefused)
+	}
+	return failedUpload(originalName, status, format, args...)
+}
+
+// refuseUpload answers a request with a failure that depends on existing
+// files, see uploadRefused.
+func refuseUpload(w http.ResponseWriter, msg string, status int) {
+	if C.UploadOnly {
+		msg, status = uploadRefused, http.StatusForbidden
+	}
+	http.Error(w, msg, status)
+}
+
+// concealStoredNames drops the names files were stored under in upload-only
+// mode: an upload stored as "essay (1).txt" tells that "essay.txt" exists.
+func concealStoredNames(results []uploadResult) {
+	if !C.UploadOnly {
+		return
+	}
+	for i := range results {
+		results[i].StoredName = ""
+	}
+}
+
+// storeUploadPart stores one file part of a multipart upload into uploadDir,
+// the directory relUploadDir, and reports the outcome.
+func storeUploadPart(ctx context.Context, part *multipart.Part, relUploadDir, uploadDir string, opts uploadOptions) uploadResult {
+	logger := loggerFrom(ctx)
+	// Get the filename from the part
+	originalName := part.FileName()
+	filename := filepath.Base(originalName)
+
+	// With --allow-nested-upload, keep the relative path sent by the browser
+	partDir, subDir := uploadDir, ""
+	if C.AllowNestedUpload {
+		originalName = rawPartFileName(part)
+		relPath, err := sanitizeNestedPath(originalName)
+		if err != nil {
+			logger.Warnf("Rejected upload of %q: %v", originalName, err)
+			return failedUpload(originalName, http.StatusBadRequest, "invalid path: %v", err)
+		}
+		subDir, filename = path.Split(relPath)
+		partDir = filepath.Join(uploadDir, filepath.FromSlash(subDir))
+	}
+
+	relPath := path.Join(relUploadDir, subDir, filename)
+	if !isServable(relPath) {
+		logger.Warnf("Rejected upload of %q: hidden or excluded", originalName)
+		return failedUpload(originalName, http.StatusForbidden, "hidden or excluded files are not accepted")
+	}
+	if _, err := resolvePath(ctx, relPath); err != nil {
+		logger.Warnf("Rejected upload of %q: %v", originalName, err)
+		return refusedUpload(originalName, http.StatusForbidden, "invalid path: %v", err)
+	}
+	if subDir != "" {
+		if err := createSubDirs(uploadDir, subDir); err != nil {
+			if errors.Is(err, errNotADirectory) {
+				logger.Warnf("Rejected upload of %q: %v", originalName, err)
+				return refusedUpload(originalName, http.StatusConflict, "%v", err)
+			}
+			logger.Errorf("Could not create directory %s: %v", partDir, err)
+			return failedUpload(originalName, http.StatusInternalServerError, "could not create directory")
+		}
+		invalidateListingTree(partDir)
+	}
+
+	result := storeUploadStream(ctx, part, originalName, partDir, filename, opts)
+	if result.StoredName != "" {
+		result.StoredName = path.Join(subDir, result.StoredName)
+	}
+	return result
+}
+
+// errNotADirectory is returned by createSubDirs when a file or a symlink is
+// in the way of a directory.
+var errNotADirectory = errors.New("not a directory")
+
+// createSubDirs creates the directories of subDir, a sanitized relative path
+// with forward slashes, inside dir. Like /mkdir, it goes one component at a
+// time and refuses components that exist as anything but a directory,
+// symlinks included, so that no upload is written through a symlink.
+func createSubDirs(dir, subDir string) error {
+	for _, component := range strings.Split(strings.Trim(subDir, "/"), "/") {
+		dir = filepath.Join(dir, component)
+		err := os.Mkdir(dir, newDirMode)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return err
+		}
+		info, err := os.Lstat(dir)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is %w", component, errNotADirectory)
+		}
+	}
+	return nil
+}
+
+// storeUploadStream stores body as filename inside dir and reports the
+// outcome. The content is streamed into a temporary file which is moved into
+// place, applying the conflict policy, only once it is complete and matches
+// the expected checksum (when given).
+func storeUploadStream(ctx context.Context, body io.Reader, originalName, dir, filename string, opts uploadOptions) uploadResult {
+	logger := loggerFrom(ctx)
+	logger.Debugf("Starting upload of file: %s", filename)
+
+	// In upload-only mode the rename policy steps around a directory like
+	// around a file, refusing would reveal it
+	if info, err := os.Lstat(filepath.Join(dir, filename)); err == nil && info.IsDir() && !C.UploadOnly {
+		logger.Warnf("Rejected upload of %s: a directory with that name exists", filename)
+		return failedUpload(originalName, http.StatusConflict, "a directory with that name exists")
+	}
+	if uploadConflicts(dir, filename, opts.policy) {
+		logger.Warnf("Rejected upload of %s: file already exists", filename)
+		return failedUpload(originalName, http.StatusConflict, "file already exists")
+	}
+
+	// Stream into a temporary file next to the destination, so that an
+	// interrupted upload never shows up as a truncated file
+	dst, err := createPartialFile(dir, filename)
+	if err != nil {
+		logger.Errorf("Could not create temporary file for %s on server: %v", filename, err)
+		return failedUpload(originalName, http.StatusInternalServerError, "could not create file on server")
+	}
+	tmpPath := dst.Name()
+
+	// Copy from the body to the temporary file, stopping if the client
+	// goes away or the disk fills up, and hash the content on the way. dst
+	// is wrapped so that its ReadFrom, which would allocate its own buffer,
+	// is not used.
+	hasher := sha256.New()
+	buf := copyBuffers.Get().(*[]byte)
+	guard := &spaceGuard{ctx: ctx, w: dst, dir: dir}
+	fileSize, err := io.CopyBuffer(guard, io.TeeReader(contextReader{ctx, body}, hasher), *buf)
+	copyBuffers.Put(buf)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	stored := false
+	defer func() {
+		if !stored {
+			quotaRelease(guard.reserved)
+		}
+	}()
+	if errors.Is(err, errQuotaExceeded) {
+		os.Remove(tmpPath)
+		quotaRelease(guard.reserved)
+		guard.reserved = 0
+		err = quotaExceeded()
+		logger.Warnf("Aborted upload of %s after %d bytes: %v", filename, fileSize, err)
+		return failedUpload(originalName, http.StatusInsufficientStorage, "%v", err)
+	}
+	if errors.Is(err, errInsufficientStorage) || errors.Is(err, syscall.ENOSPC) {
+		logger.Errorf("Aborted upload of %s after %d bytes: %v", filename, fileSize, err)
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusInsufficientStorage, "not enough free space on the server")
+	}
+	if err != nil {
+		logger.Errorf("Could not save file %s: %v", filename, err)
+		// Remove the partial file
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusInternalServerError, "could not save file")
+	}
+
+	digest := hex.EncodeToString(hasher.Sum(nil))
+	if opts.expectedSum != "" && digest != opts.expectedSum {
+		logger.Warnf("Checksum mismatch for upload %s: expected sha256 %s, got %s", filename, opts.expectedSum, digest)
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusUnprocessableEntity, "checksum mismatch: expected sha256 %s, got %s", opts.expectedSum, digest)
+	}
+
+	if err := writeXattrs(tmpPath, opts.xattrs); errors.Is(err, errXattrUnsupported) {
+		logger.Warnf("Extended attributes of upload %s not kept: %v", filename, err)
+	} else if err != nil {
+		logger.Errorf("Could not set extended attributes of upload %s: %v", filename, err)
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusInternalServerError, "could not set extended attributes")
+	}
+
+	// Move the completed file into place, applying the conflict policy. An
+	// overwritten file no longer counts against the quota.
+	replaced := replacedSize(filepath.Join(dir, filename), opts.policy)
+	storedName, err := placeUploadFile(tmpPath, dir, filename, opts.policy)
+	if err == errFileExists {
+		logger.Warnf("Rejected upload of %s: file already exists", filename)
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusConflict, "file already exists")
+	}
+	if err != nil {
+		logger.Errorf("Could not move %s into place as %s: %v", tmpPath, filename, err)
+		os.Remove(tmpPath)
+		return failedUpload(originalName, http.StatusInternalServerError, "could not save file")
+	}
+	stored = true
+	quotaRelease(replaced)
+	uploadsTotal.Inc()
+	countTransfer(directionUpload, fileSize)
+	invalidateListing(dir)
+
+	if storedName != filename {
+		logger.Infof("Completed upload of file: %s as %s (size: %d bytes, sha256: %s)", filename, storedName, fileSize, digest)
+	} else {
+		logger.Infof("Completed upload of file: %s (size: %d bytes, sha256: %s)", filename, fileSize, digest)
+	}
+	return uploadResult{
+		OriginalName: originalName,
+		StoredName:   storedName,
+		Size:         fileSize,
+		SHA256:       digest,
+		status:       http.StatusOK,
+	}
+}
+
+// resolveUploadDir validates the target directory of an upload, relative to
+// the served directory, creating it when --mkdir-on-upload is set.
+func resolveUploadDir(ctx context.Context, relDir string) (string, error) {
+	dir, err := resolvePath(ctx, relDir)
+	if err != nil {
+		return "", err
+	}
+	if !isServableDir(relDir) {
+		return "", errNotServed
+	}
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) && C.MkdirOnUpload {
+		loggerFrom(ctx).Infof("Creating upload directory %s", dir)
+		defer invalidateListingTree(dir)
+		return dir, os.MkdirAll(dir, newDirMode)
+	}
+	if err != nil {
+		return "", fmt.Errorf("directory %s does not exist", relDir)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", relDir)
+	}
+	return dir, nil
+}
+
+// rawPartFileName returns the filename of a multipart part as sent by the
+// client. Unlike part.FileName() it keeps directory components, which
+// browsers send for folder uploads (e.g. "photos/2023/img.jpg").
+func rawPartFileName(part *multipart.Part) string {
+	_, params, err := mime.ParseMediaType(part.Header.Get("Content-Disposition"))
+	if err != nil {
+		return part.FileName()
+	}
+	return params["filename"]
+}
+
+// sanitizeNestedPath validates every component of the relative path of a
+// folder upload and returns it cleaned, with forward slashes.
+func sanitizeNestedPath(rawPath string) (string, error) {
+	rawPath = strings.ReplaceAll(rawPath, "\\", "/")
+	if strings.HasPrefix(rawPath, "/") || filepath.IsAbs(rawPath) || filepath.VolumeName(rawPath) != "" {
+		return "", fmt.Errorf("absolute paths are not allowed")
+	}
+	components := strings.Split(rawPath, "/")
+	for _, c := range components {
+		switch {
+		case c == "" || c == ".":
+			return "", fmt.Errorf("empty path component")
+		case c == "..":
+			return "", fmt.Errorf("parent directory components are not allowed")
+		case strings.ContainsRune(c, 0):
+			return "", fmt.Errorf("invalid character in %q", c)
+		}
+	}
+	return strings.Join(components, "/"), nil
+}
+
+// parseSHA256 validates a client supplied SHA-256 checksum in hex form.
+func parseSHA256(value string) (string, error) {
+	sum := strings.ToLower(strings.TrimSpace(value))
+	if _, err := hex.DecodeString(sum); err != nil || len(sum) != sha256.Size*2 {
+		return "", fmt.Errorf("invalid sha256 checksum %q", value)
+	}
+	return sum, nil
+}
+
+// partialMarker is part of the name of every temporary upload file, which
+// is written next to its final destination and renamed into place once complete.
+const partialMarker = ".hfs-partial-"
+
+// isPartialFile reports whether name is an in-progress (or orphaned) upload.
+func isPartialFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, partialMarker)
+}
+
+// createPartialFile creates the temporary file an upload named filename is
+// streamed into, as ".<filename>.hfs-partial-<random>" inside dir.
+func createPartialFile(dir, filename string) (*os.File, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, err
+	}
+	tmpPath := filepath.Join(dir, "."+filename+partialMarker+hex.EncodeToString(random))
+	return os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+}
+
+// uploadConflicts reports whether an upload of filename into dir would be
+// rejected by the conflict policy, so it can be skipped before receiving
+// its content. placeUploadFile still makes the final decision.
+func uploadConflicts(dir, filename, policy string) bool {
+	if policy != conflictReject {
+		return false
+	}
+	_, err := os.Lstat(filepath.Join(dir, filename))
+	return err == nil
+}
+
+// placeUploadFile moves the completed temporary file tmpPath to filename
+// inside dir, applying the conflict policy, and returns the name it was
+// finally stored under. The reject and rename policies place the file with
+// a hard link, which fails if the target exists, so two concurrent uploads
+// can never both claim the same name.
+func placeUploadFile(tmpPath, dir, filename, policy string) (string, error) {
+	switch policy {
+	case conflictReject:
+		return filename, placeNoClobber(tmpPath, filepath.Join(dir, filename))
+	case conflictRename:
+		ext := filepath.Ext(filename)
+		stem := strings.TrimSuffix(filename, ext)
+		candidate := filename
+		for i := 1; i <= maxRenameAttempts; i++ {
+			err := placeNoClobber(tmpPath, filepath.Join(dir, candidate))
+			if err != errFileExists {
+				return candidate, err
+			}
+			candidate = fmt.Sprintf("%s (%d)%s", stem, i, ext)
+		}
+		return "", fmt.Errorf("no free name found for %s after %d attempts", filename, maxRenameAttempts)
+	default:
+		return filename, os.Rename(tmpPath, filepath.Join(dir, filename))
+	}
+}
+
+// placeNoClobber moves tmpPath to dstPath unless dstPath already exists.
+func placeNoClobber(tmpPath, dstPath string) error {
+	err := os.Link(tmpPath, dstPath)
+	if errors.Is(err, os.ErrExist) {
+		return errFileExists
+	}
+	if err != nil {
+		// Filesystems without hard links: fall back to a (racy) check and rename
+		if _, statErr := os.Lstat(dstPath); statErr == nil {
+			return errFileExists
+		}
+		return os.Rename(tmpPath, dstPath)
+	}
+	return os.Remove(tmpPath)
+}
+
+// cleanupPartialFiles removes orphaned temporary upload files older than
+// maxAge, left behind by a crash or a killed server.
+func cleanupPartialFiles(dir string, maxAge time.Duration) {
+	removed := 0
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Warnf("Could not scan %s for stale partial uploads: %v", path, err)
+			return nil
+		}
+		if d.IsDir() || !isPartialFile(d.Name()) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			log.Warnf("Could not remove stale partial upload %s: %v", path, err)
+			return nil
+		}
+		log.Infof("Removed stale partial upload %s", path)
+		removed++
+		return nil
+	})
+	if err != nil {
+		log.Warnf("Could not scan %s for stale partial uploads: %v", dir, err)
+	}
+	if removed > 0 {
+		log.Infof("Removed %d stale partial uploads", removed)
+	}
+}
+
+// contextReader stops a copy as soon as ctx is done, so that an upload from
+// a client that went away is abandoned promptly.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (cr contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.r.Read(p)
+}
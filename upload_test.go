@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// uploadJSON sends an upload asking for the JSON results.
+func uploadJSON(t *testing.T, req *http.Request) (int, []uploadResult) {
+	t.Helper()
+	req.Header.Set("Accept", "application/json")
+	resp, body := send(t, req)
+	var results []uploadResult
+	if err := json.Unmarshal([]byte(body), &results); err != nil {
+		t.Fatalf("invalid upload results %q: %v", body, err)
+	}
+	return resp.StatusCode, results
+}
+
+func TestNestedUploadThroughSymlinkedDirectory(t *testing.T) {
+	server, dir := newTestServer(t, "--allow-nested-upload")
+	outside := t.TempDir()
+	if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "inside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "inside"), filepath.Join(dir, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	status, results := uploadJSON(t, multipartUpload(t, server.URL+"/upload", nil, [][2]string{
+		{"out/evil.iso", "evil"},
+		{"out/sub/evil.iso", "evil"},
+		{"link/evil.iso", "evil"},
+		{"photos/2023/a.jpg", "photo"},
+	}))
+	if status != http.StatusMultiStatus {
+		t.Errorf("status %d, want 207", status)
+	}
+	for i, result := range results[:3] {
+		if result.Error == "" {
+			t.Errorf("upload of %s through a symlink was accepted: %+v", results[i].OriginalName, result)
+		}
+	}
+	if results[3].Error != "" || results[3].StoredName != "photos/2023/a.jpg" {
+		t.Errorf("upload next to the refused ones: %+v", results[3])
+	}
+
+	if entries, _ := os.ReadDir(outside); len(entries) != 0 {
+		t.Errorf("upload escaped the served directory: %v", entries)
+	}
+	if entries, _ := os.ReadDir(filepath.Join(dir, "inside")); len(entries) != 0 {
+		t.Errorf("upload was written through a symlink: %v", entries)
+	}
+}
+
+func TestParseSHA256(t *testing.T) {
+	sum := sha256Hex("hello")
+	for value, want := range map[string]string{
+		sum:                  sum,
+		strings.ToUpper(sum): sum,
+		" " + sum + "\n":     sum,
+		sum[:63]:             "",
+		sum + "0":            "",
+		"z" + sum[1:]:        "",
+		"":                   "",
+		"sha256:" + sum[:57]: "",
+	} {
+		got, err := parseSHA256(value)
+		if got != want || (err == nil) != (want != "") {
+			t.Errorf("parseSHA256(%q) = %q, %v; want %q", value, got, err, want)
+		}
+	}
+}
+
+func sha256Hex(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestPutVerifiesChecksum(t *testing.T) {
+	server, dir := newTestServer(t)
+	content := "build artifact"
+
+	for _, tc := range []struct {
+		name, header string
+		want         int
+		stored       bool
+	}{
+		{"absent.bin", "", http.StatusCreated, true},
+		{"matching.bin", sha256Hex(content), http.StatusCreated, true},
+		{"mismatching.bin", sha256Hex("something else"), http.StatusUnprocessableEntity, false},
+	} {
+		req := newRequest(t, http.MethodPut, server.URL+"/files/"+tc.name, strings.NewReader(content))
+		if tc.header != "" {
+			req.Header.Set("X-Content-SHA256", tc.header)
+		}
+		resp, body := send(t, req)
+		if resp.StatusCode != tc.want {
+			t.Errorf("PUT %s: %d %q, want %d", tc.name, resp.StatusCode, body, tc.want)
+		}
+		if tc.stored && resp.Header.Get("X-Stored-Sha256") != sha256Hex(content) {
+			t.Errorf("PUT %s: X-Stored-Sha256 %q, want the digest of the content", tc.name, resp.Header.Get("X-Stored-Sha256"))
+		}
+		if !tc.stored && (!strings.Contains(body, tc.header) || !strings.Contains(body, sha256Hex(content))) {
+			t.Errorf("PUT %s: %q does not name the expected and actual digests", tc.name, body)
+		}
+	}
+	want := map[string]string{"absent.bin": content, "matching.bin": content}
+	if got := snapshot(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored files %v, want %v", got, want)
+	}
+}
+
+func TestMultipartUploadVerifiesChecksums(t *testing.T) {
+	server, dir := newTestServer(t)
+
+	// A sha256 field applies to the next file only
+	status, results := uploadJSON(t, multipartRequest(t, server.URL+"/upload", []formPart{
+		{name: "sha256", content: sha256Hex("one")},
+		{name: "files", filename: "matching.txt", content: "one"},
+		{name: "sha256", content: sha256Hex("something else")},
+		{name: "files", filename: "mismatching.txt", content: "two"},
+		{name: "files", filename: "absent.txt", content: "three"},
+	}))
+	if status != http.StatusMultiStatus || len(results) != 3 {
+		t.Fatalf("status %d, results %+v; want 207 and 3 results", status, results)
+	}
+	for i, want := range []uploadResult{
+		{OriginalName: "matching.txt", StoredName: "matching.txt", Size: 3, SHA256: sha256Hex("one")},
+		{OriginalName: "mismatching.txt"},
+		{OriginalName: "absent.txt", StoredName: "absent.txt", Size: 5, SHA256: sha256Hex("three")},
+	} {
+		got := results[i]
+		if i == 1 {
+			if !strings.Contains(got.Error, sha256Hex("something else")) || !strings.Contains(got.Error, sha256Hex("two")) {
+				t.Errorf("mismatch error %q does not name the expected and actual digests", got.Error)
+			}
+			continue
+		}
+		if got != want {
+			t.Errorf("result %d: %+v, want %+v", i, got, want)
+		}
+	}
+	want := map[string]string{"matching.txt": "one", "absent.txt": "three"}
+	if got := snapshot(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("stored files %v, want %v", got, want)
+	}
+}
+
+func TestUploadFileCap(t *testing.T) {
+	server, dir := newTestServer(t, "--max-upload-files", "3")
+	var files [][2]string
+	for i := 1; i <= 5; i++ {
+		files = append(files, [2]string{fmt.Sprintf("%d.txt", i), "x"})
+	}
+
+	resp, body := send(t, multipartUpload(t, server.URL+"/upload", nil, files))
+	want := "Too many files in one upload: at most 3 per request are accepted, 3 were stored. " +
+		"Upload an archive (e.g. .zip or .tar) instead, or split the upload.\n"
+	if resp.StatusCode != http.StatusRequestEntityTooLarge || body != want {
+		t.Errorf("upload of 5 files: %d %q, want 413 %q", resp.StatusCode, body, want)
+	}
+	stored := snapshot(t, dir)
+	if want := map[string]string{"1.txt": "x", "2.txt": "x", "3.txt": "x"}; !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored %v, want %v", stored, want)
+	}
+}
+
+// BenchmarkUploadManySmallFiles uploads 10,000 files of 1 KB in one
+// multipart request, straight to the handler, so that allocs/op are those
+// of the upload loop.
+func BenchmarkUploadManySmallFiles(b *testing.B) {
+	const files = 10000
+	newTestServer(b, "--max-upload-files", "0")
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	content := bytes.Repeat([]byte("x"), 1024)
+	for i := 0; i < files; i++ {
+		part, err := form.CreateFormFile("files", fmt.Sprintf("%05d.txt", i))
+		if err != nil {
+			b.Fatal(err)
+		}
+		part.Write(content)
+	}
+	form.Close()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(body.Len()))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/upload", bytes.NewReader(body.Bytes()))
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		req.Header.Set("Accept", "application/json")
+		recorder := httptest.NewRecorder()
+		uploadFileHandler(recorder, req)
+		if recorder.Code != http.StatusOK {
+			b.Fatalf("upload: %d %s", recorder.Code, recorder.Body.String()[:min(recorder.Body.Len(), 200)])
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// uploadRetryAfterSecs is sent with 503 when all upload slots stay busy.
+const uploadRetryAfterSecs = 30
+
+// uploadSlots limits the number of concurrent uploads to
+// --max-concurrent-uploads. It is nil, meaning unlimited, by default.
+var uploadSlots chan struct{}
+
+// activeUploads counts the uploads in progress, for the logs and /api/stats.
+var activeUploads atomic.Int64
+
+// applyUploadLimit sets up --max-concurrent-uploads. It must run before the
+// server starts.
+func applyUploadLimit() {
+	if C.MaxConcurrentUploads <= 0 {
+		return
+	}
+	uploadSlots = make(chan struct{}, C.MaxConcurrentUploads)
+	log.Infof("At most %d concurrent uploads, others wait up to %s", C.MaxConcurrentUploads, C.UploadQueueWait)
+}
+
+// uploading guards the upload handlers: an upload whose Content-Length
+// would leave less than --min-free-space, or go over --quota, gets 507 at
+// once. Over --max-concurrent-uploads, a request waits up to
+// --upload-queue-wait for a free slot and then gets 503 with Retry-After.
+// The slot is released however the handler ends, be it a failed copy or a
+// client that went away.
+func uploading(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger := loggerFrom(r.Context())
+		if r.ContentLength > 0 && checkFreeSpace(r.Context(), C.DirpathToServe, r.ContentLength) != nil {
+			http.Error(w, "Not enough free space on the server", http.StatusInsufficientStorage)
+			return
+		}
+		if err := quotaCheck(r.ContentLength); err != nil {
+			logger.Warnf("Refused upload of %d bytes from %s: %v", r.ContentLength, clientAddr(r), err)
+			http.Error(w, "Upload too large: "+err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		if uploadSlots != nil {
+			timer := time.NewTimer(C.UploadQueueWait)
+			select {
+			case uploadSlots <- struct{}{}:
+				timer.Stop()
+				defer func() { <-uploadSlots }()
+			case <-timer.C:
+				logger.Warnf("Refused upload from %s: %d uploads in progress", clientAddr(r), activeUploads.Load())
+				w.Header().Set("Retry-After", strconv.Itoa(uploadRetryAfterSecs))
+				http.Error(w, "Too many uploads in progress, try again later", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		active := activeUploads.Add(1)
+		activeTransfers.WithLabelValues(directionUpload).Inc()
+		defer activeTransfers.WithLabelValues(directionUpload).Dec()
+		defer func() {
+			logger.Debugf("Upload from %s ended, %d uploads in progress", clientAddr(r), activeUploads.Add(-1))
+		}()
+		logger.Infof("Upload from %s started, %d uploads in progress", clientAddr(r), active)
+		handler(w, r)
+	}
+}
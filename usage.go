@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// dirTotalsMaxAge is how long the totals of the served directory are kept
+// when no change is seen, as fsnotify does not see every change made
+// outside the server.
+const dirTotalsMaxAge = 5 * time.Minute
+
+// dirTotals counts the regular files below a directory.
+type dirTotals struct {
+	Files int64
+	Bytes int64
+}
+
+// servedTotals caches the totals of the served directory, shown in the
+// footer of the index page and by /api/stats. Walking a huge tree takes a
+// while, so it is done in the background and never by a request.
+var servedTotals struct {
+	mu       sync.Mutex
+	totals   dirTotals
+	computed time.Time // Zero until the first walk is done
+	stale    bool
+	walking  bool
+}
+
+// walkTotals walks dirPath for its totals, without the trash and without
+// following symlinks.
+func walkTotals(dirPath string) dirTotals {
+	var totals dirTotals
+	filepath.WalkDir(dirPath, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && filePath == trashPath() {
+			return filepath.SkipDir
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				totals.Files++
+				totals.Bytes += info.Size()
+			}
+		}
+		return nil
+	})
+	return totals
+}
+
+// currentTotals returns the totals of the served directory, and false while
+// they are first computed. Totals that are stale or too old are still
+// returned, while a walk in the background updates them.
+func currentTotals() (dirTotals, bool) {
+	servedTotals.mu.Lock()
+	defer servedTotals.mu.Unlock()
+	ready := !servedTotals.computed.IsZero()
+	outdated := !ready || servedTotals.stale || time.Since(servedTotals.computed) > dirTotalsMaxAge
+	if outdated && !servedTotals.walking {
+		servedTotals.walking = true
+		servedTotals.stale = false
+		go updateTotals()
+	}
+	return servedTotals.totals, ready
+}
+
+func updateTotals() {
+	start := time.Now()
+	totals := walkTotals(C.DirpathToServe)
+	log.Debugf("Counted %d files, %d bytes in the served directory in %s", totals.Files, totals.Bytes, time.Since(start))
+	servedTotals.mu.Lock()
+	servedTotals.totals = totals
+	servedTotals.computed = time.Now()
+	servedTotals.walking = false
+	servedTotals.mu.Unlock()
+}
+
+// footerLine sums up the served directory for the footer of the index page,
+// e.g. "87 files · 12.4 GB used · 310.0 GB free".
+func footerLine() string {
+	parts := []string{"calculating…"}
+	if totals, ok := currentTotals(); ok {
+		parts = []string{fmt.Sprintf("%d files", totals.Files), humanSize(totals.Bytes) + " used"}
+	}
+	if free, err := freeSpace(C.DirpathToServe); err == nil {
+		parts = append(parts, humanSize(free)+" free")
+	}
+	return strings.Join(parts, " · ")
+}
+
+// invalidateTotals marks the totals of the served directory as stale, to be
+// recomputed when they are next asked for.
+func invalidateTotals() {
+	servedTotals.mu.Lock()
+	servedTotals.stale = true
+	servedTotals.mu.Unlock()
+}
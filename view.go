@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	chromahtml "github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var (
+	markdown = goldmark.New(goldmark.WithExtensions(extension.GFM))
+	// sanitizer strips scripts, styles, event handler attributes and
+	// javascript: URLs, so that an uploaded file cannot run code in the
+	// browsers of other users
+	sanitizer = bluemonday.UGCPolicy()
+	viewTmpl  = template.Must(template.New("view").Parse(viewHTML))
+
+	// Line numbers link to #L<n> anchors, for sharing excerpts
+	codeFormatter = chromahtml.New(chromahtml.WithClasses(true), chromahtml.WithLineNumbers(true),
+		chromahtml.WithLinkableLineNumbers(true, "L"))
+	codeStyle = styles.Get("github")
+	codeCSS   = func() template.CSS {
+		var css bytes.Buffer
+		if err := codeFormatter.WriteCSS(&css, codeStyle); err != nil {
+			panic(err)
+		}
+		return template.CSS(css.String())
+	}()
+)
+
+// binarySniffLen is how much of a file is checked for NUL bytes, which
+// text files do not contain.
+const binarySniffLen = 8 << 10
+
+// isMarkdown reports whether name is rendered as HTML by /view/.
+func isMarkdown(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".md", ".markdown":
+		return true
+	}
+	return false
+}
+
+// hasPreview reports whether the listing links name to /view/, judged by
+// the extension only.
+func hasPreview(name string) bool {
+	// Logs have no lexer, but are what gets shared most
+	return isMarkdown(name) || strings.EqualFold(path.Ext(name), ".log") || lexers.Match(name) != nil
+}
+
+// isTextType reports whether content of type ctype is shown by /view/.
+func isTextType(ctype string) bool {
+	mediaType, _, err := mime.ParseMediaType(ctype)
+	if err != nil {
+		return false
+	}
+	switch mediaType {
+	case "application/json", "application/xml", "application/javascript", "application/x-sh":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// viewHandler serves GET /view/<path>: Markdown files rendered to sanitized
+// HTML and other text files syntax highlighted, both inside a page with a
+// link to the raw file. Markdown files above --view-max-size get 413, text
+// files are cut off there. Binary files are redirected to their download,
+// other types get 415.
+func viewHandler(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFrom(r.Context())
+	if !allowMethods(w, r, http.MethodGet, http.MethodHead) {
+		return
+	}
+	relPath := strings.TrimPrefix(r.URL.Path, "/view/")
+	filePath, err := resolvePath(r.Context(), relPath)
+	if err != nil || !isServable(relPath) {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			logger.Errorf("Error opening file %s: %v", filePath, err)
+			http.Error(w, "Error opening file", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		logger.Errorf("Error getting file info for %s: %v", filePath, err)
+		http.Error(w, "Error opening file", http.StatusInternalServerError)
+		return
+	}
+	if info.IsDir() {
+		http.Error(w, "Cannot view a directory", http.StatusBadRequest)
+		return
+	}
+
+	name := path.Base(cleanRelPath(relPath))
+	markdownFile := isMarkdown(name)
+	if markdownFile && info.Size() > C.ViewMaxSize {
+		http.Error(w, "File too large to view, download it instead", http.StatusRequestEntityTooLarge)
+		return
+	}
+	content, err := io.ReadAll(io.LimitReader(file, C.ViewMaxSize))
+	if err != nil {
+		logger.Errorf("Error reading file %s: %v", filePath, err)
+		http.Error(w, "Error reading file", http.StatusInternalServerError)
+		return
+	}
+	if !markdownFile && bytes.IndexByte(content[:min(len(content), binarySniffLen)], 0) >= 0 {
+		http.Redirect(w, r, (&url.URL{Path: "/download/" + cleanRelPath(relPath)}).String(), http.StatusFound)
+		return
+	}
+	if !markdownFile && !isTextType(detectContentType(file, name)) && lexers.Match(name) == nil {
+		http.Error(w, "Only Markdown and text files can be viewed", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	data := struct {
+		Name      string
+		Path      string
+		Back      string // The listing the page was opened from
+		HTML      template.HTML
+		CSS       template.CSS
+		Truncated string // Human readable size shown, if not the whole file
+	}{
+		Name: name,
+		Path: cleanRelPath(relPath),
+		Back: returnURL(r, cleanRelPath(path.Dir(cleanRelPath(relPath)))),
+		CSS:  codeCSS,
+	}
+	if markdownFile {
+		var rendered bytes.Buffer
+		if err := markdown.Convert(content, &rendered); err != nil {
+			logger.Errorf("Error rendering %s: %v", filePath, err)
+			http.Error(w, "Error rendering file", http.StatusInternalServerError)
+			return
+		}
+		data.HTML = template.HTML(sanitizer.SanitizeBytes(rendered.Bytes()))
+	} else {
+		if info.Size() > int64(len(content)) {
+			data.Truncated = humanSize(int64(len(content)))
+		}
+		data.HTML, err = highlight(name, content)
+		if err != nil {
+			logger.Errorf("Error highlighting %s: %v", filePath, err)
+			http.Error(w, "Error rendering file", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// Second line of defense behind the sanitizer: no scripts at all
+	w.Header().Set("Content-Security-Policy", "default-src 'none'; img-src * data:; style-src 'unsafe-inline'")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if r.Method == http.MethodHead {
+		return
+	}
+	if err := viewTmpl.Execute(w, data); err != nil {
+		logger.Errorf("Error rendering view of %s: %v", filePath, err)
+	}
+}
+
+// highlight renders content as HTML with line numbers, picking the language
+// from the extension of name. Unknown languages are shown as plain text.
+func highlight(name string, content []byte) (template.HTML, error) {
+	lexer := lexers.Match(name)
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+	iterator, err := chroma.Coalesce(lexer).Tokenise(nil, string(content))
+	if err != nil {
+		return "", err
+	}
+	var rendered bytes.Buffer
+	if err := codeFormatter.Format(&rendered, codeStyle, iterator); err != nil {
+		return "", err
+	}
+	return template.HTML(rendered.String()), nil
+}
+
+const viewHTML = `
+<!DOCTYPE html>
+<html>
+<head>
+    <title>{{.Name}} - File Server</title>
+    <style>
+        body { font-family: sans-serif; }
+        .container { max-width: 800px; margin: auto; padding: 20px; }
+        .links a { margin-right: 1em; }
+        pre { background: #f6f8fa; padding: 10px; overflow-x: auto; }
+        img { max-width: 100%; }
+        table { border-collapse: collapse; }
+        th, td { border: 1px solid #ccc; padding: 4px 8px; }
+        .truncated { background: #fff3cd; padding: 8px; margin-bottom: 10px; }
+        {{.CSS}}
+    </style>
+</head>
+<body>
+    <div class="container">
+        <div class="links"><a href="{{.Back}}">&larr; back to listing</a><a href="/download/{{.Path}}">download raw</a></div>
+        <h1>{{.Name}}</h1>
+        {{if .Truncated}}<div class="truncated">Truncated: only the first {{.Truncated}} are shown, download the file for the rest.</div>{{end}}
+        {{.HTML}}
+    </div>
+</body>
+</html>
+`
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// xattrPrefix is the namespace of the extended attributes the server
+// copies, lists and sets: those of the users, not of the system.
+const xattrPrefix = "user."
+
+// maxXattrSize caps the value of an extended attribute set by an upload.
+const maxXattrSize = 1024
+
+// xattrFieldPrefix and xattrHeaderPrefix name the form fields and headers
+// that set extended attributes on upload, e.g. the field xattr.user.source
+// before a file, or the header X-Xattr-User.Source for every file.
+const (
+	xattrFieldPrefix  = "xattr."
+	xattrHeaderPrefix = "X-Xattr-"
+)
+
+// errXattrUnsupported is returned where the platform or the filesystem
+// has no extended attributes.
+var errXattrUnsupported = errors.New("extended attributes are not supported")
+
+// validateExposedXattrs checks the names of --expose-xattrs: only user.*
+// attributes may be listed and set.
+func validateExposedXattrs() error {
+	for _, name := range C.ExposeXattrs {
+		if !strings.HasPrefix(name, xattrPrefix) || len(name) == len(xattrPrefix) || strings.IndexFunc(name, notXattrNameRune) >= 0 {
+			return fmt.Errorf("invalid --expose-xattrs name %q (e.g. user.source)", name)
+		}
+	}
+	return nil
+}
+
+// notXattrNameRune reports whether r may not be part of an attribute name.
+func notXattrNameRune(r rune) bool {
+	return !(r < utf8.RuneSelf && (unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("._-", r)))
+}
+
+// exposedXattrs returns the attributes of --expose-xattrs that the file at
+// filePath has, nil if none.
+func exposedXattrs(filePath string) map[string]string {
+	var attrs map[string]string
+	for _, name := range C.ExposeXattrs {
+		value, err := getXattr(filePath, name)
+		if err != nil {
+			continue
+		}
+		if attrs == nil {
+			attrs = make(map[string]string)
+		}
+		attrs[name] = string(value)
+	}
+	return attrs
+}
+
+// addXattrs fills in the exposed attributes of entries, in dirPath.
+func addXattrs(dirPath string, entries []Entry) {
+	if len(C.ExposeXattrs) == 0 {
+		return
+	}
+	for i := range entries {
+		entries[i].Xattrs = exposedXattrs(filepath.Join(dirPath, entries[i].Name))
+	}
+}
+
+// copyXattrs gives the file at to the user.* attributes of the file at
+// from, as a copy made by the server must keep them. Where there are none
+// to be had, it does nothing.
+func copyXattrs(from, to string) error {
+	names, err := listXattrs(from)
+	if errors.Is(err, errXattrUnsupported) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrPrefix) {
+			continue
+		}
+		value, err := getXattr(from, name)
+		if err != nil {
+			return err
+		}
+		if err := setXattr(to, name, value); errors.Is(err, errXattrUnsupported) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// exposedXattrName returns the name in --expose-xattrs that key, the rest
+// of a form field or header name, stands for. Header names come
+// capitalized, so the case is ignored.
+func exposedXattrName(key string) (string, bool) {
+	for _, name := range C.ExposeXattrs {
+		if strings.EqualFold(name, key) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+// setUploadXattr adds the attribute key, the rest of a form field or header
+// name, with value to attrs. Only attributes of --expose-xattrs can be set,
+// with printable values of at most maxXattrSize bytes.
+func setUploadXattr(attrs map[string]string, key, value string) error {
+	name, ok := exposedXattrName(key)
+	if !ok {
+		return fmt.Errorf("extended attribute %q cannot be set, see --expose-xattrs", key)
+	}
+	if len(value) > maxXattrSize {
+		return fmt.Errorf("extended attribute %s is longer than %d bytes", name, maxXattrSize)
+	}
+	if !utf8.ValidString(value) || strings.IndexFunc(value, unicode.IsControl) >= 0 {
+		return fmt.Errorf("extended attribute %s must be printable text", name)
+	}
+	attrs[name] = value
+	return nil
+}
+
+// headerXattrs returns the attributes set by the X-Xattr-* headers of r,
+// for every file of the upload.
+func headerXattrs(r *http.Request) (map[string]string, error) {
+	attrs := make(map[string]string)
+	for key, values := range r.Header {
+		rest, ok := strings.CutPrefix(key, xattrHeaderPrefix)
+		if !ok || len(values) == 0 {
+			continue
+		}
+		if err := setUploadXattr(attrs, rest, values[0]); err != nil {
+			return nil, err
+		}
+	}
+	return attrs, nil
+}
+
+// writeXattrs sets attrs on the file at filePath.
+func writeXattrs(filePath string, attrs map[string]string) error {
+	for name, value := range attrs {
+		if err := setXattr(filePath, name, []byte(value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
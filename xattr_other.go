@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+// Extended attributes are only kept on Linux and macOS.
+
+func listXattrs(filePath string) ([]string, error) {
+	return nil, errXattrUnsupported
+}
+
+func getXattr(filePath, name string) ([]byte, error) {
+	return nil, errXattrUnsupported
+}
+
+func setXattr(filePath, name string, value []byte) error {
+	return errXattrUnsupported
+}
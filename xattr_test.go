@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// provenance are the attributes the tests give files.
+var provenance = map[string]string{"user.source": "scanner 3", "user.checksum": "sha256:abc"}
+
+// setProvenance gives the file at filePath the provenance attributes,
+// skipping the test where they cannot be set.
+func setProvenance(t *testing.T, filePath string) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("extended attributes are tested on Linux")
+	}
+	err := writeXattrs(filePath, provenance)
+	if errors.Is(err, errXattrUnsupported) {
+		t.Skipf("the filesystem of %s has no extended attributes", filePath)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// userXattrs returns the user.* attributes of the file at filePath.
+func userXattrs(t *testing.T, filePath string) map[string]string {
+	t.Helper()
+	names, err := listXattrs(filePath)
+	if err != nil {
+		t.Fatalf("attributes of %s: %v", filePath, err)
+	}
+	attrs := make(map[string]string)
+	for _, name := range names {
+		if !strings.HasPrefix(name, xattrPrefix) {
+			continue
+		}
+		value, err := getXattr(filePath, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		attrs[name] = string(value)
+	}
+	return attrs
+}
+
+func TestMoveKeepsXattrsAcrossFilesystems(t *testing.T) {
+	from := filepath.Join(t.TempDir(), "a.txt")
+	writeFile(t, filepath.Dir(from), "a.txt", "a")
+	setProvenance(t, from)
+	// /dev/shm is a filesystem of its own on most Linux systems, so that
+	// moving there copies
+	other, err := os.MkdirTemp("/dev/shm", "hfs-test")
+	if err != nil {
+		t.Skipf("no second filesystem: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(other) })
+	to := filepath.Join(other, "a.txt")
+	if err := setXattr(other, "user.probe", []byte("x")); errors.Is(err, errXattrUnsupported) {
+		t.Skip("the second filesystem has no extended attributes")
+	}
+
+	info, err := os.Lstat(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := moveFile(context.Background(), from, to, info, false); err != nil {
+		t.Fatal(err)
+	}
+	if got := userXattrs(t, to); !reflect.DeepEqual(got, provenance) {
+		t.Errorf("after the move: %v, want %v", got, provenance)
+	}
+}
+
+func TestServerKeepsXattrs(t *testing.T) {
+	server, dir := newTestServer(t, "--trash")
+	writeFile(t, dir, "a.txt", "a")
+	writeFile(t, dir, "dest/.keep", "")
+	setProvenance(t, filepath.Join(dir, "a.txt"))
+	check := func(step, rel string) {
+		t.Helper()
+		if got := userXattrs(t, filepath.Join(dir, filepath.FromSlash(rel))); !reflect.DeepEqual(got, provenance) {
+			t.Errorf("after %s: %v, want %v", step, got, provenance)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dir, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	form := url.Values{"content": {"edited"}, "mtime": {strconv.FormatInt(info.ModTime().UnixNano(), 10)}}
+	if resp, body := send(t, postForm(t, server.URL+"/save/a.txt", form)); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("save: %d %q", resp.StatusCode, body)
+	}
+	check("saving from the editor", "a.txt")
+
+	send(t, postForm(t, server.URL+"/rename", url.Values{"from": {"a.txt"}, "to": {"b.txt"}}))
+	check("a rename", "b.txt")
+	send(t, postForm(t, server.URL+"/move", url.Values{"files": {encodeFormPath("b.txt")}, "dest": {"dest"}}))
+	check("a move", "dest/b.txt")
+
+	send(t, postForm(t, server.URL+"/delete", url.Values{"files": {encodeFormPath("dest/b.txt")}}))
+	resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/trash?json=1", nil))
+	var items []trashItem
+	if err := json.Unmarshal([]byte(body), &items); err != nil || len(items) != 1 {
+		t.Fatalf("trash: %d %q, %v", resp.StatusCode, body, err)
+	}
+	check("moving to the trash", filepath.ToSlash(filepath.Join(trashDirName, items[0].ID)))
+	send(t, postForm(t, server.URL+"/trash/restore", url.Values{"id": {items[0].ID}}))
+	check("restoring from the trash", "dest/b.txt")
+}
+
+func TestExposeXattrs(t *testing.T) {
+	server, dir := newTestServer(t, "--expose-xattrs", "user.source,user.owner")
+	writeFile(t, dir, "a.txt", "a")
+	writeFile(t, dir, "plain.txt", "p")
+	setProvenance(t, filepath.Join(dir, "a.txt"))
+
+	resp, body := send(t, newRequest(t, http.MethodGet, server.URL+"/api/files", nil))
+	var l listing
+	if err := json.Unmarshal([]byte(body), &l); err != nil {
+		t.Fatalf("listing: %d %q, %v", resp.StatusCode, body, err)
+	}
+	got := map[string]map[string]string{}
+	for _, entry := range l.Entries {
+		got[entry.Name] = entry.Xattrs
+	}
+	// Only the attributes of --expose-xattrs, user.checksum is not
+	want := map[string]map[string]string{"a.txt": {"user.source": "scanner 3"}, "plain.txt": nil}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listed attributes %v, want %v", got, want)
+	}
+	if strings.Contains(body, "sha256:abc") {
+		t.Errorf("attribute not in --expose-xattrs listed: %s", body)
+	}
+
+	// Set on upload: the header for every file, the field for the next one
+	req := multipartRequest(t, server.URL+"/upload", []formPart{
+		{name: "xattr.user.source", content: "camera"},
+		{name: "files", filename: "b.txt", content: "b"},
+		{name: "files", filename: "c.txt", content: "c"},
+	})
+	req.Header.Set("X-Xattr-User.Owner", "alice")
+	if resp, body := send(t, req); resp.StatusCode != http.StatusSeeOther {
+		t.Fatalf("upload: %d %q", resp.StatusCode, body)
+	}
+	req = newRequest(t, http.MethodPut, fileURL(server, "d.txt"), strings.NewReader("d"))
+	req.Header.Set("X-Xattr-User.Source", "curl")
+	if resp, body := send(t, req); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: %d %q", resp.StatusCode, body)
+	}
+	for name, want := range map[string]map[string]string{
+		"b.txt": {"user.source": "camera", "user.owner": "alice"},
+		"c.txt": {"user.owner": "alice"},
+		"d.txt": {"user.source": "curl"},
+	} {
+		if got := userXattrs(t, filepath.Join(dir, name)); !reflect.DeepEqual(got, want) {
+			t.Errorf("uploaded %s has %v, want %v", name, got, want)
+		}
+	}
+
+	for _, tc := range []struct{ field, value string }{
+		{"xattr.user.checksum", "sha256:abc"}, // Not in --expose-xattrs
+		{"xattr.trusted.source", "x"},
+		{"xattr.user.source", strings.Repeat("x", maxXattrSize+1)},
+		{"xattr.user.source", "line\nbreak"},
+		{"xattr.user.source", "\xff"},
+	} {
+		req := multipartRequest(t, server.URL+"/upload", []formPart{
+			{name: tc.field, content: tc.value},
+			{name: "files", filename: "e.txt", content: "e"},
+		})
+		if resp, body := send(t, req); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s=%.20q: %d %q, want 400", tc.field, tc.value, resp.StatusCode, body)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "e.txt")); err == nil {
+		t.Errorf("e.txt was stored with invalid attributes")
+	}
+}
+
+func TestInvalidExposedXattrs(t *testing.T) {
+	for _, name := range []string{"source", "user.", "trusted.source", "security.selinux", "user.a b", "user.ü"} {
+		loadConfig(t, "--expose-xattrs", name)
+		if err := validateExposedXattrs(); err == nil {
+			t.Errorf("--expose-xattrs %q was accepted", name)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+//go:build linux || darwin
+
+package main
+
+import (
+	"bytes"
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// listXattrs returns the names of the extended attributes of the file at
+// filePath, without following symlinks.
+func listXattrs(filePath string) ([]string, error) {
+	for {
+		size, err := unix.Llistxattr(filePath, nil)
+		if err != nil || size == 0 {
+			return nil, xattrError(err)
+		}
+		buf := make([]byte, size)
+		size, err = unix.Llistxattr(filePath, buf)
+		if errors.Is(err, unix.ERANGE) {
+			continue // Attributes were added meanwhile
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		var names []string
+		for _, name := range bytes.Split(buf[:size], []byte{0}) {
+			if len(name) > 0 {
+				names = append(names, string(name))
+			}
+		}
+		return names, nil
+	}
+}
+
+// getXattr returns the value of the extended attribute name of the file at
+// filePath.
+func getXattr(filePath, name string) ([]byte, error) {
+	for {
+		size, err := unix.Lgetxattr(filePath, name, nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		value := make([]byte, size)
+		size, err = unix.Lgetxattr(filePath, name, value)
+		if errors.Is(err, unix.ERANGE) {
+			continue // The value grew meanwhile
+		}
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		return value[:size], nil
+	}
+}
+
+// setXattr sets the extended attribute name of the file at filePath.
+func setXattr(filePath, name string, value []byte) error {
+	return xattrError(unix.Lsetxattr(filePath, name, value, 0))
+}
+
+// xattrError turns the errors of filesystems without extended attributes
+// into errXattrUnsupported.
+func xattrError(err error) error {
+	if errors.Is(err, unix.ENOTSUP) || errors.Is(err, unix.EOPNOTSUPP) {
+		return errXattrUnsupported
+	}
+	return err
+}